@@ -0,0 +1,9 @@
+package main
+
+import "embed"
+
+// assets holds the templates, static files and migrations, so the binary
+// runs from any working directory.
+//
+//go:embed templates static migrations
+var assets embed.FS
@@ -0,0 +1,457 @@
+// Package config loads the login-ng configuration from a YAML or TOML file,
+// environment variables and command line flags.
+//
+// The precedence is, from lowest to highest: defaults, config file,
+// environment variables, flags. Every option can also be read from a file
+// named by the <ENV>_FILE environment variable, e.g. OIDC_CLIENT_SECRET_FILE,
+// which is convenient for Kubernetes secrets.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Command selects what the binary does and thereby which options are
+// required.
+type Command uint
+
+const (
+	// CommandServe runs the login portal.
+	CommandServe Command = 1 << iota
+	// CommandMigrate manages the database migrations.
+	CommandMigrate
+	// CommandPatch patches a device on behalf of its user.
+	CommandPatch
+)
+
+// Short names used in the option definitions.
+const (
+	serve   = CommandServe
+	migrate = CommandMigrate
+	patch   = CommandPatch
+)
+
+// Config is the effective configuration of the app.
+type Config struct {
+	Command Command
+
+	ConfigFile  string
+	PrintConfig bool
+
+	LogLevel  string
+	LogFormat string
+
+	DBDialect     string
+	MySQLServer   string
+	MySQLPort     string
+	MySQLDatabase string
+	MySQLUser     string
+	MySQLPassword string
+
+	OIDCIssuer       string
+	OIDCRedirectURL  string
+	OIDCClientID     string
+	OIDCClientSecret string
+
+	GecoLanID                 string
+	GecoUserstatusEndpointFmt string
+
+	SessionSecret string
+	SessionMaxAge time.Duration
+
+	EventStart            Time
+	EventEnd              Time
+	CaptiveVLAN           int
+	EventTeardownInterval time.Duration
+	EventCacheTTL         time.Duration
+
+	QuarantineVLAN int
+
+	ProgressPollInterval time.Duration
+	ProgressTimeout      time.Duration
+
+	BouncerLease      time.Duration
+	BouncerMaxRetries int
+	BouncerRetryDelay time.Duration
+
+	WebhookInterval     time.Duration
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookRetryBackoff time.Duration
+
+	EventsPublisher    string
+	EventsURL          string
+	EventsPrefix       string
+	EventsInterval     time.Duration
+	EventsTimeout      time.Duration
+	EventsRetryBackoff time.Duration
+	EventsMaxAttempts  int
+
+	Listen        string
+	MetricsListen string
+	OTLPEndpoint  string
+
+	HTTPReadTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+	ShutdownDelay         time.Duration
+	ShutdownTimeout       time.Duration
+
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	TrustedHTTPSProxy bool
+	TrustedProxies    List
+
+	AutoMigrate        bool
+	MigrateLockTimeout time.Duration
+
+	RateLimitIP      Rate
+	RateLimitSession Rate
+	RateLimitShared  bool
+
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+	HSTSMaxAge            time.Duration
+
+	AssetsDir string
+
+	AdminUsernames List
+
+	APITokens Tokens
+
+	PatchReason        string
+	PatchActor         string
+	PatchUsername      string
+	PatchBypassCheckin bool
+
+	StartupBackoffInitial time.Duration
+	StartupBackoffMax     time.Duration
+
+	ReadinessCheckTimeout time.Duration
+	ReadinessCacheTTL     time.Duration
+	MaxBouncerBacklog     int
+	MaxBouncerJobAge      time.Duration
+	ReadinessStrict       bool
+
+	fs      *flag.FlagSet
+	options []option
+}
+
+// option describes a single configuration option. The name is used as flag
+// name and as key in the config file.
+type option struct {
+	name   string
+	env    string
+	secret bool
+	// required lists the commands which need the option to be set.
+	required Command
+	// noFile marks options which are not read from the config file.
+	noFile bool
+}
+
+// define registers all options on the flag set, binding them to c.
+func (c *Config) define() {
+	c.fs = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+
+	str := func(p *string, o option, value, usage string) {
+		c.fs.StringVar(p, o.name, value, usage)
+		c.options = append(c.options, o)
+	}
+	dur := func(p *time.Duration, o option, value time.Duration, usage string) {
+		c.fs.DurationVar(p, o.name, value, usage)
+		c.options = append(c.options, o)
+	}
+	integer := func(p *int, o option, value int, usage string) {
+		c.fs.IntVar(p, o.name, value, usage)
+		c.options = append(c.options, o)
+	}
+	boolean := func(p *bool, o option, value bool, usage string) {
+		c.fs.BoolVar(p, o.name, value, usage)
+		c.options = append(c.options, o)
+	}
+	rate := func(p *Rate, o option, value Rate, usage string) {
+		*p = value
+		c.fs.Var(p, o.name, usage)
+		c.options = append(c.options, o)
+	}
+	list := func(p *List, o option, usage string) {
+		c.fs.Var(p, o.name, usage)
+		c.options = append(c.options, o)
+	}
+	timestamp := func(p *Time, o option, usage string) {
+		c.fs.Var(p, o.name, usage)
+		c.options = append(c.options, o)
+	}
+	tokens := func(p *Tokens, o option, usage string) {
+		c.fs.Var(p, o.name, usage)
+		c.options = append(c.options, o)
+	}
+
+	str(&c.ConfigFile, option{name: "config", env: "CONFIG_FILE", noFile: true}, "", "Path to a YAML (.yaml, .yml) or TOML (.toml) config file. Keys are the flag names.")
+	boolean(&c.PrintConfig, option{name: "print-config", noFile: true}, false, "Print the effective config with secrets redacted and exit.")
+
+	str(&c.LogLevel, option{name: "log-level", env: "LOG_LEVEL"}, "info", "Sets the verbosity of the logger. One of: trace, debug, info, warn, error, fatal, panic")
+	str(&c.LogFormat, option{name: "log-format", env: "LOG_FORMAT"}, "console", "Log output format. One of: console, json.")
+
+	str(&c.DBDialect, option{name: "db-dialect", env: "DB_DIALECT"}, "mysql", "Database system of FreeRADIUS and Kea. One of: mysql, postgres. The mysql-* options configure the connection for both.")
+	str(&c.MySQLServer, option{name: "mysql-server", env: "MYSQL_DB_SERVER", required: serve | migrate | patch}, "", "Database server address (required)")
+	str(&c.MySQLPort, option{name: "mysql-port", env: "MYSQL_DB_PORT", required: serve | migrate | patch}, "", "Database port number (required)")
+	str(&c.MySQLDatabase, option{name: "mysql-name", env: "MYSQL_DB_NAME", required: serve | migrate | patch}, "", "Database name (required)")
+	str(&c.MySQLUser, option{name: "mysql-user", env: "MYSQL_DB_USER", required: serve | migrate | patch}, "", "Database user (required)")
+	str(&c.MySQLPassword, option{name: "mysql-pw", env: "MYSQL_DB_PW", required: serve | migrate | patch, secret: true}, "", "Database user password (required)")
+
+	str(&c.OIDCIssuer, option{name: "oidc-issuer", env: "OIDC_ISSUER", required: serve}, "", "Geco OIDC Provider (required)")
+	str(&c.OIDCRedirectURL, option{name: "oidc-redirect-url", env: "OIDC_REDIRECT_URL", required: serve}, "", "Geco OIDC Redirect URL (required)")
+	str(&c.OIDCClientID, option{name: "oidc-client-id", env: "OIDC_CLIENT_ID", required: serve}, "", "Geco OIDC Client ID (required)")
+	str(&c.OIDCClientSecret, option{name: "oidc-client-secret", env: "OIDC_CLIENT_SECRET", required: serve, secret: true}, "", "Geco OIDC Client secret (required)")
+
+	str(&c.GecoLanID, option{name: "geco-lan-id", env: "GECO_LAN_ID", required: serve}, "", "Geco LAN ID (required). The id of the LAN event instance on the website, used for clients not matching an event of the events table.")
+	str(&c.GecoUserstatusEndpointFmt, option{name: "geco-userstatus-endpoint", env: "GECO_USERSTATUS_ENDPOINT", required: serve}, "", "Geco user status endpoint format (required). Geco API endpoint as specified on https://geco.ethz.ch/api/v1#/paths/api-v1-lan_parties-id--me/get, with %s for the LAN ID. Other percent signs must be escaped as %%.")
+
+	str(&c.SessionSecret, option{name: "session-secret", env: "SESSION_SECRET", required: serve, secret: true}, "", "Session secret (required). Must be at least 32 bytes, it is recommended to use a session key with 32 or 64 bytes.")
+	dur(&c.SessionMaxAge, option{name: "session-max-age", env: "SESSION_MAX_AGE"}, 4*24*time.Hour, "How long a login session lasts at most. Sessions end earlier if the event ends.")
+
+	timestamp(&c.EventStart, option{name: "event-start", env: "EVENT_START"}, "Start of the default event in RFC 3339, e.g. 2026-11-20T16:00:00+01:00. Devices can only be patched during the event. Open ended if empty.")
+	timestamp(&c.EventEnd, option{name: "event-end", env: "EVENT_END"}, "End of the default event in RFC 3339. Open ended if empty.")
+	integer(&c.CaptiveVLAN, option{name: "captive-vlan", env: "CAPTIVE_VLAN"}, 0, "VLAN of the captive portal. Devices are bounced back into it when their event ends. 0 disables the teardown.")
+	dur(&c.EventTeardownInterval, option{name: "event-teardown-interval", env: "EVENT_TEARDOWN_INTERVAL"}, time.Minute, "How often ended events are looked for to tear them down.")
+	dur(&c.EventCacheTTL, option{name: "event-cache-ttl", env: "EVENT_CACHE_TTL"}, 10*time.Second, "How long the events table is cached. 0 disables the cache.")
+	integer(&c.QuarantineVLAN, option{name: "quarantine-vlan", env: "QUARANTINE_VLAN"}, 0, "VLAN of quarantined devices of the blocklist. Quarantined devices are blocked if 0.")
+	dur(&c.ProgressPollInterval, option{name: "progress-poll-interval", env: "PROGRESS_POLL_INTERVAL"}, 2*time.Second, "How often the progress of a bounce job is checked for the success page.")
+	dur(&c.ProgressTimeout, option{name: "progress-timeout", env: "PROGRESS_TIMEOUT"}, 5*time.Minute, "How long after a patch the user is asked to re-plug if the device is not connected yet.")
+	dur(&c.BouncerLease, option{name: "bouncer-lease", env: "BOUNCER_LEASE"}, time.Minute, "How long a bouncer holds a job claimed through the API without heartbeat before it is handed to another bouncer.")
+	integer(&c.BouncerMaxRetries, option{name: "bouncer-max-retries", env: "BOUNCER_MAX_RETRIES"}, 5, "Failed attempts, including expired leases, after which a bounce job of the API queue is given up.")
+	dur(&c.BouncerRetryDelay, option{name: "bouncer-retry-delay", env: "BOUNCER_RETRY_DELAY"}, 10*time.Second, "How long a failed bounce job waits before it is claimed again.")
+	dur(&c.WebhookInterval, option{name: "webhook-interval", env: "WEBHOOK_INTERVAL"}, 5*time.Second, "How often pending webhook deliveries are sent.")
+	dur(&c.WebhookTimeout, option{name: "webhook-timeout", env: "WEBHOOK_TIMEOUT"}, 10*time.Second, "Timeout of every webhook delivery attempt.")
+	integer(&c.WebhookMaxAttempts, option{name: "webhook-max-attempts", env: "WEBHOOK_MAX_ATTEMPTS"}, 5, "Attempts after which a webhook delivery fails.")
+	dur(&c.WebhookRetryBackoff, option{name: "webhook-retry-backoff", env: "WEBHOOK_RETRY_BACKOFF"}, 30*time.Second, "Delay before retrying a failed webhook delivery, doubled on every attempt up to an hour. Must be longer than -webhook-timeout.")
+	str(&c.EventsPublisher, option{name: "events-publisher", env: "EVENTS_PUBLISHER"}, "", "Message bus events are published on, nats or mqtt. Disabled if empty.")
+	str(&c.EventsURL, option{name: "events-url", env: "EVENTS_URL", secret: true}, "", "URL of the broker of -events-publisher with credentials, e.g. nats://user:pw@nats:4222 or tcp://user:pw@mosquitto:1883.")
+	str(&c.EventsPrefix, option{name: "events-prefix", env: "EVENTS_PREFIX"}, "login", "Subject or topic prefix of the published events, e.g. login.bounce.created on NATS and login/bounce/created on MQTT.")
+	dur(&c.EventsInterval, option{name: "events-interval", env: "EVENTS_INTERVAL"}, time.Second, "How often pending events are published.")
+	dur(&c.EventsTimeout, option{name: "events-timeout", env: "EVENTS_TIMEOUT"}, 5*time.Second, "Timeout of every publish to the message bus.")
+	dur(&c.EventsRetryBackoff, option{name: "events-retry-backoff", env: "EVENTS_RETRY_BACKOFF"}, 10*time.Second, "Delay before retrying to publish an event, doubled on every attempt up to 5 minutes. Must be longer than -events-timeout.")
+	integer(&c.EventsMaxAttempts, option{name: "events-max-attempts", env: "EVENTS_MAX_ATTEMPTS"}, 20, "Attempts after which publishing an event fails and the later events are published.")
+
+	str(&c.Listen, option{name: "listen", env: "LISTEN"}, ":8080", "Where the HTTP server should listen.")
+	str(&c.MetricsListen, option{name: "metrics-listen", env: "METRICS_LISTEN"}, ":9090", "Where the Prometheus metrics endpoint should listen. Set to empty to disable.")
+	str(&c.OTLPEndpoint, option{name: "otlp-endpoint", env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}, "", "OTLP/HTTP collector URL spans are exported to, e.g. http://localhost:4318. Tracing is disabled if empty.")
+
+	dur(&c.HTTPReadTimeout, option{name: "http-read-timeout", env: "HTTP_READ_TIMEOUT"}, 10*time.Second, "Maximum duration for reading an entire request, including the body.")
+	dur(&c.HTTPReadHeaderTimeout, option{name: "http-read-header-timeout", env: "HTTP_READ_HEADER_TIMEOUT"}, 5*time.Second, "Maximum duration for reading the request headers.")
+	dur(&c.HTTPWriteTimeout, option{name: "http-write-timeout", env: "HTTP_WRITE_TIMEOUT"}, 30*time.Second, "Maximum duration before timing out writes of the response.")
+	dur(&c.HTTPIdleTimeout, option{name: "http-idle-timeout", env: "HTTP_IDLE_TIMEOUT"}, 120*time.Second, "Maximum time to wait for the next request on a keep-alive connection.")
+	integer(&c.HTTPMaxHeaderBytes, option{name: "http-max-header-bytes", env: "HTTP_MAX_HEADER_BYTES"}, 64<<10, "Maximum size of the request headers in bytes.")
+	dur(&c.ShutdownDelay, option{name: "shutdown-delay", env: "SHUTDOWN_DELAY"}, 5*time.Second, "How long readiness fails after SIGTERM before the listener is closed.")
+	dur(&c.ShutdownTimeout, option{name: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT"}, 20*time.Second, "How long in-flight requests are drained on shutdown.")
+
+	str(&c.TLSCertFile, option{name: "tls-cert", env: "TLS_CERT_FILE"}, "", "TLS certificate file. Together with -tls-key the server terminates TLS itself.")
+	str(&c.TLSKeyFile, option{name: "tls-key", env: "TLS_KEY_FILE"}, "", "TLS private key file.")
+	dur(&c.TLSReloadInterval, option{name: "tls-reload-interval", env: "TLS_RELOAD_INTERVAL"}, 30*time.Second, "How often the TLS certificate and key files are checked for changes.")
+	boolean(&c.TrustedHTTPSProxy, option{name: "trusted-https-proxy", env: "TRUSTED_HTTPS_PROXY"}, false, "Set if a trusted proxy in front terminates HTTPS, so cookies are marked secure.")
+	list(&c.TrustedProxies, option{name: "trusted-proxies", env: "TRUSTED_PROXIES"}, "Comma separated IPs or CIDRs of the proxies in front, e.g. the HAProxy, whose X-Forwarded-For header is honoured. Without, clients are identified by the peer address.")
+
+	boolean(&c.AutoMigrate, option{name: "auto-migrate", env: "AUTO_MIGRATE"}, true, "Apply pending migrations on start. Otherwise the portal exits if the schema is behind, see the migrate command.")
+	dur(&c.MigrateLockTimeout, option{name: "migrate-lock-timeout", env: "MIGRATE_LOCK_TIMEOUT"}, time.Minute, "How long to wait for another instance to finish migrating.")
+
+	rate(&c.RateLimitIP, option{name: "rate-limit-ip", env: "RATE_LIMIT_IP"}, Rate{N: 30, Per: time.Minute}, "Requests per client IP to /login, /callback, /patch and /switch, as N/period. 0 disables the limit.")
+	rate(&c.RateLimitSession, option{name: "rate-limit-session", env: "RATE_LIMIT_SESSION"}, Rate{N: 10, Per: time.Minute}, "Requests per logged in session to /patch and /switch, as N/period. 0 disables the limit.")
+	boolean(&c.RateLimitShared, option{name: "rate-limit-shared", env: "RATE_LIMIT_SHARED"}, false, "Keep the rate limit buckets in the database so all replicas enforce the same limits. Otherwise they are kept in memory.")
+
+	str(&c.ContentSecurityPolicy, option{name: "csp", env: "CONTENT_SECURITY_POLICY"}, "default-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; base-uri 'self'; frame-ancestors 'none'", "Content-Security-Policy sent with every response. Empty disables the header.")
+	str(&c.ReferrerPolicy, option{name: "referrer-policy", env: "REFERRER_POLICY"}, "same-origin", "Referrer-Policy sent with every response. Empty disables the header.")
+	dur(&c.HSTSMaxAge, option{name: "hsts-max-age", env: "HSTS_MAX_AGE"}, 365*24*time.Hour, "max-age of the Strict-Transport-Security header, sent when clients use HTTPS. 0 disables the header.")
+
+	dur(&c.StartupBackoffInitial, option{name: "startup-backoff-initial", env: "STARTUP_BACKOFF_INITIAL"}, time.Second, "Delay before retrying the DB or the OIDC issuer at startup, doubled on every attempt.")
+	dur(&c.StartupBackoffMax, option{name: "startup-backoff-max", env: "STARTUP_BACKOFF_MAX"}, 30*time.Second, "Maximum delay between retries of the DB or the OIDC issuer at startup.")
+	dur(&c.ReadinessCheckTimeout, option{name: "readiness-check-timeout", env: "READINESS_CHECK_TIMEOUT"}, 2*time.Second, "Timeout of every single readiness check.")
+	dur(&c.ReadinessCacheTTL, option{name: "readiness-cache-ttl", env: "READINESS_CACHE_TTL"}, 5*time.Second, "How long readiness check results are reused.")
+	integer(&c.MaxBouncerBacklog, option{name: "max-bouncer-backlog", env: "MAX_BOUNCER_BACKLOG"}, 200, "Number of queued bounce jobs above which the bouncer readiness check fails. 0 disables the check.")
+	dur(&c.MaxBouncerJobAge, option{name: "max-bouncer-job-age", env: "MAX_BOUNCER_JOB_AGE"}, 15*time.Minute, "Age of the oldest queued bounce job above which the bouncer readiness check fails. 0 disables the check.")
+	boolean(&c.ReadinessStrict, option{name: "readiness-strict", env: "READINESS_STRICT"}, false, "Fail the readiness probe if the GeCo API or the bouncer backlog check fails. Otherwise they only report the instance as degraded.")
+
+	str(&c.AssetsDir, option{name: "assets-dir", env: "ASSETS_DIR"}, "", "Directory with templates/ and static/ files overriding the embedded ones. The embedded assets are used if empty.")
+
+	list(&c.AdminUsernames, option{name: "admin-usernames", env: "ADMIN_USERNAMES"}, "Comma separated GeCo usernames of the staff allowed to use the admin pages.")
+	tokens(&c.APITokens, option{name: "api-tokens", env: "API_TOKENS", secret: true}, "Comma separated bearer tokens of the API as name:secret or name:secret:scopes, with the scopes read, patch and bouncer joined by +. Tokens without scopes may only read. The API is disabled if empty.")
+
+	str(&c.PatchReason, option{name: "reason", required: patch, noFile: true}, "", "patch command: Why the device is patched, recorded in the audit log (required).")
+	str(&c.PatchActor, option{name: "actor", noFile: true}, "", "patch command: Who patches the device, recorded in the audit log. Defaults to cli:<OS user>.")
+	str(&c.PatchUsername, option{name: "geco-user", noFile: true}, "", "patch command: GeCo username of the device's user if the target is a MAC or IP, to verify the check-in.")
+	boolean(&c.PatchBypassCheckin, option{name: "bypass-checkin", noFile: true}, false, "patch command: Patch even if GeCo never confirmed the check-in of the user.")
+}
+
+// Load builds the configuration of cmd from the command line arguments
+// following the command, the environment and the config file, and validates
+// it.
+func Load(cmd Command, args []string) (*Config, error) {
+	c := &Config{Command: cmd}
+	c.define()
+
+	if err := c.fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fromFlags := map[string]bool{}
+	c.fs.Visit(func(f *flag.Flag) {
+		fromFlags[f.Name] = true
+	})
+
+	// The config file location itself may only come from a flag or the
+	// environment.
+	if !fromFlags["config"] {
+		if err := c.setFromEnv(c.lookup("config")); err != nil {
+			return nil, err
+		}
+	}
+	if c.ConfigFile != "" {
+		if err := c.loadFile(c.ConfigFile, fromFlags); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range c.options {
+		if fromFlags[o.name] || o.noFile {
+			continue
+		}
+		if err := c.setFromEnv(o); err != nil {
+			return nil, err
+		}
+	}
+
+	// Dumping an invalid config is the easiest way to debug it.
+	if c.PrintConfig {
+		return c, nil
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Args returns the positional arguments left after the flags.
+func (c *Config) Args() []string {
+	return c.fs.Args()
+}
+
+func (c *Config) lookup(name string) option {
+	for _, o := range c.options {
+		if o.name == name {
+			return o
+		}
+	}
+	panic("unknown option " + name)
+}
+
+func (c *Config) set(o option, value, source string) error {
+	if err := c.fs.Set(o.name, value); err != nil {
+		return fmt.Errorf("invalid value for %s from %s: %w", o.name, source, err)
+	}
+	return nil
+}
+
+// setFromEnv sets o from its environment variable or, if that is unset, from
+// the file named by <ENV>_FILE.
+func (c *Config) setFromEnv(o option) error {
+	if v, ok := os.LookupEnv(o.env); ok {
+		return c.set(o, v, o.env)
+	}
+	path, ok := os.LookupEnv(o.env + "_FILE")
+	if !ok {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s_FILE: %w", o.env, err)
+	}
+	return c.set(o, strings.TrimRight(string(b), "\r\n"), o.env+"_FILE")
+}
+
+func (c *Config) loadFile(path string, skip map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	default:
+		return fmt.Errorf("unsupported config file extension %q, use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	known := map[string]option{}
+	for _, o := range c.options {
+		if !o.noFile {
+			known[o.name] = o
+		}
+	}
+	for key, value := range values {
+		o, ok := known[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q in config file %s", key, path)
+		}
+		if skip[key] {
+			continue
+		}
+		switch v := value.(type) {
+		case []any:
+			value = joinList(v)
+		case time.Time:
+			value = v.Format(time.RFC3339)
+		}
+		if err := c.set(o, fmt.Sprint(value), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redacted returns the effective value of every option with secrets replaced.
+func (c *Config) Redacted() map[string]string {
+	m := make(map[string]string, len(c.options))
+	for _, o := range c.options {
+		if o.noFile {
+			continue
+		}
+		v := c.fs.Lookup(o.name).Value.String()
+		if o.secret && v != "" {
+			v = "<redacted>"
+		}
+		m[o.name] = v
+	}
+	return m
+}
+
+// Dump writes the effective config with secrets redacted as YAML.
+func (c *Config) Dump(w io.Writer) error {
+	m := c.Redacted()
+	for _, o := range c.options {
+		v, ok := m[o.name]
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s: %q\n", o.name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// dbArgs are the flags required by CommandMigrate, except the password.
+var dbArgs = []string{"-mysql-server=db", "-mysql-port=3306", "-mysql-name=login", "-mysql-user=login"}
+
+// writeFile writes content to name in a temporary directory and returns its
+// path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "default", want: "info"},
+		{name: "file", file: "log-level: warn\n", want: "warn"},
+		{name: "env over file", file: "log-level: warn\n", env: map[string]string{"LOG_LEVEL": "error"}, want: "error"},
+		{name: "flag over env", file: "log-level: warn\n", env: map[string]string{"LOG_LEVEL": "error"}, args: []string{"-log-level=debug"}, want: "debug"},
+		{name: "flag over file", file: "log-level: warn\n", args: []string{"-log-level=debug"}, want: "debug"},
+		{name: "_FILE over file", file: "log-level: warn\n", env: map[string]string{"LOG_LEVEL_FILE": "error\n"}, want: "error"},
+		{name: "env over _FILE", env: map[string]string{"LOG_LEVEL": "debug", "LOG_LEVEL_FILE": "error\n"}, want: "debug"},
+		{name: "flag over _FILE", env: map[string]string{"LOG_LEVEL_FILE": "error\n"}, args: []string{"-log-level=debug"}, want: "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MYSQL_DB_PW", "secret")
+			for k, v := range tt.env {
+				// _FILE variables name a file with the value.
+				if strings.HasSuffix(k, "_FILE") {
+					v = writeFile(t, "value", v)
+				}
+				t.Setenv(k, v)
+			}
+			args := append(dbArgs, tt.args...)
+			if tt.file != "" {
+				args = append(args, "-config="+writeFile(t, "config.yaml", tt.file))
+			}
+
+			c, err := Load(CommandMigrate, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.LogLevel != tt.want {
+				t.Errorf("log-level = %q, want %q", c.LogLevel, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	t.Setenv("MYSQL_DB_PW", "secret")
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.toml", "log-level = \"warn\"\nmysql-port = 5432\n"))
+	c, err := Load(CommandMigrate, []string{"-mysql-server=db", "-mysql-name=login", "-mysql-user=login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "warn" || c.MySQLPort != "5432" {
+		t.Errorf("log-level, mysql-port = %q, %q, want the values of the file", c.LogLevel, c.MySQLPort)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "unknown key", file: "no-such-option: 1\n", wantErr: `unknown key "no-such-option"`},
+		{name: "flag only key", file: "print-config: true\n", wantErr: `unknown key "print-config"`},
+		{name: "invalid value", file: "session-max-age: soon\n", wantErr: "invalid value for session-max-age"},
+		{name: "missing _FILE", env: map[string]string{"MYSQL_DB_PW_FILE": "/nonexistent"}, wantErr: "failed to read MYSQL_DB_PW_FILE"},
+		{name: "missing required", wantErr: "missing required option mysql-pw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := dbArgs
+			if tt.file != "" {
+				args = append(args, "-config="+writeFile(t, "config.yaml", tt.file))
+			}
+			_, err := Load(CommandMigrate, args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	t.Setenv("MYSQL_DB_PW_FILE", writeFile(t, "pw", "secret\n"))
+	c, err := Load(CommandMigrate, append(dbArgs, "-print-config", "-api-tokens=helpdesk:0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MySQLPassword != "secret" {
+		t.Fatalf("mysql-pw = %q, want the trimmed content of the file", c.MySQLPassword)
+	}
+
+	m := c.Redacted()
+	for name, want := range map[string]string{
+		"mysql-pw":           "<redacted>",
+		"api-tokens":         "<redacted>",
+		"oidc-client-secret": "",
+		"mysql-user":         "login",
+	} {
+		if got := m[name]; got != want {
+			t.Errorf("Redacted()[%s] = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"config", "print-config"} {
+		if _, ok := m[name]; ok {
+			t.Errorf("Redacted() has %s, which cannot be set in the config file", name)
+		}
+	}
+
+	var dump strings.Builder
+	if err := c.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump.String(), `"secret"`) || strings.Contains(dump.String(), "0123456789abcdef") {
+		t.Errorf("Dump() leaks a secret:\n%s", dump.String())
+	}
+	if !strings.Contains(dump.String(), "mysql-pw: \"<redacted>\"\n") {
+		t.Errorf("Dump() has no redacted mysql-pw:\n%s", dump.String())
+	}
+}
+
+func TestValidateEndpointFmt(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "https://geco.ethz.ch/api/v1/lan_parties/%s/me"},
+		{value: "https://geco.ethz.ch/api/v1/lan_parties/%s/me?scope=a%%2Fb"},
+		{value: "https://geco.ethz.ch/%%25/%s"},
+		{value: "https://geco.ethz.ch/api/v1/lan_parties/me", wantErr: true},
+		{value: "https://geco.ethz.ch/%s/%s", wantErr: true},
+		{value: "https://geco.ethz.ch/%d/me", wantErr: true},
+		{value: "https://geco.ethz.ch/%s/me?scope=a%2Fb", wantErr: true},
+		{value: "https://geco.ethz.ch/%s%", wantErr: true},
+		{value: "ftp://geco.ethz.ch/%s", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateEndpointFmt("endpoint", tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateEndpointFmt(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTokensSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Tokens
+		wantErr bool
+	}{
+		{value: "overlay:t0k3n", want: Tokens{{Name: "overlay", Secret: "t0k3n", Scopes: []string{"read"}}}},
+		{value: "helpdesk:s3cr3t:read+patch, bouncer:b0unc3r:bouncer", want: Tokens{
+			{Name: "helpdesk", Secret: "s3cr3t", Scopes: []string{"read", "patch"}},
+			{Name: "bouncer", Secret: "b0unc3r", Scopes: []string{"bouncer"}},
+		}},
+		{value: "overlay", wantErr: true},
+		{value: "overlay:t0k3n:", wantErr: true},
+		{value: "overlay:t0k3n:admin", wantErr: true},
+		{value: "overlay:t0k3n,overlay:t0k3n2", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Tokens
+		err := got.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b Token) bool {
+			return a.Name == b.Name && a.Secret == b.Secret && slices.Equal(a.Scopes, b.Scopes)
+		}) {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
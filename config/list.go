@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// List is a comma separated list of values, e.g. "alice,bob". In the config
+// file it may also be written as a list.
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// joinList converts a list from the config file to the flag notation.
+func joinList(values []any) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, ",")
+}
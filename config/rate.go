@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a token bucket budget of N requests per period, written as "N/period",
+// e.g. "10/1m". The zero Rate, written as "0" or "", disables the limit.
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// Enabled reports whether the rate limits anything.
+func (r Rate) Enabled() bool {
+	return r.N > 0
+}
+
+func (r *Rate) String() string {
+	if !r.Enabled() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", r.N, r.Per)
+}
+
+func (r *Rate) Set(s string) error {
+	if s == "" || s == "0" {
+		*r = Rate{}
+		return nil
+	}
+	n, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("rate %q must be of the form N/period, e.g. 10/1m", s)
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return fmt.Errorf("rate %q: invalid count %q", s, n)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("rate %q: invalid period %q", s, per)
+	}
+	*r = Rate{N: count, Per: d}
+	return nil
+}
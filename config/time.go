@@ -0,0 +1,29 @@
+package config
+
+import "time"
+
+// Time is a point in time in RFC 3339 notation, e.g. "2026-11-20T16:00:00+01:00".
+// The zero value is unset.
+type Time struct {
+	time.Time
+}
+
+func (t *Time) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *Time) Set(s string) error {
+	if s == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	t.Time = v
+	return nil
+}
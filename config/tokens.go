@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TokenScopes are the scopes a token may be granted: read for the lookups,
+// patch for patching devices and requeueing their jobs, and bouncer for the
+// job queue of the bouncers.
+var TokenScopes = []string{"read", "patch", "bouncer"}
+
+// defaultTokenScopes are granted to tokens without scopes.
+var defaultTokenScopes = []string{"read"}
+
+// Token is a named bearer token of the API. The name identifies the client in
+// logs and the audit log.
+type Token struct {
+	Name   string
+	Secret string
+	Scopes []string
+}
+
+// Tokens is a comma separated list of tokens written as "name:secret" or
+// "name:secret:scope+scope", e.g. "overlay:t0k3n,helpdesk:s3cr3t:read+patch".
+// Tokens without scopes may only read. In the config file it may also be
+// written as a list.
+type Tokens []Token
+
+func (t *Tokens) String() string {
+	s := make([]string, len(*t))
+	for i, token := range *t {
+		s[i] = token.Name + ":" + token.Secret + ":" + strings.Join(token.Scopes, "+")
+	}
+	return strings.Join(s, ",")
+}
+
+func (t *Tokens) Set(s string) error {
+	var tokens Tokens
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(v, ":")
+		secret, rawScopes, hasScopes := strings.Cut(secret, ":")
+		if !ok || name == "" || secret == "" {
+			// The secret is not echoed.
+			return fmt.Errorf("tokens must be of the form name:secret or name:secret:scopes, got one named %q", name)
+		}
+		if slices.ContainsFunc(tokens, func(t Token) bool { return t.Name == name }) {
+			return fmt.Errorf("duplicate token name %q", name)
+		}
+		scopes := defaultTokenScopes
+		if hasScopes {
+			scopes = strings.Split(rawScopes, "+")
+			for _, scope := range scopes {
+				if !slices.Contains(TokenScopes, scope) {
+					return fmt.Errorf("unknown scope %q of token %q, must be one of %s", scope, name, strings.Join(TokenScopes, ", "))
+				}
+			}
+		}
+		tokens = append(tokens, Token{Name: name, Secret: secret, Scopes: scopes})
+	}
+	*t = tokens
+	return nil
+}
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// minSessionSecretLength is the minimum length of the session secret in bytes.
+const minSessionSecretLength = 32
+
+// minAPITokenLength is the minimum length of the secret of an API token.
+const minAPITokenLength = 16
+
+// validate checks all options and reports every problem at once.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, o := range c.options {
+		if o.required&c.Command != 0 && c.fs.Lookup(o.name).Value.String() == "" {
+			errs = append(errs, fmt.Errorf("missing required option %s", o.name))
+		}
+	}
+
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+	if c.LogFormat != "console" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log-format: must be console or json, got %q", c.LogFormat))
+	}
+
+	if c.DBDialect != "mysql" && c.DBDialect != "postgres" {
+		errs = append(errs, fmt.Errorf("db-dialect: must be mysql or postgres, got %q", c.DBDialect))
+	}
+	check(validatePort("mysql-port", c.MySQLPort))
+	check(validateHTTPURL("oidc-issuer", c.OIDCIssuer))
+	check(validateHTTPURL("oidc-redirect-url", c.OIDCRedirectURL))
+	if c.GecoLanID != "" {
+		if id, err := strconv.Atoi(c.GecoLanID); err != nil || id <= 0 {
+			errs = append(errs, fmt.Errorf("geco-lan-id: must be a positive number, got %q", c.GecoLanID))
+		}
+	}
+	check(validateEndpointFmt("geco-userstatus-endpoint", c.GecoUserstatusEndpointFmt))
+	if c.SessionSecret != "" && len(c.SessionSecret) < minSessionSecretLength {
+		errs = append(errs, fmt.Errorf("session-secret: must be at least %d bytes, got %d", minSessionSecretLength, len(c.SessionSecret)))
+	}
+
+	check(validateListen("listen", c.Listen))
+	if c.MetricsListen != "" {
+		check(validateListen("metrics-listen", c.MetricsListen))
+	}
+	if c.OTLPEndpoint != "" {
+		check(validateHTTPURL("otlp-endpoint", c.OTLPEndpoint))
+	}
+
+	if c.HTTPMaxHeaderBytes <= 0 {
+		errs = append(errs, fmt.Errorf("http-max-header-bytes: must be positive, got %d", c.HTTPMaxHeaderBytes))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				errs = append(errs, fmt.Errorf("trusted-proxies: must be IPs or CIDRs, got %q", proxy))
+			}
+		}
+	}
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("hsts-max-age: must not be negative, got %v", c.HSTSMaxAge))
+	}
+	if c.AssetsDir != "" {
+		if info, err := os.Stat(c.AssetsDir); err != nil {
+			errs = append(errs, fmt.Errorf("assets-dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("assets-dir: %s is not a directory", c.AssetsDir))
+		}
+	}
+	if c.StartupBackoffInitial <= 0 || c.StartupBackoffMax < c.StartupBackoffInitial {
+		errs = append(errs, fmt.Errorf("startup-backoff-initial must be positive and at most startup-backoff-max, got %v and %v", c.StartupBackoffInitial, c.StartupBackoffMax))
+	}
+	if c.ReadinessCheckTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("readiness-check-timeout: must be positive, got %v", c.ReadinessCheckTimeout))
+	}
+	if c.MaxBouncerBacklog < 0 || c.MaxBouncerJobAge < 0 {
+		errs = append(errs, errors.New("max-bouncer-backlog and max-bouncer-job-age must not be negative"))
+	}
+	if c.MigrateLockTimeout < time.Second {
+		errs = append(errs, fmt.Errorf("migrate-lock-timeout: must be at least 1s, got %v", c.MigrateLockTimeout))
+	}
+	if c.SessionMaxAge < time.Minute {
+		errs = append(errs, fmt.Errorf("session-max-age: must be at least 1m, got %v", c.SessionMaxAge))
+	}
+	if !c.EventStart.IsZero() && !c.EventEnd.IsZero() && !c.EventEnd.After(c.EventStart.Time) {
+		errs = append(errs, fmt.Errorf("event-end: must be after event-start, got %v and %v", c.EventStart.String(), c.EventEnd.String()))
+	}
+	if c.CaptiveVLAN != 0 && !c.EventEnd.IsZero() && c.EventStart.IsZero() {
+		errs = append(errs, errors.New("event-start: required to tear down the default event at event-end"))
+	}
+	if c.CaptiveVLAN < 0 || c.CaptiveVLAN > 4094 {
+		errs = append(errs, fmt.Errorf("captive-vlan: must be between 1 and 4094, or 0 to disable, got %d", c.CaptiveVLAN))
+	}
+	if c.QuarantineVLAN < 0 || c.QuarantineVLAN > 4094 {
+		errs = append(errs, fmt.Errorf("quarantine-vlan: must be between 1 and 4094, or 0 to disable, got %d", c.QuarantineVLAN))
+	}
+	if c.EventTeardownInterval <= 0 {
+		errs = append(errs, fmt.Errorf("event-teardown-interval: must be positive, got %v", c.EventTeardownInterval))
+	}
+	if c.EventCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("event-cache-ttl: must not be negative, got %v", c.EventCacheTTL))
+	}
+	if c.ProgressPollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("progress-poll-interval: must be positive, got %v", c.ProgressPollInterval))
+	}
+	if c.ProgressTimeout < c.ProgressPollInterval {
+		errs = append(errs, fmt.Errorf("progress-timeout: must be at least progress-poll-interval, got %v", c.ProgressTimeout))
+	}
+	if c.BouncerLease <= 0 {
+		errs = append(errs, fmt.Errorf("bouncer-lease: must be positive, got %v", c.BouncerLease))
+	}
+	if c.BouncerMaxRetries < 1 {
+		errs = append(errs, fmt.Errorf("bouncer-max-retries: must be at least 1, got %d", c.BouncerMaxRetries))
+	}
+	if c.BouncerRetryDelay < 0 {
+		errs = append(errs, fmt.Errorf("bouncer-retry-delay: must not be negative, got %v", c.BouncerRetryDelay))
+	}
+	if c.WebhookInterval <= 0 {
+		errs = append(errs, fmt.Errorf("webhook-interval: must be positive, got %v", c.WebhookInterval))
+	}
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("webhook-timeout: must be positive, got %v", c.WebhookTimeout))
+	}
+	if c.WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook-max-attempts: must be at least 1, got %d", c.WebhookMaxAttempts))
+	}
+	if c.WebhookRetryBackoff <= c.WebhookTimeout {
+		errs = append(errs, fmt.Errorf("webhook-retry-backoff: must be longer than webhook-timeout, got %v", c.WebhookRetryBackoff))
+	}
+	switch c.EventsPublisher {
+	case "":
+	case "nats", "mqtt":
+		if c.EventsURL == "" {
+			errs = append(errs, fmt.Errorf("events-url: required with events-publisher %s", c.EventsPublisher))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("events-publisher: must be nats, mqtt or empty, got %q", c.EventsPublisher))
+	}
+	if c.EventsPrefix == "" {
+		errs = append(errs, errors.New("events-prefix: must not be empty"))
+	}
+	if c.EventsInterval <= 0 {
+		errs = append(errs, fmt.Errorf("events-interval: must be positive, got %v", c.EventsInterval))
+	}
+	if c.EventsTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("events-timeout: must be positive, got %v", c.EventsTimeout))
+	}
+	if c.EventsRetryBackoff <= c.EventsTimeout {
+		errs = append(errs, fmt.Errorf("events-retry-backoff: must be longer than events-timeout, got %v", c.EventsRetryBackoff))
+	}
+	if c.EventsMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("events-max-attempts: must be at least 1, got %d", c.EventsMaxAttempts))
+	}
+	for _, t := range c.APITokens {
+		if len(t.Secret) < minAPITokenLength {
+			errs = append(errs, fmt.Errorf("api-tokens: token %q must be at least %d characters", t.Name, minAPITokenLength))
+		}
+	}
+	if c.TLSReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("tls-reload-interval: must be positive, got %v", c.TLSReloadInterval))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validatePort(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%s: must be a port number between 1 and 65535, got %q", name, value)
+	}
+	return nil
+}
+
+func validateHTTPURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: must be an absolute http(s) URL, got %q", name, value)
+	}
+	return nil
+}
+
+// validateEndpointFmt checks that value is an URL with exactly one %s
+// placeholder for the LAN ID. Percent signs, e.g. of percent-encoded paths,
+// must be escaped as %%.
+func validateEndpointFmt(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	placeholders := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			continue
+		}
+		i++
+		switch {
+		case i < len(value) && value[i] == '%':
+		case i < len(value) && value[i] == 's':
+			placeholders++
+		default:
+			return fmt.Errorf("%s: must contain only the %%s placeholder, escape other percent signs as %%%%, got %q", name, value)
+		}
+	}
+	if placeholders != 1 {
+		return fmt.Errorf("%s: must contain exactly one %%s placeholder, got %q", name, value)
+	}
+	return validateHTTPURL(name, fmt.Sprintf(value, "1"))
+}
+
+func validateListen(name, value string) error {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return validatePort(name, port)
+}
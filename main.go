@@ -2,121 +2,148 @@ package main
 
 import (
 	"context"
-	"flag"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/VSETH-GECO/login-ng/config"
 	"github.com/VSETH-GECO/login-ng/server"
 )
 
-var (
-	levelFlag  = flag.String("log-level", "info", "Sets the verbosity of the logger. One of: trace, debug, info, warn, error, fatal, panic")
-	writerFlag = flag.String("log-format", "console", "Log output format. One of: console, json.")
-
-	mysqlServer   = flag.String("mysql-server", os.Getenv("MYSQL_DB_SERVER"), "MySQL server address (required)")
-	mysqlPort     = flag.String("mysql-port", os.Getenv("MYSQL_DB_PORT"), "MySQL port number (required)")
-	mysqlDatabase = flag.String("mysql-name", os.Getenv("MYSQL_DB_NAME"), "MySQL database name (required)")
-	mysqlUser     = flag.String("mysql-user", os.Getenv("MYSQL_DB_USER"), "MySQL database user (required)")
-	mysqlPassword = flag.String("mysql-pw", os.Getenv("MYSQL_DB_PW"), "MySQL database user password (required)")
-
-	oidcIssuer       = flag.String("oidc-issuer", os.Getenv("OIDC_ISSUER"), "Geco OIDC Provider (required)")
-	oidcRedirectURL  = flag.String("oidc-redirect-url", os.Getenv("OIDC_REDIRECT_URL"), "Geco OIDC Redirect URL (required)")
-	oidcClientID     = flag.String("oidc-client-id", os.Getenv("OIDC_CLIENT_ID"), "Geco OIDC Client ID (required)")
-	oidcClientSecret = flag.String("oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "Geco OIDC Client secret (required)")
-
-	gecoAPILanID                 = flag.String("geco-lan-id", os.Getenv("GECO_LAN_ID"), "Geco LAN ID (required). The id of the LAN event instance on the website.")
-	gecoAPIUserstatusEndpointFmt = flag.String("geco-userstatus-endpoint", os.Getenv("GECO_USERSTATUS_ENDPOINT"), "Geco user status endpoint format (required). Geco API endpoint as specified on https://geco.ethz.ch/api/v1#/paths/api-v1-lan_parties-id--me/get.")
+func main() {
+	cmd, args := config.CommandServe, os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			cmd, args = config.CommandMigrate, args[1:]
+		case "patch":
+			cmd, args = config.CommandPatch, args[1:]
+		}
+	}
 
-	sessionSecret = flag.String("session-secret", os.Getenv("SESSION_SECRET"), "Session secret (required). It is recommended to use a session key with 32 or 64 bytes.")
+	cfg, err := config.Load(cmd, args)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration.")
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Dump(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Failed to print configuration.")
+		}
+		return
+	}
 
-	listenFlag = flag.String("listen", ":8080", "Where the HTTP server should listen.")
-)
+	logger := newLogger(cfg)
 
-func main() {
-	flag.Parse()
-	args := map[string]string{
-		"mysql-server":             *mysqlServer,
-		"mysql-port":               *mysqlPort,
-		"mysql-name":               *mysqlDatabase,
-		"mysql-user":               *mysqlUser,
-		"mysql-pw":                 *mysqlPassword,
-		"oidc-issuer":              *oidcIssuer,
-		"oidc-redirect-url":        *oidcRedirectURL,
-		"oidc-client-id":           *oidcClientID,
-		"oidc-client-secret":       *oidcClientSecret,
-		"geoc-lan-id":              *gecoAPILanID,
-		"geoc-userstatus-endpoint": *gecoAPIUserstatusEndpointFmt,
-		"session-secret":           *sessionSecret,
-	}
-	argMissing := false
-	for argName, argValue := range args {
-		if len(argValue) == 0 {
-			argMissing = true
-			log.Error().Msgf("missing required argument: %s", argName)
-		}
+	migrations, err := fs.Sub(assets, "migrations")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to open embedded migrations.")
 	}
-	if argMissing {
-		log.Fatal().Msg("missing required arguments")
+
+	switch cmd {
+	case config.CommandMigrate:
+		runMigrate(cfg, logger, migrations)
+	case config.CommandPatch:
+		runPatch(cfg, logger, migrations)
+	default:
+		runServe(cfg, logger, migrations)
 	}
+}
 
-	// Set up the logger.
-	lvl, err := zerolog.ParseLevel(*levelFlag)
+// newLogger sets up the logger as configured.
+func newLogger(cfg *config.Config) zerolog.Logger {
+	lvl, err := zerolog.ParseLevel(cfg.LogLevel)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Could not parse log-level flag: '%s'.", *levelFlag)
+		log.Fatal().Err(err).Msgf("Could not parse log-level flag: '%s'.", cfg.LogLevel)
 	}
 	zerolog.SetGlobalLevel(lvl)
 	var w io.Writer = os.Stderr
-	switch *writerFlag {
+	switch cfg.LogFormat {
 	case "console":
 		w = zerolog.ConsoleWriter{Out: w}
 	case "json":
 		// This is the default of zerolog.
 	}
-	logger := zerolog.New(w).With().Timestamp().Caller().Logger()
+	return zerolog.New(w).With().Timestamp().Caller().Logger().Hook(server.TraceHook{})
+}
+
+// runServe runs the login portal until SIGTERM.
+func runServe(cfg *config.Config, logger zerolog.Logger, migrations fs.FS) {
+	effective := zerolog.Dict()
+	for k, v := range cfg.Redacted() {
+		effective.Str(k, v)
+	}
+	logger.Info().Dict("config", effective).Msg("Effective configuration.")
+
+	// Set up tracing
+	var err error
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.OTLPEndpoint != "" {
+		shutdownTracing, err = server.SetupTracing(context.Background(), cfg.OTLPEndpoint)
+		if err != nil {
+			logger.Fatal().Err(err).Str("endpoint", cfg.OTLPEndpoint).Msg("Failed to set up tracing.")
+		}
+		logger.Info().Msgf("Exporting traces to: %v", cfg.OTLPEndpoint)
+	}
 
-	// Connect to and migrate database
-	openDBCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	db, err := server.OpenDB(openDBCtx, *mysqlUser, *mysqlPassword, *mysqlServer, *mysqlPort, *mysqlDatabase)
+	// Open database, it is connected to and migrated in the background
+	db, err := server.OpenDB(cfg.DBDialect, cfg.MySQLUser, cfg.MySQLPassword, cfg.MySQLServer, cfg.MySQLPort, cfg.MySQLDatabase)
 	if err != nil {
 		logger.
 			Fatal().
 			Err(err).
-			Str("server", *mysqlServer).
-			Str("port", *mysqlPort).
-			Str("database", *mysqlDatabase).
-			Str("user", *mysqlUser).
+			Str("dialect", cfg.DBDialect).
+			Str("server", cfg.MySQLServer).
+			Str("port", cfg.MySQLPort).
+			Str("database", cfg.MySQLDatabase).
+			Str("user", cfg.MySQLUser).
 			Msg("Failed to open connection to DB.")
 	}
-	cancel()
-	logger.Info().Msgf("Connected to database: %v:%v/%v", *mysqlServer, *mysqlPort, *mysqlDatabase)
 
-	// Create OIDC provider
-	oidcProvider, err := server.NewOIDCProvider(
+	// Create OIDC provider, the issuer is discovered in the background
+	oidcProvider := server.NewOIDCProvider(
 		logger.With().Str("component", "oidc").Logger(),
-		*oidcIssuer,
-		*oidcRedirectURL,
-		*oidcClientID,
-		*oidcClientSecret,
+		cfg.OIDCIssuer,
+		cfg.OIDCRedirectURL,
+		cfg.OIDCClientID,
+		cfg.OIDCClientSecret,
 	)
-	if err != nil {
-		logger.
-			Fatal().
-			Err(err).
-			Str("server", *mysqlServer).
-			Str("port", *mysqlPort).
-			Str("database", *mysqlDatabase).
-			Str("user", *mysqlUser).
-			Msg("Failed to create OIDC provider.")
-	}
 
 	// assemble geco API config
 	gecoAPIConfig := &server.GecoAPIConfig{
-		LanID:                 *gecoAPILanID,
-		UserstatusEndpointFmt: *gecoAPIUserstatusEndpointFmt,
+		LanID:                 cfg.GecoLanID,
+		UserstatusEndpointFmt: cfg.GecoUserstatusEndpointFmt,
+	}
+
+	// Templates and static files are embedded, single files may be overridden.
+	var webAssets fs.FS = assets
+	if cfg.AssetsDir != "" {
+		webAssets = server.OverlayFS(os.DirFS(cfg.AssetsDir), assets)
+		logger.Info().Msgf("Overriding assets from: %v", cfg.AssetsDir)
+	}
+
+	apiTokens := make(map[string]server.APIToken, len(cfg.APITokens))
+	for _, t := range cfg.APITokens {
+		apiTokens[t.Name] = server.APIToken{Secret: t.Secret, Scopes: t.Scopes}
+	}
+
+	// Events are published on the message bus if configured, the broker is
+	// connected to in the background.
+	var publisher server.EventPublisher
+	if cfg.EventsPublisher != "" {
+		publisher, err = server.NewEventPublisher(cfg.EventsPublisher, cfg.EventsURL, cfg.EventsPrefix, logger.With().Str("component", "publisher").Logger())
+		if err != nil {
+			logger.Fatal().Err(err).Str("publisher", cfg.EventsPublisher).Msg("Failed to set up event publisher.")
+		}
+		logger.Info().Msgf("Publishing events on %v below: %v", cfg.EventsPublisher, cfg.EventsPrefix)
 	}
 
 	// Setup server
@@ -126,8 +153,192 @@ func main() {
 		DB:            db,
 		OIDCProvider:  oidcProvider,
 		GecoAPIConfig: gecoAPIConfig,
-		SessionSecret: *sessionSecret,
+		HTTPConfig: &server.HTTPConfig{
+			ReadTimeout:       cfg.HTTPReadTimeout,
+			ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+			WriteTimeout:      cfg.HTTPWriteTimeout,
+			IdleTimeout:       cfg.HTTPIdleTimeout,
+			MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+			ShutdownDelay:     cfg.ShutdownDelay,
+			ShutdownTimeout:   cfg.ShutdownTimeout,
+			TLSCertFile:       cfg.TLSCertFile,
+			TLSKeyFile:        cfg.TLSKeyFile,
+			TLSReloadInterval: cfg.TLSReloadInterval,
+			TrustedHTTPSProxy: cfg.TrustedHTTPSProxy,
+			TrustedProxies:    cfg.TrustedProxies,
+			SessionMaxAge:     cfg.SessionMaxAge,
+		},
+		RateLimitConfig: &server.RateLimitConfig{
+			PerIP:      server.RateBudget{Tokens: cfg.RateLimitIP.N, Per: cfg.RateLimitIP.Per},
+			PerSession: server.RateBudget{Tokens: cfg.RateLimitSession.N, Per: cfg.RateLimitSession.Per},
+			Shared:     cfg.RateLimitShared,
+		},
+		SecurityHeadersConfig: &server.SecurityHeadersConfig{
+			ContentSecurityPolicy: cfg.ContentSecurityPolicy,
+			ReferrerPolicy:        cfg.ReferrerPolicy,
+			HSTSMaxAge:            cfg.HSTSMaxAge,
+		},
+		ReadinessConfig: &server.ReadinessConfig{
+			CheckTimeout:      cfg.ReadinessCheckTimeout,
+			CacheTTL:          cfg.ReadinessCacheTTL,
+			MaxBouncerBacklog: cfg.MaxBouncerBacklog,
+			MaxBouncerJobAge:  cfg.MaxBouncerJobAge,
+			Strict:            cfg.ReadinessStrict,
+		},
+		EventConfig: &server.EventConfig{
+			Start:            cfg.EventStart.Time,
+			End:              cfg.EventEnd.Time,
+			CaptiveVLAN:      cfg.CaptiveVLAN,
+			TeardownInterval: cfg.EventTeardownInterval,
+			CacheTTL:         cfg.EventCacheTTL,
+		},
+		BlocklistConfig: &server.BlocklistConfig{
+			QuarantineVLAN: cfg.QuarantineVLAN,
+		},
+		ProgressConfig: &server.ProgressConfig{
+			PollInterval: cfg.ProgressPollInterval,
+			Timeout:      cfg.ProgressTimeout,
+		},
+		BouncerQueueConfig: &server.BouncerQueueConfig{
+			Lease:      cfg.BouncerLease,
+			MaxRetries: cfg.BouncerMaxRetries,
+			RetryDelay: cfg.BouncerRetryDelay,
+		},
+		WebhookConfig: &server.WebhookConfig{
+			Interval:     cfg.WebhookInterval,
+			Timeout:      cfg.WebhookTimeout,
+			MaxAttempts:  cfg.WebhookMaxAttempts,
+			RetryBackoff: cfg.WebhookRetryBackoff,
+		},
+		PublisherConfig: &server.PublisherConfig{
+			Interval:     cfg.EventsInterval,
+			Timeout:      cfg.EventsTimeout,
+			RetryBackoff: cfg.EventsRetryBackoff,
+			MaxAttempts:  cfg.EventsMaxAttempts,
+		},
+		Publisher: publisher,
+		AdminConfig: &server.AdminConfig{
+			Usernames: cfg.AdminUsernames,
+		},
+		APIConfig: &server.APIConfig{
+			Tokens: apiTokens,
+		},
+		StartupBackoff: server.Backoff{
+			Initial: cfg.StartupBackoffInitial,
+			Max:     cfg.StartupBackoffMax,
+		},
+		SessionSecret: cfg.SessionSecret,
+		Assets:        webAssets,
 	}
 
-	logger.Fatal().Err(s.ListenAndServe(*listenFlag)).Msg("Failed.")
+	// Serve until SIGTERM (k8s) or SIGINT (ctrl-c), then drain.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// The metrics listener outlives the main listener so the drain is observable.
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if cfg.MetricsListen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.ListenAndServeMetrics(metricsCtx, cfg.MetricsListen); err != nil {
+				logger.Error().Err(err).Msg("Metrics listener failed.")
+				stop()
+			}
+		}()
+	}
+
+	// Until the dependencies are ready, the portal shows a maintenance page.
+	var prepareErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := s.ConnectDB(ctx, s.StartupBackoff, func(ctx context.Context) error {
+			if cfg.AutoMigrate {
+				n, err := server.MigrateUp(ctx, db, migrations, cfg.MigrateLockTimeout)
+				if err != nil {
+					return err
+				}
+				logger.Info().Msgf("Applied %d migrations.", n)
+			}
+			if err := server.CheckSchema(db, migrations); err != nil {
+				// Only connection errors are retried, the schema is not
+				// migrated while waiting.
+				if !cfg.AutoMigrate && errors.Is(err, server.ErrSchemaBehind) {
+					return server.Permanent(fmt.Errorf("%w, run the migrate command first", err))
+				}
+				return err
+			}
+			return nil
+		})
+		if err == nil {
+			logger.Info().Msgf("Connected to database: %v:%v/%v", cfg.MySQLServer, cfg.MySQLPort, cfg.MySQLDatabase)
+		} else if ctx.Err() == nil {
+			logger.Error().Err(err).Msg("Failed to prepare the database.")
+			prepareErr = err
+			stop()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		oidcProvider.Discover(ctx, s.StartupBackoff)
+	}()
+
+	// SIGHUP reloads the events table after it was edited.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			s.InvalidateEvents()
+			logger.Info().Msg("Reloading the events.")
+		}
+	}()
+
+	// Ended events are torn down, webhooks delivered and the outbox published
+	// while serving.
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		s.RunEventTeardown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.RunWebhooks(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.RunOutbox(ctx)
+	}()
+
+	err = s.ListenAndServe(ctx, cfg.Listen)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed.")
+	}
+	stop()
+	stopMetrics()
+	wg.Wait()
+	if err == nil {
+		err = prepareErr
+	}
+
+	if publisher != nil {
+		if err := publisher.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to close event publisher.")
+		}
+	}
+	if err := db.Close(); err != nil {
+		logger.Error().Err(err).Msg("Failed to close DB.")
+	}
+	tracingCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(tracingCtx); err != nil {
+		logger.Error().Err(err).Msg("Failed to flush traces.")
+	}
+	cancel()
+
+	if err != nil {
+		os.Exit(1)
+	}
+	logger.Info().Msg("Shut down gracefully.")
 }
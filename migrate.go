@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/VSETH-GECO/login-ng/config"
+	"github.com/VSETH-GECO/login-ng/server"
+)
+
+const migrateUsage = "usage: login-ng migrate [flags] up|down [N]|status|redo"
+
+// runMigrate implements the migrate command:
+//
+//	up        apply all pending migrations
+//	down [N]  roll back the last N migrations, default 1
+//	status    list all migrations and when they were applied
+//	redo      roll back the last migration and apply it again
+func runMigrate(cfg *config.Config, logger zerolog.Logger, migrations fs.FS) {
+	args := cfg.Args()
+	if len(args) == 0 {
+		logger.Fatal().Msg(migrateUsage)
+	}
+
+	db, err := server.OpenDB(cfg.DBDialect, cfg.MySQLUser, cfg.MySQLPassword, cfg.MySQLServer, cfg.MySQLPort, cfg.MySQLDatabase)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to open connection to DB.")
+	}
+	defer db.Close()
+
+	pingCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	err = db.PingContext(pingCtx)
+	cancel()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to reach DB.")
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		n, err := server.MigrateUp(ctx, db, migrations, cfg.MigrateLockTimeout)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to migrate up.")
+		}
+		logger.Info().Msgf("Applied %d migrations.", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				logger.Fatal().Msg(migrateUsage)
+			}
+		}
+		n, err := server.MigrateDown(ctx, db, migrations, steps, cfg.MigrateLockTimeout)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to migrate down.")
+		}
+		logger.Info().Msgf("Rolled back %d migrations.", n)
+	case "redo":
+		if err := server.MigrateRedo(ctx, db, migrations, cfg.MigrateLockTimeout); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to redo migration.")
+		}
+		logger.Info().Msg("Redid the last migration.")
+	case "status":
+		status, err := server.GetMigrationStatus(db, migrations)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to get migration status.")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED AT")
+		for _, st := range status {
+			appliedAt := "pending"
+			if st.AppliedAt != nil {
+				appliedAt = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", st.ID, appliedAt)
+		}
+		w.Flush()
+	default:
+		logger.Fatal().Msg(migrateUsage)
+	}
+}
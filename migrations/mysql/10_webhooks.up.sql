@@ -0,0 +1,35 @@
+-- Webhook subscriptions and their deliveries, which are also the queue of
+-- pending deliveries, see server/webhook.go.
+-- +migrate Up
+CREATE TABLE webhooks (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    -- comma separated event types
+    events TEXT NOT NULL,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE webhook_deliveries (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    -- pending, delivered or failed
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP(6) NULL,
+    -- HTTP status of the last attempt
+    last_status INT NULL,
+    last_error TEXT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL
+);
+
+CREATE INDEX idx_webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at);
+
+-- +migrate Down
+DROP TABLE webhook_deliveries;
+
+DROP TABLE webhooks;
@@ -0,0 +1,20 @@
+-- Events to publish on the message bus, written in the transaction of the
+-- change they report, see server/outbox.go.
+-- +migrate Up
+CREATE TABLE event_outbox (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP(6) NULL,
+    last_error TEXT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP NULL,
+    -- set once the event failed PublisherConfig.MaxAttempts times
+    failed_at TIMESTAMP NULL
+);
+
+CREATE INDEX idx_event_outbox_pending ON event_outbox (published_at, next_attempt_at);
+
+-- +migrate Down
+DROP TABLE event_outbox;
@@ -0,0 +1,11 @@
+-- Token buckets of the rate limiter shared by all replicas
+-- +migrate Up
+CREATE TABLE rate_limit_buckets (
+    bucket_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    tokens DOUBLE NOT NULL,
+    updated_at BIGINT NOT NULL,
+    KEY idx_updated_at (`updated_at`)
+);
+
+-- +migrate Down
+DROP TABLE rate_limit_buckets;
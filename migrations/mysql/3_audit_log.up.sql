@@ -0,0 +1,16 @@
+-- Audit log of staff actions
+-- +migrate Up
+CREATE TABLE audit_log (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(255) NOT NULL,
+    detail TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    KEY idx_audit_log_created_at (`created_at`),
+    KEY idx_audit_log_target (`target`)
+);
+
+-- +migrate Down
+DROP TABLE audit_log;
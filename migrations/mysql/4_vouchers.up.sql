@@ -0,0 +1,27 @@
+-- Guest vouchers for users without a GeCo account
+-- +migrate Up
+CREATE TABLE voucher_batches (
+    id VARCHAR(32) NOT NULL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_by VARCHAR(255) NOT NULL,
+    label VARCHAR(255) NOT NULL,
+    -- 1 for one-time vouchers, 0 for any number of uses
+    max_uses INTEGER NOT NULL,
+    valid_until TIMESTAMP NULL DEFAULT NULL,
+    -- VLAN the devices are patched into instead of the switch's one
+    vlan INTEGER NULL,
+    KEY idx_voucher_batches_created_at (`created_at`)
+);
+
+CREATE TABLE vouchers (
+    code VARCHAR(32) NOT NULL PRIMARY KEY,
+    batch_id VARCHAR(32) NOT NULL REFERENCES voucher_batches(id),
+    uses INTEGER NOT NULL DEFAULT 0,
+    first_used_at TIMESTAMP NULL DEFAULT NULL,
+    KEY idx_vouchers_batch_id (`batch_id`)
+);
+
+-- +migrate Down
+DROP TABLE vouchers;
+
+DROP TABLE voucher_batches;
@@ -0,0 +1,33 @@
+-- Events served by one deployment, selected by hostname or client network.
+-- Login logs and bounce jobs of the bouncer are tagged with the event.
+-- +migrate Up
+CREATE TABLE events (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    -- GeCo LAN party ID
+    lan_id VARCHAR(32) NOT NULL,
+    -- GeCo user status endpoint format, NULL for -geco-userstatus-endpoint
+    userstatus_endpoint VARCHAR(255) NULL,
+    hostname VARCHAR(255) NULL,
+    -- comma separated CIDRs of the client networks
+    networks TEXT NULL,
+    title VARCHAR(255) NULL,
+    logo VARCHAR(255) NULL,
+    starts_at TIMESTAMP NULL DEFAULT NULL,
+    ends_at TIMESTAMP NULL DEFAULT NULL
+);
+
+ALTER TABLE login_logs ADD COLUMN event_id INTEGER NULL;
+
+ALTER TABLE bouncer_jobs ADD COLUMN event_id INTEGER NULL;
+
+CREATE INDEX idx_login_logs_event_id ON login_logs (event_id);
+
+-- +migrate Down
+DROP INDEX idx_login_logs_event_id ON login_logs;
+
+ALTER TABLE bouncer_jobs DROP COLUMN event_id;
+
+ALTER TABLE login_logs DROP COLUMN event_id;
+
+DROP TABLE events;
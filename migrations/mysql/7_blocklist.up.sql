@@ -0,0 +1,19 @@
+-- Attendees and devices which are blocked or sent to the quarantine VLAN
+-- +migrate Up
+CREATE TABLE blocklist (
+    id INTEGER NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    -- sub, username or mac
+    kind VARCHAR(16) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    -- block or quarantine
+    action VARCHAR(16) NOT NULL,
+    reason TEXT NOT NULL,
+    author VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NULL DEFAULT NULL
+);
+
+CREATE INDEX idx_blocklist_kind_value ON blocklist (kind, value);
+
+-- +migrate Down
+DROP TABLE blocklist;
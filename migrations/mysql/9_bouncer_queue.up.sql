@@ -0,0 +1,19 @@
+-- Bounce jobs are leased to the bouncers through the API, see server/queue.go.
+-- lease_until is also when a failed job may be claimed again.
+-- +migrate Up
+ALTER TABLE bouncer_jobs ADD COLUMN lease_owner VARCHAR(255) NULL;
+
+ALTER TABLE bouncer_jobs ADD COLUMN lease_until TIMESTAMP(6) NULL;
+
+ALTER TABLE bouncer_jobs ADD COLUMN last_error TEXT NULL;
+
+ALTER TABLE bouncer_jobs ADD COLUMN failed_at TIMESTAMP NULL;
+
+-- +migrate Down
+ALTER TABLE bouncer_jobs DROP COLUMN failed_at;
+
+ALTER TABLE bouncer_jobs DROP COLUMN last_error;
+
+ALTER TABLE bouncer_jobs DROP COLUMN lease_until;
+
+ALTER TABLE bouncer_jobs DROP COLUMN lease_owner;
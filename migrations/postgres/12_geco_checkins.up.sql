@@ -0,0 +1,15 @@
+-- GeCo check-ins verified at patch time, so staff can patch the devices of
+-- checked in users by hand. Check-ins are confirmed by GeCo per LAN party, so
+-- they are kept per event. event_id is 0 for the default event, as it is part
+-- of the primary key.
+-- +migrate Up
+CREATE TABLE geco_checkins (
+    username VARCHAR(255) NOT NULL,
+    event_id INTEGER NOT NULL,
+    sub VARCHAR(255) NOT NULL,
+    checked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (username, event_id)
+);
+
+-- +migrate Down
+DROP TABLE geco_checkins;
@@ -0,0 +1,3 @@
+-- Create initial version of the database (see: https://github.com/rubenv/sql-migrate#writing-migrations)
+-- +migrate Up
+-- +migrate Down
@@ -0,0 +1,12 @@
+-- Token buckets of the rate limiter shared by all replicas
+-- +migrate Up
+CREATE TABLE rate_limit_buckets (
+    bucket_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX idx_updated_at ON rate_limit_buckets (updated_at);
+
+-- +migrate Down
+DROP TABLE rate_limit_buckets;
@@ -0,0 +1,17 @@
+-- Audit log of staff actions
+-- +migrate Up
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(255) NOT NULL,
+    detail TEXT NOT NULL,
+    reason TEXT NOT NULL
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log (created_at);
+CREATE INDEX idx_audit_log_target ON audit_log (target);
+
+-- +migrate Down
+DROP TABLE audit_log;
@@ -0,0 +1,14 @@
+-- Events torn down at their end, so every end is torn down once
+-- +migrate Up
+CREATE TABLE event_closures (
+    -- 0 for the default event
+    event_id INTEGER NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    closed_at TIMESTAMP NOT NULL,
+    -- number of devices bounced back to the captive VLAN
+    devices INTEGER NOT NULL,
+    PRIMARY KEY (event_id, ends_at)
+);
+
+-- +migrate Down
+DROP TABLE event_closures;
@@ -0,0 +1,6 @@
+-- Login logs record whether a device was patched or disconnected
+-- +migrate Up
+ALTER TABLE login_logs ADD COLUMN action VARCHAR(16) NOT NULL DEFAULT 'patch';
+
+-- +migrate Down
+ALTER TABLE login_logs DROP COLUMN action;
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/VSETH-GECO/login-ng/config"
+	"github.com/VSETH-GECO/login-ng/server"
+)
+
+const patchUsage = "usage: login-ng patch [flags] -reason REASON [-geco-user USER] [-bypass-checkin] MAC|IP|USERNAME"
+
+// runPatch implements the patch command, which patches a device on behalf of
+// its user like the admin page and records it in the audit log.
+func runPatch(cfg *config.Config, logger zerolog.Logger, migrations fs.FS) {
+	args := cfg.Args()
+	if len(args) != 1 {
+		logger.Fatal().Msg(patchUsage)
+	}
+
+	actor := cfg.PatchActor
+	if actor == "" {
+		u, err := user.Current()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to determine the OS user, set -actor.")
+		}
+		actor = "cli:" + u.Username
+	}
+
+	db, err := server.OpenDB(cfg.DBDialect, cfg.MySQLUser, cfg.MySQLPassword, cfg.MySQLServer, cfg.MySQLPort, cfg.MySQLDatabase)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to open connection to DB.")
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to reach DB.")
+	}
+	if err := server.CheckSchema(db, migrations); err != nil {
+		logger.Fatal().Err(err).Msg("Database schema is not up to date, run the migrate command first.")
+	}
+
+	s := server.Server{
+		Log: logger.With().Str("component", "patch").Logger(),
+		DB:  db,
+		BlocklistConfig: &server.BlocklistConfig{
+			QuarantineVLAN: cfg.QuarantineVLAN,
+		},
+	}
+	res, err := s.ManualPatch(ctx, server.ManualPatchRequest{
+		Target:        args[0],
+		Username:      cfg.PatchUsername,
+		Actor:         actor,
+		Reason:        cfg.PatchReason,
+		BypassCheckin: cfg.PatchBypassCheckin,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to patch device.")
+	}
+	fmt.Fprintf(os.Stdout, "Patched %s (%s) of %q on switch %s into VLAN %d.\n", res.MAC, res.IP, res.Username, res.SwitchIP, res.VLAN)
+}
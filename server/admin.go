@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// auditLogPageSize is the number of audit log entries shown on admin pages.
+const auditLogPageSize = 20
+
+// AdminConfig lists the staff allowed to use the admin pages.
+type AdminConfig struct {
+	// Usernames are the GeCo usernames of the staff.
+	Usernames []string
+}
+
+// adminMiddleware only lets staff through. It must follow
+// IsAuthenticatedMiddleware.
+func (s *Server) adminMiddleware(ctx *gin.Context) {
+	username, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+	if !slices.Contains(s.AdminConfig.Usernames, username) {
+		withTrace(ctx.Request.Context(), s.Log).Warn().Str("username", username).Str("path", ctx.FullPath()).Msg("admin page denied")
+		renderError(ctx, "index.gohtml", http.StatusForbidden, "This page is reserved for staff.")
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+// ManualPatchRequest asks to patch a device on behalf of its user.
+type ManualPatchRequest struct {
+	// Target is the MAC or IP of the device, or the GeCo username of its
+	// user, whose last patched device is used then.
+	Target string
+	// Username is the GeCo username of the device's user if Target is a MAC
+	// or IP. It is needed to verify the check-in.
+	Username string
+	// Actor and Reason are recorded in the audit log.
+	Actor  string
+	Reason string
+	// BypassCheckin patches the device even if GeCo never confirmed the
+	// check-in of the user.
+	BypassCheckin bool
+}
+
+// ManualPatchResult describes the patched device.
+type ManualPatchResult struct {
+	Username string
+	MAC      string
+	IP       string
+	SwitchIP string
+	VLAN     int
+}
+
+// ManualPatch runs the same pipeline as the portal on behalf of a user and
+// records it in the audit log. Unless bypassed, GeCo must have confirmed the
+// check-in of the user for the event of the device at an earlier login.
+func (s *Server) ManualPatch(ctx context.Context, req ManualPatchRequest) (*ManualPatchResult, error) {
+	target := strings.TrimSpace(req.Target)
+	username := strings.TrimSpace(req.Username)
+	reason := strings.TrimSpace(req.Reason)
+	log := withTrace(ctx, s.Log).With().Str("actor", req.Actor).Str("target", target).Logger()
+
+	if target == "" {
+		return nil, &userError{"A MAC, IP or username is required.", errors.New("empty target")}
+	}
+	if reason == "" {
+		return nil, &userError{"A reason is required.", errors.New("empty reason")}
+	}
+	if req.Actor == "" {
+		return nil, errors.New("actor is required")
+	}
+
+	// locate the device
+	up, err := s.locateDevice(ctx, target)
+	if errors.Is(err, errNotAddress) {
+		username = target
+		var mac string
+		mac, err = s.getLastMACOfUser(ctx, username)
+		if errors.Is(err, errDeviceNotFound) {
+			return nil, &userError{"No device is known for this user, use its MAC or IP instead.", err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		up, err = s.locateMAC(ctx, mac)
+	}
+	if errors.Is(err, errDeviceNotFound) {
+		return nil, &userError{"Unable to locate the device, is it connected?", err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Staff may not use the hostname of the event, so it is selected by the
+	// network of the device.
+	ev, err := s.eventFor(ctx, "", up.userIP)
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.BypassCheckin {
+		if username == "" {
+			return nil, &userError{"The username is required to verify the check-in.", errors.New("no username")}
+		}
+		ok, err := s.hasCheckin(ctx, username, ev)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &userError{"GeCo never confirmed the check-in of this user for this event.", fmt.Errorf("no check-in of %s for %s", username, ev.Name)}
+		}
+	}
+
+	// The audit entry is written with the bounce job, so no device is
+	// patched without it.
+	vlan, err := s.patchDevice(ctx, ev, up, "", username, 0, nil, &auditEntry{
+		Actor:  req.Actor,
+		Action: auditActionManualPatch,
+		Target: up.userMAC,
+		Detail: fmt.Sprintf("user=%s ip=%s switch=%s bypass_checkin=%t", username, up.userIP, up.switchIP, req.BypassCheckin),
+		Reason: reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &ManualPatchResult{Username: username, MAC: up.userMAC, IP: up.userIP, SwitchIP: up.switchIP, VLAN: vlan}
+
+	log.Info().
+		Str("username", username).
+		Str("user MAC", up.userMAC).
+		Int("target VLAN", vlan).
+		Bool("bypass checkin", req.BypassCheckin).
+		Msg("Manually patched device.")
+	return res, nil
+}
+
+// errNotAddress is returned by locateDevice if the address is neither an IP
+// nor a MAC.
+var errNotAddress = errors.New("neither an IP nor a MAC")
+
+// locateDevice locates the device with the IP or MAC addr.
+func (s *Server) locateDevice(ctx context.Context, addr string) (*userProperties, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return s.locateUser(ctx, ip.String())
+	}
+	if mac, ok := normalizeMAC(addr); ok {
+		return s.locateMAC(ctx, mac)
+	}
+	return nil, errNotAddress
+}
+
+// normalizeMAC converts a MAC in any common notation to the lower case hex
+// used by FreeRADIUS as username.
+func normalizeMAC(s string) (string, bool) {
+	if hw, err := net.ParseMAC(s); err == nil && len(hw) == 6 {
+		return hex.EncodeToString(hw), true
+	}
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 6 {
+		return hex.EncodeToString(b), true
+	}
+	return "", false
+}
+
+func adminPatchPageHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		renderAdminPatch(ctx, s, http.StatusOK, gin.H{})
+	}
+}
+
+func adminPatchHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		actor, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+		req := ManualPatchRequest{
+			Target:        ctx.PostForm("target"),
+			Username:      ctx.PostForm("username"),
+			Actor:         actor,
+			Reason:        ctx.PostForm("reason"),
+			BypassCheckin: ctx.PostForm("bypass_checkin") != "",
+		}
+
+		res, err := s.ManualPatch(ctx.Request.Context(), req)
+		if err != nil {
+			code, msg := http.StatusInternalServerError, "Failed to patch the device."
+			var ue *userError
+			if errors.As(err, &ue) {
+				code, msg = http.StatusUnprocessableEntity, ue.msg
+			} else {
+				withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Str("actor", req.Actor).Msg("failed to patch device manually")
+			}
+			renderAdminPatch(ctx, s, code, gin.H{"error": msg, "request": req})
+			return
+		}
+		renderAdminPatch(ctx, s, http.StatusOK, gin.H{"result": res})
+	}
+}
+
+// renderAdminPatch renders the manual patch form with the latest audit log.
+func renderAdminPatch(ctx *gin.Context, s *Server, code int, pageContent gin.H) {
+	token, err := csrfToken(ctx)
+	if err != nil {
+		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+		return
+	}
+	entries, err := s.listAuditEntries(ctx.Request.Context(), auditLogPageSize)
+	if err != nil {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to list audit log")
+	}
+
+	pageContent["username"] = sessions.Default(ctx).Get(sessionUserName)
+	pageContent["csrfToken"] = token
+	pageContent["auditLog"] = entries
+	renderHTML(ctx, code, "admin_patch.gohtml", pageContent)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestManualPatch(t *testing.T) {
+	const reason = "phone died during login"
+	tests := []struct {
+		name     string
+		req      ManualPatchRequest
+		checkin  bool
+		wantUser string
+		wantErr  string
+	}{
+		{name: "by MAC", req: ManualPatchRequest{Reason: reason, Target: "61:62:63:64:65:66", Username: "bob"}, checkin: true, wantUser: "bob"},
+		{name: "by IP", req: ManualPatchRequest{Reason: reason, Target: "127.0.0.1", Username: "bob"}, checkin: true, wantUser: "bob"},
+		{name: "by username", req: ManualPatchRequest{Reason: reason, Target: "bob"}, checkin: true, wantUser: "bob"},
+		{name: "no check-in", req: ManualPatchRequest{Reason: reason, Target: fixtureMAC, Username: "bob"}, wantErr: "never confirmed the check-in"},
+		{name: "no username", req: ManualPatchRequest{Reason: reason, Target: fixtureMAC}, checkin: true, wantErr: "username is required"},
+		{name: "bypass check-in", req: ManualPatchRequest{Reason: reason, Target: fixtureMAC, BypassCheckin: true}},
+		{name: "unknown device", req: ManualPatchRequest{Reason: reason, Target: "10.0.0.1", BypassCheckin: true}, wantErr: "Unable to locate"},
+		{name: "no reason", req: ManualPatchRequest{Target: fixtureMAC, BypassCheckin: true}, wantErr: "reason is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			s := env.S
+			// The device was patched by its user before.
+			if err := s.createNewLoginLog(t.Context(), sql.NullInt64{}, loginLogPatch, "bob", fixtureMAC); err != nil {
+				t.Fatal(err)
+			}
+			if tt.checkin {
+				if err := s.recordCheckin(t.Context(), s.defaultEvent(), "bob", "42"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.req.Actor = "carol"
+
+			res, err := s.ManualPatch(t.Context(), tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ManualPatch() error = %v, want %q", err, tt.wantErr)
+				}
+				if got := bounceJobs(t, s.DB); len(got) != 0 {
+					t.Errorf("bounce jobs = %v, want none", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ManualPatch() error = %v", err)
+			}
+
+			want := ManualPatchResult{Username: tt.wantUser, MAC: fixtureMAC, IP: "127.0.0.1", SwitchIP: "10.233.254.27", VLAN: fixtureVLAN}
+			if *res != want {
+				t.Errorf("ManualPatch() = %+v, want %+v", *res, want)
+			}
+			if got := bounceJobs(t, s.DB); len(got) != 1 || got[0] != (bounceJob{mac: fixtureMAC, vlan: fixtureVLAN}) {
+				t.Errorf("bounce jobs = %v, want one to VLAN %d", got, fixtureVLAN)
+			}
+			entries, err := s.listAuditEntries(t.Context(), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("audit log has %d entries, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Actor != "carol" || e.Action != auditActionManualPatch || e.Target != fixtureMAC || e.Reason != tt.req.Reason {
+				t.Errorf("audit entry = %+v", e)
+			}
+			if bypass := strings.Contains(e.Detail, "bypass_checkin=true"); bypass != tt.req.BypassCheckin {
+				t.Errorf("audit detail %q does not record bypass_checkin=%t", e.Detail, tt.req.BypassCheckin)
+			}
+		})
+	}
+}
+
+func TestManualPatchCheckinOfOtherEvent(t *testing.T) {
+	env := newTestEnv(t)
+	s := env.S
+	id := insertEvent(t, s.DB, "other", "other.example", "", 0, 0)
+	if err := s.recordCheckin(t.Context(), &event{ID: id}, "bob", "42"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.ManualPatch(t.Context(), ManualPatchRequest{Actor: "carol", Reason: "test", Target: fixtureMAC, Username: "bob"})
+	if err == nil || !strings.Contains(err.Error(), "never confirmed the check-in") {
+		t.Fatalf("ManualPatch() error = %v, want no check-in for the event of the device", err)
+	}
+	if got := bounceJobs(t, s.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestManualPatchWithoutAudit(t *testing.T) {
+	env := newTestEnv(t)
+	s := env.S
+	if _, err := s.DB.ExecContext(t.Context(), `DROP TABLE audit_log;`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bounce job is rolled back if the audit entry cannot be written.
+	_, err := s.ManualPatch(t.Context(), ManualPatchRequest{Actor: "carol", Reason: "test", Target: fixtureMAC, BypassCheckin: true})
+	if err == nil {
+		t.Fatal("ManualPatch() succeeded without an audit log")
+	}
+	if got := bounceJobs(t, s.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestAdminPatchPage(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	b.login(t)
+
+	resp, page := b.get(t, "/admin/patch")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/patch: %s:\n%s", resp.Status, page)
+	}
+	resp, page = b.post(t, "/admin/patch", url.Values{
+		csrfFormField:    {csrfTokenFrom(t, page)},
+		"target":         {fixtureMAC},
+		"reason":         {"phone died during login"},
+		"bypass_checkin": {"on"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /admin/patch: %s:\n%s", resp.Status, page)
+	}
+	if !strings.Contains(page, "phone died during login") || !strings.Contains(page, env.IdP.User.Username) {
+		t.Errorf("audit log on page does not list the patch:\n%s", page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 {
+		t.Errorf("bounce jobs = %v, want one", got)
+	}
+}
+
+func TestAdminPatchRequiresStaff(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.AdminConfig.Usernames = []string{"someone-else"}
+	b := env.newBrowser(t)
+	page := b.login(t)
+
+	if resp, _ := b.get(t, "/admin/patch"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /admin/patch: %s, want %d", resp.Status, http.StatusForbidden)
+	}
+	resp, _ := b.post(t, "/admin/patch", url.Values{
+		csrfFormField:    {csrfTokenFrom(t, page)},
+		"target":         {fixtureMAC},
+		"reason":         {"test"},
+		"bypass_checkin": {"on"},
+	})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /admin/patch: %s, want %d", resp.Status, http.StatusForbidden)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestPatchRecordsCheckin(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+
+	ok, err := env.S.hasCheckin(t.Context(), env.IdP.User.Username, env.S.defaultEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("check-in of %q not recorded", env.IdP.User.Username)
+	}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// apiPrefix is the path of the current version of the API.
+	apiPrefix = "/api/v1"
+
+	// ctxAPIClientKey holds the name of the token of an API request.
+	ctxAPIClientKey = "api_client"
+	// ctxAPIScopesKey holds the scopes of the token of an API request.
+	ctxAPIScopesKey = "api_scopes"
+)
+
+// Scopes of API tokens, see apiRoute.
+const (
+	apiScopeRead    = "read"
+	apiScopePatch   = "patch"
+	apiScopeBouncer = "bouncer"
+)
+
+// APIConfig configures the JSON API used by tools like the stream overlay and
+// the helpdesk.
+type APIConfig struct {
+	// Tokens maps the names of the clients to their bearer tokens. The API
+	// rejects all requests if empty.
+	Tokens map[string]APIToken
+}
+
+// APIToken is a bearer token of the API and the scopes it is granted.
+type APIToken struct {
+	Secret string
+	Scopes []string
+}
+
+// Codes of apiErrorDetail.
+const (
+	apiCodeInvalidRequest = "invalid_request"
+	apiCodeUnauthorized   = "unauthorized"
+	apiCodeForbidden      = "forbidden"
+	apiCodeNotFound       = "not_found"
+	apiCodeConflict       = "conflict"
+	apiCodeUnprocessable  = "unprocessable"
+	apiCodeInternal       = "internal"
+	apiCodeUnavailable    = "unavailable"
+)
+
+// apiError is the body of all error responses of the API.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code" doc:"Stable machine readable code, e.g. not_found."`
+	Message string `json:"message" doc:"Human readable description."`
+}
+
+// apiAbort aborts the request with an error object.
+func apiAbort(ctx *gin.Context, status int, code, msg string) {
+	ctx.AbortWithStatusJSON(status, apiError{apiErrorDetail{Code: code, Message: msg}})
+}
+
+// apiAbortErr aborts the request with the error object matching err.
+func (s *Server) apiAbortErr(ctx *gin.Context, err error) {
+	var ue *userError
+	switch {
+	case errors.Is(err, errNotAddress):
+		apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, "The device must be given by IP or MAC.")
+	case errors.Is(err, errBlocked):
+		apiAbort(ctx, http.StatusForbidden, apiCodeForbidden, "The user or device is blocked.")
+	case errors.Is(err, errDeviceNotFound):
+		apiAbort(ctx, http.StatusNotFound, apiCodeNotFound, "The device is not connected.")
+	case errors.Is(err, errJobNotFound):
+		apiAbort(ctx, http.StatusNotFound, apiCodeNotFound, "No such job, it may be done already.")
+	case errors.Is(err, errLeaseLost):
+		apiAbort(ctx, http.StatusConflict, apiCodeConflict, "The job is not leased by the worker, it may have been claimed by another one.")
+	case errors.Is(err, errJobNotFailed):
+		apiAbort(ctx, http.StatusConflict, apiCodeConflict, "Only failed jobs can be requeued.")
+	case errors.As(err, &ue):
+		// Checked last, as user errors may wrap the errors above.
+		apiAbort(ctx, http.StatusUnprocessableEntity, apiCodeUnprocessable, ue.msg)
+	default:
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Str("path", ctx.FullPath()).Msg("API request failed")
+		apiAbort(ctx, http.StatusInternalServerError, apiCodeInternal, "Internal error.")
+	}
+}
+
+// apiMiddleware authenticates API requests by bearer token, see
+// apiClient.
+func (s *Server) apiMiddleware(ctx *gin.Context) {
+	token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	client := ""
+	var scopes []string
+	if ok && token != "" {
+		for name, t := range s.APIConfig.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Secret)) == 1 {
+				client, scopes = name, t.Scopes
+			}
+		}
+	}
+	if client == "" {
+		withTrace(ctx.Request.Context(), s.Log).Warn().Str("path", ctx.FullPath()).Msg("API request denied")
+		ctx.Header("WWW-Authenticate", `Bearer realm="`+ServiceName+`"`)
+		apiAbort(ctx, http.StatusUnauthorized, apiCodeUnauthorized, "A valid bearer token is required.")
+		return
+	}
+	if !s.dbReady.Load() {
+		apiAbort(ctx, http.StatusServiceUnavailable, apiCodeUnavailable, "The service is starting, please try again later.")
+		return
+	}
+	ctx.Set(ctxAPIClientKey, client)
+	ctx.Set(ctxAPIScopesKey, scopes)
+	ctx.Next()
+}
+
+// apiScopeMiddleware rejects requests whose token is not granted scope.
+func (s *Server) apiScopeMiddleware(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		scopes, _ := ctx.Value(ctxAPIScopesKey).([]string)
+		if !slices.Contains(scopes, scope) {
+			withTrace(ctx.Request.Context(), s.Log).Warn().Str("client", apiClient(ctx)).Str("path", ctx.FullPath()).Msg("API request denied, missing scope")
+			apiAbort(ctx, http.StatusForbidden, apiCodeForbidden, "The token is not granted the scope "+scope+".")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// apiClient returns the name of the token authenticated by apiMiddleware.
+func apiClient(ctx *gin.Context) string {
+	return ctx.GetString(ctxAPIClientKey)
+}
+
+// apiNotFoundHandler answers unknown API routes with an error object.
+func apiNotFoundHandler(ctx *gin.Context) {
+	apiAbort(ctx, http.StatusNotFound, apiCodeNotFound, "No such endpoint.")
+}
+
+// apiRoute is an endpoint of the API. The routes are registered and
+// documented in the OpenAPI document from apiRoutes.
+type apiRoute struct {
+	method string
+	// path is relative to apiPrefix, in the gin notation.
+	path        string
+	operationID string
+	summary     string
+	// scope is the scope the token must be granted.
+	scope  string
+	params []apiParam
+	// request is the JSON body, nil if none.
+	request any
+	// response is the JSON body answered with 200.
+	response any
+	// errors are the statuses of error responses besides those of every
+	// route, 401, 403, 500 and 503.
+	errors  []int
+	handler func(*Server) gin.HandlerFunc
+}
+
+// apiParam is a path parameter of an apiRoute.
+type apiParam struct {
+	name string
+	doc  string
+}
+
+var apiRoutes = []apiRoute{
+	{
+		method: http.MethodGet, path: "/users/:username", operationID: "getUser",
+		scope:    apiScopeRead,
+		summary:  "Login status of a GeCo user",
+		params:   []apiParam{{"username", "GeCo username"}},
+		response: apiUser{},
+		errors:   []int{http.StatusNotFound},
+		handler:  apiUserHandler,
+	},
+	{
+		method: http.MethodGet, path: "/devices/:device", operationID: "getDevice",
+		scope:    apiScopeRead,
+		summary:  "Location of a connected device",
+		params:   []apiParam{{"device", "IP or MAC of the device"}},
+		response: apiDevice{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound},
+		handler:  apiDeviceHandler,
+	},
+	{
+		method: http.MethodGet, path: "/devices/:device/job", operationID: "getDeviceJob",
+		scope:    apiScopeRead,
+		summary:  "Status of the bounce job of a device",
+		params:   []apiParam{{"device", "IP or MAC of the device"}},
+		response: apiJob{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound},
+		handler:  apiJobHandler,
+	},
+	{
+		method: http.MethodPost, path: "/patches", operationID: "createPatch",
+		scope:    apiScopePatch,
+		summary:  "Patch a device on behalf of its user, like the admin page",
+		request:  apiPatchRequest{},
+		response: apiPatch{},
+		errors:   []int{http.StatusBadRequest, http.StatusUnprocessableEntity},
+		handler:  apiPatchHandler,
+	},
+	{
+		method: http.MethodGet, path: "/switches", operationID: "listSwitches",
+		scope:    apiScopeRead,
+		summary:  "Switches and the VLANs their devices are patched into",
+		response: apiSwitchList{},
+		handler:  apiSwitchesHandler,
+	},
+	{
+		method: http.MethodPost, path: "/jobs/claim", operationID: "claimJobs",
+		scope:    apiScopeBouncer,
+		summary:  "Lease queued bounce jobs to a bouncer",
+		request:  apiClaimRequest{},
+		response: apiQueueJobList{},
+		errors:   []int{http.StatusBadRequest},
+		handler:  apiClaimJobsHandler,
+	},
+	{
+		method: http.MethodPost, path: "/jobs/:id/heartbeat", operationID: "heartbeatJob",
+		scope:    apiScopeBouncer,
+		summary:  "Extend the lease of a bounce job",
+		params:   []apiParam{{"id", "ID of the job"}},
+		request:  apiLeaseRequest{},
+		response: apiQueueJob{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		handler:  apiHeartbeatJobHandler,
+	},
+	{
+		method: http.MethodPost, path: "/jobs/:id/ack", operationID: "ackJob",
+		scope:    apiScopeBouncer,
+		summary:  "Complete a leased bounce job",
+		params:   []apiParam{{"id", "ID of the job"}},
+		request:  apiLeaseRequest{},
+		response: apiQueueJob{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		handler:  apiAckJobHandler,
+	},
+	{
+		method: http.MethodPost, path: "/jobs/:id/fail", operationID: "failJob",
+		scope:    apiScopeBouncer,
+		summary:  "Report a failed attempt of a leased bounce job",
+		params:   []apiParam{{"id", "ID of the job"}},
+		request:  apiFailRequest{},
+		response: apiQueueJob{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+		handler:  apiFailJobHandler,
+	},
+	{
+		method: http.MethodPost, path: "/jobs/:id/requeue", operationID: "requeueJob",
+		scope:    apiScopePatch,
+		summary:  "Retry a failed bounce job",
+		params:   []apiParam{{"id", "ID of the job"}},
+		request:  apiRequeueRequest{},
+		response: apiQueueJob{},
+		errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+		handler:  apiRequeueJobHandler,
+	},
+}
+
+type apiUser struct {
+	Username  string    `json:"username"`
+	CheckedIn bool      `json:"checked_in" doc:"Whether GeCo ever confirmed the check-in at a login, for any event."`
+	LastLogin *apiLogin `json:"last_login,omitempty" doc:"Last patch or disconnect of the user."`
+	Blocklist string    `json:"blocklist,omitempty" doc:"block or quarantine if the user or the last device is on the blocklist."`
+}
+
+type apiLogin struct {
+	MAC    string    `json:"mac"`
+	Action string    `json:"action" doc:"patch or disconnect"`
+	At     time.Time `json:"at"`
+}
+
+func apiUserHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.Param("username")
+		checkedIn, err := s.hasCheckin(ctx.Request.Context(), username, nil)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		last, err := s.getLastLoginOfUser(ctx.Request.Context(), username)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		if !checkedIn && last == nil {
+			apiAbort(ctx, http.StatusNotFound, apiCodeNotFound, "The user never logged in.")
+			return
+		}
+
+		user := apiUser{Username: username, CheckedIn: checkedIn}
+		mac := ""
+		if last != nil {
+			user.LastLogin = &apiLogin{MAC: last.mac, Action: last.action, At: last.at}
+			mac = last.mac
+		}
+		b, err := s.findBlock(ctx.Request.Context(), "", username, mac)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		if b != nil {
+			user.Blocklist = b.Action
+		}
+		ctx.JSON(http.StatusOK, user)
+	}
+}
+
+type apiDevice struct {
+	IP         string `json:"ip"`
+	MAC        string `json:"mac"`
+	SwitchIP   string `json:"switch_ip"`
+	SwitchVLAN int    `json:"switch_vlan,omitempty" doc:"VLAN devices on the switch are patched into, if the switch is known."`
+	Event      string `json:"event" doc:"Name of the event of the device's network."`
+}
+
+func apiDeviceHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		up, err := s.locateDevice(ctx.Request.Context(), ctx.Param("device"))
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		ev, err := s.eventFor(ctx.Request.Context(), "", up.userIP)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		device := apiDevice{IP: up.userIP, MAC: up.userMAC, SwitchIP: up.switchIP, Event: ev.Name}
+		if vlan, err := s.getSwitchVLAN(ctx.Request.Context(), up.switchIP); err == nil {
+			device.SwitchVLAN = vlan
+		}
+		ctx.JSON(http.StatusOK, device)
+	}
+}
+
+type apiJob struct {
+	MAC        string     `json:"mac"`
+	State      string     `json:"state" doc:"queued or bouncing while the bouncer has not done the job, failed if it gave up, idle otherwise."`
+	TargetVLAN int        `json:"target_vlan,omitempty"`
+	Retries    int        `json:"retries"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// bounceIdle is the state of devices without pending bounce job.
+const bounceIdle = "idle"
+
+func apiJobHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// Jobs are looked up by MAC, the device need not be connected.
+		mac, ok := normalizeMAC(ctx.Param("device"))
+		if !ok {
+			up, err := s.locateDevice(ctx.Request.Context(), ctx.Param("device"))
+			if err != nil {
+				s.apiAbortErr(ctx, err)
+				return
+			}
+			mac = up.userMAC
+		}
+		job, err := s.getBounceJob(ctx.Request.Context(), mac)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+
+		res := apiJob{MAC: mac, State: bounceIdle}
+		if job != nil {
+			res.State, res.TargetVLAN, res.Retries, res.UpdatedAt = job.state(), job.TargetVLAN, job.Retries, &job.UpdatedAt
+		}
+		ctx.JSON(http.StatusOK, res)
+	}
+}
+
+type apiPatchRequest struct {
+	Target        string `json:"target" doc:"MAC or IP of the device, or the GeCo username whose last device is patched."`
+	Username      string `json:"username,omitempty" doc:"GeCo username of the device's user, to verify the check-in."`
+	Reason        string `json:"reason" doc:"Recorded in the audit log."`
+	BypassCheckin bool   `json:"bypass_checkin,omitempty"`
+}
+
+type apiPatch struct {
+	Username string `json:"username"`
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	SwitchIP string `json:"switch_ip"`
+	VLAN     int    `json:"vlan"`
+}
+
+func apiPatchHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiPatchRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, "The body must be a JSON patch request.")
+			return
+		}
+
+		res, err := s.ManualPatch(ctx.Request.Context(), ManualPatchRequest{
+			Target:        req.Target,
+			Username:      req.Username,
+			Actor:         "api:" + apiClient(ctx),
+			Reason:        req.Reason,
+			BypassCheckin: req.BypassCheckin,
+		})
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, apiPatch{Username: res.Username, MAC: res.MAC, IP: res.IP, SwitchIP: res.SwitchIP, VLAN: res.VLAN})
+	}
+}
+
+type apiSwitchList struct {
+	Switches []apiSwitch `json:"switches"`
+}
+
+type apiSwitch struct {
+	Hostname string   `json:"hostname"`
+	Location string   `json:"location,omitempty"`
+	VLAN     int      `json:"vlan" doc:"VLAN devices on the switch are patched into."`
+	IPs      []string `json:"ips"`
+}
+
+func apiSwitchesHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		switches, err := s.listSwitches(ctx.Request.Context())
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		res := apiSwitchList{Switches: []apiSwitch{}}
+		for _, sw := range switches {
+			res.Switches = append(res.Switches, apiSwitch{Hostname: sw.hostname, Location: sw.location, VLAN: sw.vlan, IPs: sw.ips})
+		}
+		ctx.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// api requests path of the API with token and decodes the JSON response into
+// res.
+func (e *testEnv) api(t *testing.T, method, path, token string, body, res any) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(t.Context(), method, e.URL+apiPrefix+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("%s %s: Content-Type %q, want JSON", method, path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func TestAPIErrors(t *testing.T) {
+	env := newTestEnv(t)
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		code   string
+	}{
+		{name: "no token", path: "/switches", status: http.StatusUnauthorized, code: apiCodeUnauthorized},
+		{name: "wrong token", path: "/switches", token: "fedcba9876543210", status: http.StatusUnauthorized, code: apiCodeUnauthorized},
+		{name: "unknown route", path: "/nothing", token: testAPIToken, status: http.StatusNotFound, code: apiCodeNotFound},
+		{name: "not an address", path: "/devices/nonsense", token: testAPIToken, status: http.StatusBadRequest, code: apiCodeInvalidRequest},
+		{name: "unknown device", path: "/devices/10.0.0.1", token: testAPIToken, status: http.StatusNotFound, code: apiCodeNotFound},
+		{name: "unknown user", path: "/users/mallory", token: testAPIToken, status: http.StatusNotFound, code: apiCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res apiError
+			resp := env.api(t, http.MethodGet, tt.path, tt.token, nil, &res)
+			if resp.StatusCode != tt.status || res.Error.Code != tt.code || res.Error.Message == "" {
+				t.Errorf("GET %s: %s %+v, want %d with code %q", tt.path, resp.Status, res, tt.status, tt.code)
+			}
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header missing")
+			}
+		})
+	}
+}
+
+func TestAPIDevice(t *testing.T) {
+	env := newTestEnv(t)
+	want := apiDevice{IP: "127.0.0.1", MAC: fixtureMAC, SwitchIP: "10.233.254.27", SwitchVLAN: fixtureVLAN, Event: defaultEventTitle}
+	for _, device := range []string{"127.0.0.1", "61:62:63:64:65:66"} {
+		var got apiDevice
+		resp := env.api(t, http.MethodGet, "/devices/"+device, testAPIToken, nil, &got)
+		if resp.StatusCode != http.StatusOK || got != want {
+			t.Errorf("GET /devices/%s: %s %+v, want %+v", device, resp.Status, got, want)
+		}
+	}
+
+	var switches apiSwitchList
+	env.api(t, http.MethodGet, "/switches", testAPIToken, nil, &switches)
+	if len(switches.Switches) != 1 || switches.Switches[0].VLAN != fixtureVLAN || len(switches.Switches[0].IPs) != 1 {
+		t.Errorf("GET /switches = %+v, want the switch of VLAN %d", switches, fixtureVLAN)
+	}
+}
+
+func TestAPIPatch(t *testing.T) {
+	env := newTestEnv(t)
+
+	var invalid apiError
+	resp := env.api(t, http.MethodPost, "/patches", testAPIToken, apiPatchRequest{Target: fixtureMAC, Username: "bob"}, &invalid)
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(invalid.Error.Message, "reason") {
+		t.Errorf("POST /patches without reason: %s %+v, want %d", resp.Status, invalid, http.StatusUnprocessableEntity)
+	}
+
+	req := apiPatchRequest{Target: fixtureMAC, Username: "bob", Reason: "helpdesk ticket 7", BypassCheckin: true}
+	var patch apiPatch
+	resp = env.api(t, http.MethodPost, "/patches", testAPIToken, req, &patch)
+	want := apiPatch{Username: "bob", MAC: fixtureMAC, IP: "127.0.0.1", SwitchIP: "10.233.254.27", VLAN: fixtureVLAN}
+	if resp.StatusCode != http.StatusOK || patch != want {
+		t.Fatalf("POST /patches: %s %+v, want %+v", resp.Status, patch, want)
+	}
+	entries, err := env.S.listAuditEntries(t.Context(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "api:"+testAPIClient {
+		t.Errorf("audit log = %+v, want the patch by the API client", entries)
+	}
+
+	var job apiJob
+	env.api(t, http.MethodGet, "/devices/127.0.0.1/job", testAPIToken, nil, &job)
+	if job.MAC != fixtureMAC || job.State != bounceQueued || job.TargetVLAN != fixtureVLAN || job.UpdatedAt == nil {
+		t.Errorf("GET /devices/127.0.0.1/job = %+v, want queued to VLAN %d", job, fixtureVLAN)
+	}
+	if _, err := env.S.DB.ExecContext(t.Context(), `DELETE FROM bouncer_jobs;`); err != nil {
+		t.Fatal(err)
+	}
+	job = apiJob{}
+	env.api(t, http.MethodGet, "/devices/"+fixtureMAC+"/job", testAPIToken, nil, &job)
+	if job.State != bounceIdle {
+		t.Errorf("job state = %q after the bouncer, want %q", job.State, bounceIdle)
+	}
+
+	var user apiUser
+	resp = env.api(t, http.MethodGet, "/users/bob", testAPIToken, nil, &user)
+	if resp.StatusCode != http.StatusOK || user.CheckedIn || user.LastLogin == nil || user.LastLogin.MAC != fixtureMAC || user.LastLogin.Action != loginLogPatch {
+		t.Errorf("GET /users/bob: %s %+v, want the last patch", resp.Status, user)
+	}
+
+	// Internal errors are not blamed on the request.
+	if _, err := env.S.DB.ExecContext(t.Context(), `DROP TABLE blocklist;`); err != nil {
+		t.Fatal(err)
+	}
+	var internal apiError
+	resp = env.api(t, http.MethodPost, "/patches", testAPIToken, req, &internal)
+	if resp.StatusCode != http.StatusInternalServerError || internal.Error.Code != apiCodeInternal {
+		t.Errorf("POST /patches without the blocklist: %s %+v, want %d", resp.Status, internal, http.StatusInternalServerError)
+	}
+}
+
+func TestAPIScopes(t *testing.T) {
+	env := newTestEnv(t)
+	var switches apiSwitchList
+	if resp := env.api(t, http.MethodGet, "/switches", testAPIReadToken, nil, &switches); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /switches with a read token: %s, want %d", resp.Status, http.StatusOK)
+	}
+
+	// A read token may neither patch nor work the job queue.
+	for _, tt := range []struct {
+		path string
+		body any
+	}{
+		{path: "/patches", body: apiPatchRequest{Target: fixtureMAC, Reason: "test", BypassCheckin: true}},
+		{path: "/jobs/claim", body: apiClaimRequest{}},
+		{path: "/jobs/1/requeue", body: apiRequeueRequest{}},
+	} {
+		var res apiError
+		resp := env.api(t, http.MethodPost, tt.path, testAPIReadToken, tt.body, &res)
+		if resp.StatusCode != http.StatusForbidden || res.Error.Code != apiCodeForbidden {
+			t.Errorf("POST %s with a read token: %s %+v, want %d", tt.path, resp.Status, res, http.StatusForbidden)
+		}
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	env := newTestEnv(t)
+	var doc struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	resp := env.api(t, http.MethodGet, "/openapi.json", "", nil, &doc)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("GET /openapi.json: %s, openapi %q", resp.Status, doc.OpenAPI)
+	}
+
+	for _, route := range apiRoutes {
+		path := strings.NewReplacer(":username", "{username}", ":device", "{device}", ":id", "{id}").Replace(route.path)
+		op, ok := doc.Paths[path][strings.ToLower(route.method)].(map[string]any)
+		if !ok {
+			t.Errorf("%s %s is not documented", route.method, path)
+			continue
+		}
+		if route.scope == "" || op["x-scope"] != route.scope {
+			t.Errorf("%s %s has the scope %q, documented as %v", route.method, path, route.scope, op["x-scope"])
+		}
+	}
+
+	// Every reference resolves.
+	var refs func(v any)
+	refs = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if doc.Components.Schemas[name] == nil {
+					t.Errorf("unresolved reference %q", ref)
+				}
+			}
+			for _, e := range v {
+				refs(e)
+			}
+		case []any:
+			for _, e := range v {
+				refs(e)
+			}
+		}
+	}
+	for _, item := range doc.Paths {
+		refs(map[string]any(item))
+	}
+	refs(doc.Components.Schemas)
+}
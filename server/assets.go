@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// OverlayFS returns a file system serving files from upper if they exist
+// there and from lower otherwise. It is used to override single embedded
+// templates or static files with custom ones at runtime.
+func OverlayFS(upper, lower fs.FS) fs.FS {
+	return overlayFS{upper: upper, lower: lower}
+}
+
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.lower.Open(name)
+}
+
+// ReadDir merges the entries of both layers, so globs like
+// templates/*.gohtml see the files of both.
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.upper, name)
+	if upperErr != nil && !errors.Is(upperErr, fs.ErrNotExist) {
+		return nil, upperErr
+	}
+	lower, lowerErr := fs.ReadDir(o.lower, name)
+	if lowerErr != nil && !errors.Is(lowerErr, fs.ErrNotExist) {
+		return nil, lowerErr
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+
+	entries := slices.Clone(upper)
+	for _, e := range lower {
+		if !slices.ContainsFunc(upper, func(u fs.DirEntry) bool { return u.Name() == e.Name() }) {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
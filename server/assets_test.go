@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAssetsOverlay checks that files of the assets directory override the
+// embedded ones and that missing files fall back to them.
+func TestAssetsOverlay(t *testing.T) {
+	env := newTestEnv(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"templates/index.gohtml": `{{template "header" .}}<h1>Welcome to the custom portal</h1>{{template "footer"}}`,
+		"static/css/style.css":   "body { color: hotpink; }",
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The tests use the assets of the repository as the embedded ones.
+	embedded := os.DirFS("..")
+	env.S.Assets = OverlayFS(os.DirFS(dir), embedded)
+	r, err := env.S.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, page := get("/"); code != http.StatusOK || !strings.Contains(page, "Welcome to the custom portal") {
+		t.Errorf("GET /: %d, want %d with the custom template:\n%s", code, http.StatusOK, page)
+	}
+	if code, body := get("/static/css/style.css"); code != http.StatusOK || body != "body { color: hotpink; }" {
+		t.Errorf("GET /static/css/style.css: %d, want %d with the custom file:\n%s", code, http.StatusOK, body)
+	}
+
+	// The files missing in the directory are the embedded ones.
+	css, err := os.ReadFile("../static/css/bootstrap.min.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/static/css/bootstrap.min.css"); code != http.StatusOK || body != string(css) {
+		t.Errorf("GET /static/css/bootstrap.min.css: %d, want %d with the embedded file", code, http.StatusOK)
+	}
+	env.S.dbReady.Store(false)
+	if code, page := get("/"); code != http.StatusServiceUnavailable || !strings.Contains(page, "The login is starting up.") {
+		t.Errorf("GET / in maintenance: %d, want %d with the embedded template:\n%s", code, http.StatusServiceUnavailable, page)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditActionManualPatch    = "manual_patch"
+	auditActionCreateVouchers = "create_vouchers"
+	auditActionCloseEvent     = "close_event"
+	auditActionBlock          = "block"
+	auditActionUnblock        = "unblock"
+	auditActionRequeueJob     = "requeue_job"
+	auditActionAddWebhook     = "add_webhook"
+	auditActionRemoveWebhook  = "remove_webhook"
+)
+
+// auditEntry is a staff action recorded in the audit log.
+type auditEntry struct {
+	CreatedAt time.Time
+	// Actor is the GeCo username of the staff member, or "cli:<user>" for
+	// the command line.
+	Actor  string
+	Action string
+	// Target is the device or user acted upon.
+	Target string
+	Detail string
+	Reason string
+}
+
+func (s *Server) createAuditEntry(ctx context.Context, e auditEntry) error {
+	return s.writeAuditEntry(ctx, s.DB, e)
+}
+
+// writeAuditEntry writes e with ex, e.g. in the transaction of the action.
+func (s *Server) writeAuditEntry(ctx context.Context, ex execer, e auditEntry) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.createAuditEntry", s.DB.dialect.q.insertAuditLog)
+	defer func() { endSpan(span, err) }()
+
+	_, err = ex.ExecContext(ctx, s.DB.dialect.q.insertAuditLog, e.Actor, e.Action, e.Target, e.Detail, e.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// listAuditEntries returns the latest limit entries, newest first.
+func (s *Server) listAuditEntries(ctx context.Context, limit int) (entries []auditEntry, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listAuditEntries", s.DB.dialect.q.listAuditLog)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listAuditLog, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.CreatedAt, &e.Actor, &e.Action, &e.Target, &e.Detail, &e.Reason); err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
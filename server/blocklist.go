@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of blocklist entries, by what they match.
+const (
+	blockKindSub      = "sub"
+	blockKindUsername = "username"
+	blockKindMAC      = "mac"
+)
+
+// Actions of blocklist entries.
+const (
+	// blockActionBlock refuses to patch the device.
+	blockActionBlock = "block"
+	// blockActionQuarantine patches the device into the quarantine VLAN.
+	blockActionQuarantine = "quarantine"
+)
+
+// blocklistPageSize is the number of entries listed on the admin page.
+const blocklistPageSize = 100
+
+// errBlocked is returned if the user or device is blocked.
+var errBlocked = errors.New("blocked")
+
+// BlocklistConfig configures how blocked attendees and devices are handled.
+type BlocklistConfig struct {
+	// QuarantineVLAN is the VLAN of quarantined devices. Quarantined devices
+	// are blocked if 0.
+	QuarantineVLAN int
+}
+
+// blockEntry blocks or quarantines an attendee by GeCo subject or username,
+// or a device by MAC.
+type blockEntry struct {
+	ID        int64
+	Kind      string
+	Value     string
+	Action    string
+	Reason    string
+	Author    string
+	CreatedAt time.Time
+	// ExpiresAt is not valid for entries which never expire.
+	ExpiresAt sql.NullTime
+}
+
+// Expired reports whether the entry does not apply anymore.
+func (b blockEntry) Expired() bool {
+	return b.ExpiresAt.Valid && !time.Now().Before(b.ExpiresAt.Time)
+}
+
+// BlockRequest asks to add an entry to the blocklist.
+type BlockRequest struct {
+	Kind   string
+	Value  string
+	Action string
+	Reason string
+	// ExpiresIn is how long the entry applies, 0 for ever.
+	ExpiresIn time.Duration
+	// Author is recorded with the entry and in the audit log.
+	Author string
+}
+
+type blockRow interface {
+	Scan(dest ...any) error
+}
+
+func scanBlockEntry(row blockRow) (b blockEntry, err error) {
+	err = row.Scan(&b.ID, &b.Kind, &b.Value, &b.Action, &b.Reason, &b.Author, &b.CreatedAt, &b.ExpiresAt)
+	return b, err
+}
+
+// findBlock returns the entry applying to the attendee sub or username or the
+// device mac, preferring blocks over quarantines, or nil if there is none.
+func (s *Server) findBlock(ctx context.Context, sub, username, mac string) (b *blockEntry, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.findBlock", s.DB.dialect.q.findBlock)
+	defer func() { endSpan(span, err) }()
+
+	entry, err := scanBlockEntry(s.DB.QueryRowContext(ctx, s.DB.dialect.q.findBlock, sub, username, mac, time.Now()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check blocklist: %w", err)
+	}
+	return &entry, nil
+}
+
+// blockedVLAN checks the blocklist before a device is patched. It returns an
+// error if the device must not be patched, otherwise vlan or the quarantine
+// VLAN if the device is quarantined. The blocklist.hit of a quarantine is
+// returned, to be queued with the bounce job, that of a block is queued at
+// once as nothing else is changed.
+func (s *Server) blockedVLAN(ctx context.Context, sub, username string, up *userProperties, vlan int) (int, *outboxEvent, error) {
+	b, err := s.findBlock(ctx, sub, username, up.userMAC)
+	if err != nil {
+		return 0, nil, err
+	}
+	if b == nil {
+		return vlan, nil, nil
+	}
+
+	log := withTrace(ctx, s.Log).With().
+		Int64("block", b.ID).
+		Str("username", username).
+		Str("user MAC", up.userMAC).
+		Logger()
+	hit := webhookBlock{BlockID: b.ID, Action: blockActionBlock, Kind: b.Kind, Value: b.Value, Username: username, MAC: up.userMAC}
+	if b.Action == blockActionQuarantine && s.BlocklistConfig.QuarantineVLAN != 0 {
+		metricBlocklistHits.WithLabelValues(blockActionQuarantine).Inc()
+		log.Warn().Msg("Device is quarantined.")
+		hit.Action = blockActionQuarantine
+		return s.BlocklistConfig.QuarantineVLAN, &outboxEvent{webhookBlocklistHit, hit}, nil
+	}
+	metricBlocklistHits.WithLabelValues(blockActionBlock).Inc()
+	log.Warn().Msg("Device is blocked.")
+	s.emitEvent(ctx, outboxEvent{webhookBlocklistHit, hit})
+	return 0, nil, &userError{"Your access to the network has been blocked. Please contact the support.", errBlocked}
+}
+
+// addBlock adds an entry to the blocklist and records it in the audit log.
+func (s *Server) addBlock(ctx context.Context, req BlockRequest) (err error) {
+	value := strings.TrimSpace(req.Value)
+	reason := strings.TrimSpace(req.Reason)
+	if req.Kind == blockKindMAC {
+		mac, ok := normalizeMAC(value)
+		if !ok {
+			return &userError{"The MAC is not valid.", fmt.Errorf("invalid MAC %q", value)}
+		}
+		value = mac
+	}
+	switch {
+	case !slices.Contains([]string{blockKindSub, blockKindUsername, blockKindMAC}, req.Kind):
+		return &userError{"Block by GeCo subject, username or MAC.", fmt.Errorf("invalid kind %q", req.Kind)}
+	case value == "":
+		return &userError{"The subject, username or MAC is required.", errors.New("empty value")}
+	case req.Action != blockActionBlock && req.Action != blockActionQuarantine:
+		return &userError{"Block or quarantine.", fmt.Errorf("invalid action %q", req.Action)}
+	case req.Action == blockActionQuarantine && s.BlocklistConfig.QuarantineVLAN == 0:
+		return &userError{"No quarantine VLAN is configured.", errors.New("no quarantine VLAN")}
+	case reason == "":
+		return &userError{"A reason is required.", errors.New("empty reason")}
+	case req.ExpiresIn < 0:
+		return &userError{"The expiry must not be in the past.", fmt.Errorf("negative expiry %v", req.ExpiresIn)}
+	case req.Author == "":
+		return errors.New("author is required")
+	}
+
+	var expiresAt sql.NullTime
+	if req.ExpiresIn > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(req.ExpiresIn), Valid: true}
+	}
+
+	ctx, span := s.DB.startSpan(ctx, "db.addBlock", s.DB.dialect.q.insertBlock)
+	defer func() { endSpan(span, err) }()
+	_, err = s.DB.ExecContext(ctx, s.DB.dialect.q.insertBlock, req.Kind, value, req.Action, reason, req.Author, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to add to blocklist: %w", err)
+	}
+
+	err = s.createAuditEntry(ctx, auditEntry{
+		Actor:  req.Author,
+		Action: auditActionBlock,
+		Target: req.Kind + "=" + value,
+		Detail: fmt.Sprintf("action=%s expires_in=%s", req.Action, req.ExpiresIn),
+		Reason: reason,
+	})
+	if err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Msg("failed to write audit log of block")
+	}
+	return nil
+}
+
+// removeBlock deletes an entry of the blocklist and records it in the audit
+// log.
+func (s *Server) removeBlock(ctx context.Context, id int64, actor string) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.removeBlock", s.DB.dialect.q.deleteBlock)
+	defer func() { endSpan(span, err) }()
+
+	b, err := scanBlockEntry(s.DB.QueryRowContext(ctx, s.DB.dialect.q.getBlock, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &userError{"The entry does not exist anymore.", err}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get blocklist entry: %w", err)
+	}
+	if _, err = s.DB.ExecContext(ctx, s.DB.dialect.q.deleteBlock, id); err != nil {
+		return fmt.Errorf("failed to remove from blocklist: %w", err)
+	}
+
+	err = s.createAuditEntry(ctx, auditEntry{
+		Actor:  actor,
+		Action: auditActionUnblock,
+		Target: b.Kind + "=" + b.Value,
+		Detail: fmt.Sprintf("action=%s author=%s", b.Action, b.Author),
+		Reason: b.Reason,
+	})
+	if err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Msg("failed to write audit log of unblock")
+	}
+	return nil
+}
+
+// listBlocklist returns the latest limit entries, newest first, including
+// expired ones.
+func (s *Server) listBlocklist(ctx context.Context, limit int) (entries []blockEntry, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listBlocklist", s.DB.dialect.q.listBlocklist)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listBlocklist, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocklist: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b, err := scanBlockEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blocklist: %w", err)
+		}
+		entries = append(entries, b)
+	}
+	return entries, rows.Err()
+}
+
+func adminBlocklistPageHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		renderAdminBlocklist(ctx, s, http.StatusOK, gin.H{})
+	}
+}
+
+func adminBlockHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		author, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+		req := BlockRequest{
+			Kind:   ctx.PostForm("kind"),
+			Value:  ctx.PostForm("value"),
+			Action: ctx.PostForm("action"),
+			Reason: ctx.PostForm("reason"),
+			Author: author,
+		}
+		hours, err := atoiOrZero(ctx.PostForm("expires_hours"))
+		if err != nil {
+			err = &userError{"The expiry must be a number of hours.", err}
+		} else {
+			req.ExpiresIn = time.Duration(hours) * time.Hour
+			err = s.addBlock(ctx.Request.Context(), req)
+		}
+		if err != nil {
+			renderAdminBlocklistError(ctx, s, err)
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/admin/blocklist")
+	}
+}
+
+func adminUnblockHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		actor, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			err = &userError{"The entry does not exist.", err}
+		} else {
+			err = s.removeBlock(ctx.Request.Context(), id, actor)
+		}
+		if err != nil {
+			renderAdminBlocklistError(ctx, s, err)
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/admin/blocklist")
+	}
+}
+
+func renderAdminBlocklistError(ctx *gin.Context, s *Server, err error) {
+	msg := "Failed to update the blocklist."
+	var ue *userError
+	if errors.As(err, &ue) {
+		msg = ue.msg
+	} else {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to update blocklist")
+	}
+	renderAdminBlocklist(ctx, s, http.StatusUnprocessableEntity, gin.H{"error": msg})
+}
+
+// renderAdminBlocklist renders the blocklist with the form to add entries.
+func renderAdminBlocklist(ctx *gin.Context, s *Server, code int, pageContent gin.H) {
+	token, err := csrfToken(ctx)
+	if err != nil {
+		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+		return
+	}
+	entries, err := s.listBlocklist(ctx.Request.Context(), blocklistPageSize)
+	if err != nil {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to list blocklist")
+	}
+
+	pageContent["username"] = sessions.Default(ctx).Get(sessionUserName)
+	pageContent["csrfToken"] = token
+	pageContent["entries"] = entries
+	pageContent["quarantine"] = s.BlocklistConfig.QuarantineVLAN != 0
+	renderHTML(ctx, code, "admin_blocklist.gohtml", pageContent)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocklistPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      BlockRequest
+		expire   bool
+		wantVLAN int
+		wantErr  bool
+		wantHit  bool
+	}{
+		{name: "sub", req: BlockRequest{Kind: blockKindSub, Value: "42", Action: blockActionBlock}, wantErr: true, wantHit: true},
+		{name: "username", req: BlockRequest{Kind: blockKindUsername, Value: "alice", Action: blockActionBlock}, wantErr: true, wantHit: true},
+		{name: "MAC", req: BlockRequest{Kind: blockKindMAC, Value: "61:62:63:64:65:66", Action: blockActionBlock}, wantErr: true, wantHit: true},
+		{name: "quarantine", req: BlockRequest{Kind: blockKindMAC, Value: fixtureMAC, Action: blockActionQuarantine}, wantVLAN: testQuarantineVLAN, wantHit: true},
+		{name: "expired", req: BlockRequest{Kind: blockKindUsername, Value: "alice", Action: blockActionBlock, ExpiresIn: time.Hour}, expire: true, wantVLAN: fixtureVLAN},
+		{name: "other user", req: BlockRequest{Kind: blockKindUsername, Value: "bob", Action: blockActionBlock}, wantVLAN: fixtureVLAN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			tt.req.Reason, tt.req.Author = "spamming the network", "carol"
+			if err := env.S.addBlock(t.Context(), tt.req); err != nil {
+				t.Fatal(err)
+			}
+			if tt.expire {
+				if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE blocklist SET expires_at = ?;`, time.Now().Add(-time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b := env.newBrowser(t)
+			page := b.login(t)
+
+			resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+			jobs := bounceJobs(t, env.S.DB)
+			if hit := slices.Contains(pendingEvents(t, env.S.DB), webhookBlocklistHit); hit != tt.wantHit {
+				t.Errorf("%s queued = %v, want %v", webhookBlocklistHit, hit, tt.wantHit)
+			}
+			if tt.wantErr {
+				if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, "has been blocked") {
+					t.Errorf("POST /patch: %s, want %d:\n%s", resp.Status, http.StatusForbidden, page)
+				}
+				if len(jobs) != 0 {
+					t.Errorf("bounce jobs = %v, want none", jobs)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+			}
+			if len(jobs) != 1 || jobs[0] != (bounceJob{mac: fixtureMAC, vlan: tt.wantVLAN}) {
+				t.Errorf("bounce jobs = %v, want one to VLAN %d", jobs, tt.wantVLAN)
+			}
+		})
+	}
+}
+
+// TestBlocklistQuarantineFailed checks that the blocklist.hit of a quarantine
+// is not queued if the device cannot be patched.
+func TestBlocklistQuarantineFailed(t *testing.T) {
+	env := newTestEnv(t)
+	err := env.S.addBlock(t.Context(), BlockRequest{Kind: blockKindMAC, Value: fixtureMAC, Action: blockActionQuarantine, Reason: "infected", Author: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if _, err := env.S.DB.ExecContext(t.Context(), `DROP TABLE bouncer_jobs;`); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST /patch: %s, want %d:\n%s", resp.Status, http.StatusInternalServerError, page)
+	}
+	if got := pendingEvents(t, env.S.DB); slices.Contains(got, webhookBlocklistHit) {
+		t.Errorf("queued events = %v, want no %s", got, webhookBlocklistHit)
+	}
+}
+
+func TestBlocklistVoucher(t *testing.T) {
+	env := newTestEnv(t)
+	err := env.S.addBlock(t.Context(), BlockRequest{Kind: blockKindMAC, Value: fixtureMAC, Action: blockActionBlock, Reason: "stolen", Author: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := env.S.createVoucherBatch(t.Context(), VoucherBatchRequest{Label: "Press", Count: 1, OneTime: true, Actor: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, vouchers, err := env.S.getVoucherBatch(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, page := env.redeem(t, vouchers[0].Formatted())
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, "has been blocked") {
+		t.Errorf("POST /voucher: %s, want %d:\n%s", resp.Status, http.StatusForbidden, page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+	// The voucher is not used up by the blocked device.
+	_, vouchers, err = env.S.getVoucherBatch(t.Context(), id)
+	if err != nil || vouchers[0].Uses != 0 {
+		t.Errorf("voucher = %+v, %v, want unused", vouchers, err)
+	}
+}
+
+func TestBlocklistAdminPage(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.newBrowser(t)
+	admin.login(t)
+
+	_, page := admin.get(t, "/admin/blocklist")
+	resp, page := admin.post(t, "/admin/blocklist", url.Values{
+		csrfFormField:   {csrfTokenFrom(t, page)},
+		"kind":          {blockKindMAC},
+		"value":         {"61-62-63-64-65-66"},
+		"action":        {blockActionQuarantine},
+		"reason":        {"infected with malware"},
+		"expires_hours": {"12"},
+	})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/admin/blocklist" {
+		t.Fatalf("POST /admin/blocklist ended on %s with %s:\n%s", resp.Request.URL, resp.Status, page)
+	}
+	if !strings.Contains(page, "mac="+fixtureMAC) || !strings.Contains(page, "infected with malware") {
+		t.Errorf("admin page does not list the entry:\n%s", page)
+	}
+
+	resp, page = admin.post(t, "/admin/blocklist", url.Values{
+		csrfFormField: {csrfTokenFrom(t, page)},
+		"kind":        {blockKindUsername},
+		"value":       {"bob"},
+		"action":      {blockActionBlock},
+	})
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(page, "reason is required") {
+		t.Errorf("POST /admin/blocklist without reason: %s, want %d:\n%s", resp.Status, http.StatusUnprocessableEntity, page)
+	}
+
+	entries, err := env.S.listBlocklist(t.Context(), blocklistPageSize)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("listBlocklist() = %v, %v, want one entry", entries, err)
+	}
+	resp, page = admin.post(t, "/admin/blocklist/"+strconv.FormatInt(entries[0].ID, 10)+"/delete", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusOK || strings.Contains(page, "infected with malware") {
+		t.Errorf("POST delete: %s, want the entry removed:\n%s", resp.Status, page)
+	}
+
+	audit, err := env.S.listAuditEntries(t.Context(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 2 || audit[0].Action != auditActionUnblock || audit[1].Action != auditActionBlock {
+		t.Fatalf("audit log = %+v, want block and unblock", audit)
+	}
+	if e := audit[1]; e.Actor != env.IdP.User.Username || e.Target != "mac="+fixtureMAC || e.Reason != "infected with malware" {
+		t.Errorf("audit entry = %+v", e)
+	}
+}
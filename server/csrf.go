@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCSRFKey = "csrf"
+
+	// csrfFormField is the hidden form field carrying the token.
+	csrfFormField = "csrf_token"
+	// csrfHeader may carry the token instead, for scripts.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token bound to the session, creating and saving
+// one if needed.
+func csrfToken(ctx *gin.Context) (string, error) {
+	session := sessions.Default(ctx)
+	if token, ok := session.Get(sessionCSRFKey).(string); ok {
+		return token, nil
+	}
+
+	token, err := randString(32)
+	if err != nil {
+		return "", err
+	}
+	session.Set(sessionCSRFKey, token)
+	if err := session.Save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// csrfMiddleware rejects requests whose token does not match the one bound
+// to the session. It protects all state-changing routes.
+func (s *Server) csrfMiddleware(ctx *gin.Context) {
+	expected, _ := sessions.Default(ctx).Get(sessionCSRFKey).(string)
+	got := ctx.PostForm(csrfFormField)
+	if got == "" {
+		got = ctx.GetHeader(csrfHeader)
+	}
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(got)) != 1 {
+		withTrace(ctx.Request.Context(), s.Log).Warn().Str("path", ctx.FullPath()).Msg("invalid CSRF token")
+		renderError(ctx, "index.gohtml", http.StatusForbidden, "Your session has expired. Please try again.")
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
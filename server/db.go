@@ -5,53 +5,162 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	migrate "github.com/rubenv/sql-migrate"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type db struct {
 	*sql.DB
+	dialect *dialect
 }
 
+// dialect abstracts the differences between the supported database systems:
+// the driver, the SQL of every statement and the advisory lock.
+type dialect struct {
+	// name is the sql-migrate dialect and the directory of the migrations.
+	name   string
+	driver string
+	// system is the db.system attribute of the spans.
+	system attribute.KeyValue
+	dsn    func(user, password, server, port, database string) string
+
+	// getMigrationLock gets the advisory lock name on conn, waiting up to
+	// timeout. It reports whether the lock was acquired.
+	getMigrationLock func(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (bool, error)
+
+	q queries
+}
+
+// queries holds the statements of a dialect.
+type queries struct {
+	getUserProperties      string
+	getUserPropertiesByMAC string
+	getLastMACOfUser       string
+	insertBounceJob        string
+	insertLoginLog         string
+	getSwitchVLAN          string
+	getBouncerBacklog      string
+	listEvents             string
+
+	getBounceJobOfMAC   string
+	hasAcctSessionSince string
+	getLastLoginOfUser  string
+	listSwitches        string
+
+	listClaimableBounceJobs string
+	claimBounceJob          string
+	getQueuedBounceJob      string
+	extendBounceJobLease    string
+	deleteBounceJob         string
+	releaseBounceJob        string
+	requeueBounceJob        string
+
+	hasEventClosure               string
+	lastEventClosure              string
+	insertEventClosure            string
+	updateEventClosure            string
+	listPatchedMACsOfEvent        string
+	listPatchedMACsOfDefaultEvent string
+
+	recordCheckin  string
+	hasCheckin     string
+	hasAnyCheckin  string
+	insertAuditLog string
+	listAuditLog   string
+
+	insertVoucherBatch string
+	insertVoucher      string
+	getVoucher         string
+	claimVoucher       string
+	releaseVoucher     string
+	listVoucherBatches string
+	getVoucherBatch    string
+	listVouchers       string
+
+	findBlock     string
+	insertBlock   string
+	deleteBlock   string
+	getBlock      string
+	listBlocklist string
+
+	listWebhooks             string
+	getWebhook               string
+	insertWebhook            string
+	deleteWebhook            string
+	deleteWebhookDeliveries  string
+	insertWebhookDeliveries  string
+	listDueWebhookDeliveries string
+	claimWebhookDelivery     string
+	finishWebhookDelivery    string
+	listWebhookDeliveries    string
+	sweepWebhookDeliveries   string
+
+	insertOutboxEvent       string
+	listPendingOutboxEvents string
+	claimOutboxEvent        string
+	finishOutboxEvent       string
+	sweepOutboxEvents       string
+
+	releaseMigrationLock string
+
+	ensureRateLimitBucket string
+	lockRateLimitBucket   string
+	updateRateLimitBucket string
+	sweepRateLimitBuckets string
+}
+
+func dialectByName(name string) (*dialect, error) {
+	switch name {
+	case mysqlDialect.name:
+		return mysqlDialect, nil
+	case postgresDialect.name:
+		return postgresDialect, nil
+	}
+	return nil, fmt.Errorf("unknown database dialect %q", name)
+}
+
+// errDeviceNotFound is returned if a device has no lease or no accounting
+// session.
+var errDeviceNotFound = errors.New("device not found")
+
 type userProperties struct {
 	userIP   string
 	userMAC  string
 	switchIP string
 }
 
-// OpenDB creates a DB connection and performs all migrations.
-func OpenDB(ctx context.Context, mysqlUser, mysqlPassword, mysqlServer, mysqlPort, mysqlDatabase string) (db, error) {
-	mariadbURL := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?multiStatements=true&parseTime=true", mysqlUser, mysqlPassword, mysqlServer, mysqlPort, mysqlDatabase)
-	mardiadb, err := sql.Open("mysql", mariadbURL)
+// OpenDB creates a DB handle for the dialect, mysql or postgres, without
+// connecting, see ConnectDB for waiting until the server is reachable.
+// Migrations are applied separately, see MigrateUp.
+func OpenDB(dialectName, user, password, server, port, database string) (db, error) {
+	d, err := dialectByName(dialectName)
 	if err != nil {
-		return db{}, fmt.Errorf("failed to open connection to DB: %w", err)
+		return db{}, err
 	}
-
-	migrations := migrate.FileMigrationSource{Dir: "migrations"}
-	_, err = migrate.Exec(mardiadb, "mysql", migrations, migrate.Up)
+	sqlDB, err := sql.Open(d.driver, d.dsn(user, password, server, port, database))
 	if err != nil {
-		return db{}, fmt.Errorf("failed to apply migrations: %w", err)
+		return db{}, fmt.Errorf("failed to open connection to DB: %w", err)
 	}
 
-	return db{mardiadb}, nil
+	return db{DB: sqlDB, dialect: d}, nil
 }
 
-const qGetUserProperties = `
-SELECT INET_NTOA(l.address) AS user_ip, u.username AS user_mac, u.nasipaddress AS switch_ip
-FROM (radacct u join lease4 l ON((u.username = lower(hex(l.hwaddr)))))
-WHERE (u.acctstoptime IS NULL) AND INET_NTOA(l.address)=?
-GROUP BY user_mac, switch_ip, user_ip;`
+func (s *Server) locateUser(ctx context.Context, userIP string) (up *userProperties, err error) {
+	timer := prometheus.NewTimer(metricDBQueryDuration.WithLabelValues(queryLocateUser))
+	defer timer.ObserveDuration()
+	ctx, span := s.DB.startSpan(ctx, "db.locateUser", s.DB.dialect.q.getUserProperties)
+	defer func() { endSpan(span, err) }()
 
-func (s *Server) locateUser(ctx context.Context, userIP string) (*userProperties, error) {
-	up := new(userProperties)
-	err := s.DB.QueryRowContext(ctx, qGetUserProperties, userIP).Scan(&up.userIP, &up.userMAC, &up.switchIP)
+	up = new(userProperties)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getUserProperties, userIP).Scan(&up.userIP, &up.userMAC, &up.switchIP)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			s.Log.Error().Err(err).Str("user ip", userIP).Msg("failed to locate user")
-			return nil, errors.New("user not found")
+			metricDBLookupMisses.WithLabelValues(queryLocateUser).Inc()
+			return nil, errDeviceNotFound
 		}
-		s.Log.Error().Err(err).
+		withTrace(ctx, s.Log).Error().Err(err).
 			Str("user IP", userIP).
 			Msg("Failed to fetch user properties")
 		return nil, fmt.Errorf("failed to get user properties: %w", err)
@@ -60,26 +169,56 @@ func (s *Server) locateUser(ctx context.Context, userIP string) (*userProperties
 	return up, nil
 }
 
-const qInsertBounceJob = `INSERT INTO bouncer_jobs(clientMAC, targetVLAN) VALUES(?, ?);`
+// createNewBounceJob creates a job for the bouncer to move clientMAC into
+// targetVLAN. It is reported as bounce.created, together with events, in the
+// transaction of the job. If audit is set, it is written in the transaction
+// too, so the job is not created without its audit entry.
+func (s *Server) createNewBounceJob(ctx context.Context, eventID sql.NullInt64, clientMAC string, targetVLAN int, audit *auditEntry, events ...outboxEvent) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.createNewBounceJob", s.DB.dialect.q.insertBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	events = append([]outboxEvent{{webhookBounceCreated, webhookBounce{MAC: clientMAC, TargetVLAN: targetVLAN}}}, events...)
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-func (s *Server) createNewBounceJob(ctx context.Context, clientMAC string, targetVLAN int) error {
-	_, err := s.DB.ExecContext(ctx, qInsertBounceJob, clientMAC, targetVLAN)
+	_, err = tx.ExecContext(ctx, s.DB.dialect.q.insertBounceJob, clientMAC, targetVLAN, eventID)
 	if err != nil {
-		s.Log.Error().Err(err).
+		withTrace(ctx, s.Log).Error().Err(err).
 			Str("clientMac", clientMAC).
 			Int("targetVlan", targetVLAN).
 			Msg("Failed to insert bounce job into database.")
 		return err
 	}
+	if audit != nil {
+		if err = s.writeAuditEntry(ctx, tx, *audit); err != nil {
+			return err
+		}
+	}
+	if err = s.queueEvents(ctx, tx, time.Now(), events...); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit bounce job: %w", err)
+	}
 	return nil
 }
 
-const qInsertLoginLog = `INSERT INTO login_logs(username, mac) VALUES(?, ?);`
+// Actions recorded in the login logs.
+const (
+	loginLogPatch      = "patch"
+	loginLogDisconnect = "disconnect"
+)
+
+func (s *Server) createNewLoginLog(ctx context.Context, eventID sql.NullInt64, action, username string, clientMAC string) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.createNewLoginLog", s.DB.dialect.q.insertLoginLog)
+	defer func() { endSpan(span, err) }()
 
-func (s *Server) createNewLoginLog(ctx context.Context, username string, clientMAC string) error {
-	_, err := s.DB.ExecContext(ctx, qInsertLoginLog, username, clientMAC)
+	_, err = s.DB.ExecContext(ctx, s.DB.dialect.q.insertLoginLog, username, clientMAC, eventID, action)
 	if err != nil {
-		s.Log.Error().Err(err).
+		withTrace(ctx, s.Log).Error().Err(err).
 			Str("username", username).
 			Str("clientMac", clientMAC).
 			Msg("Failed to insert login log into database.")
@@ -88,26 +227,150 @@ func (s *Server) createNewLoginLog(ctx context.Context, username string, clientM
 	return nil
 }
 
-const qGetSwitchVLAN = `
-SELECT primary_vlan AS vlan
-FROM bouncer_switch_ip AS ip
-JOIN bouncer_switch_map AS map ON ip.switch_id = map.id
-WHERE ip=?;`
+func (s *Server) getSwitchVLAN(ctx context.Context, switchIP string) (vlan int, err error) {
+	timer := prometheus.NewTimer(metricDBQueryDuration.WithLabelValues(queryGetSwitchVLAN))
+	defer timer.ObserveDuration()
+	ctx, span := s.DB.startSpan(ctx, "db.getSwitchVLAN", s.DB.dialect.q.getSwitchVLAN)
+	defer func() { endSpan(span, err) }()
 
-func (s *Server) getSwitchVLAN(ctx context.Context, switchIP string) (int, error) {
-	var vlan int
-	err := s.DB.QueryRowContext(ctx, qGetSwitchVLAN, switchIP).Scan(&vlan)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getSwitchVLAN, switchIP).Scan(&vlan)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			s.Log.Error().Err(err).
+			metricDBLookupMisses.WithLabelValues(queryGetSwitchVLAN).Inc()
+			withTrace(ctx, s.Log).Error().Err(err).
 				Str("switch ip", switchIP).
 				Msg("failed to get vlan")
 			return -1, errors.New("vlan not found")
 		}
-		s.Log.Error().Err(err).
+		withTrace(ctx, s.Log).Error().Err(err).
 			Str("switch IP", switchIP).
 			Msg("Failed to getch switch VLAN")
 		return -1, fmt.Errorf("failed to get switch vlan: %w", err)
 	}
 	return vlan, nil
 }
+
+func (s *Server) locateMAC(ctx context.Context, userMAC string) (up *userProperties, err error) {
+	timer := prometheus.NewTimer(metricDBQueryDuration.WithLabelValues(queryLocateMAC))
+	defer timer.ObserveDuration()
+	ctx, span := s.DB.startSpan(ctx, "db.locateMAC", s.DB.dialect.q.getUserPropertiesByMAC)
+	defer func() { endSpan(span, err) }()
+
+	up = new(userProperties)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getUserPropertiesByMAC, userMAC).Scan(&up.userIP, &up.userMAC, &up.switchIP)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			metricDBLookupMisses.WithLabelValues(queryLocateMAC).Inc()
+			return nil, errDeviceNotFound
+		}
+		return nil, fmt.Errorf("failed to get user properties: %w", err)
+	}
+	return up, nil
+}
+
+// getLastMACOfUser returns the MAC of the device username was last patched
+// with.
+func (s *Server) getLastMACOfUser(ctx context.Context, username string) (mac string, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.getLastMACOfUser", s.DB.dialect.q.getLastMACOfUser)
+	defer func() { endSpan(span, err) }()
+
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getLastMACOfUser, username).Scan(&mac)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: no device known for user %s", errDeviceNotFound, username)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get last MAC of user: %w", err)
+	}
+	return mac, nil
+}
+
+// loginLog is an entry of the login logs.
+type loginLog struct {
+	mac    string
+	action string
+	at     time.Time
+}
+
+// getLastLoginOfUser returns the last login log of username, or nil if there
+// is none.
+func (s *Server) getLastLoginOfUser(ctx context.Context, username string) (l *loginLog, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.getLastLoginOfUser", s.DB.dialect.q.getLastLoginOfUser)
+	defer func() { endSpan(span, err) }()
+
+	l = new(loginLog)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getLastLoginOfUser, username).Scan(&l.mac, &l.action, &l.at)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last login of user: %w", err)
+	}
+	return l, nil
+}
+
+// switchInfo is a switch of the bouncer.
+type switchInfo struct {
+	vlan     int
+	hostname string
+	location string
+	ips      []string
+}
+
+// listSwitches returns the switches of the bouncer by VLAN.
+func (s *Server) listSwitches(ctx context.Context) (switches []*switchInfo, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listSwitches", s.DB.dialect.q.listSwitches)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listSwitches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list switches: %w", err)
+	}
+	defer rows.Close()
+	var last *switchInfo
+	for rows.Next() {
+		var vlan int
+		var hostname string
+		var location, ip sql.NullString
+		if err := rows.Scan(&vlan, &hostname, &location, &ip); err != nil {
+			return nil, fmt.Errorf("failed to read switch: %w", err)
+		}
+		// The rows of a switch are adjacent, one per IP.
+		if last == nil || last.vlan != vlan {
+			last = &switchInfo{vlan: vlan, hostname: hostname, location: location.String, ips: []string{}}
+			switches = append(switches, last)
+		}
+		if ip.Valid {
+			last.ips = append(last.ips, ip.String)
+		}
+	}
+	return switches, rows.Err()
+}
+
+// recordCheckin remembers that GeCo confirmed the check-in of username for
+// ev, so staff can patch the user's devices later on.
+func (s *Server) recordCheckin(ctx context.Context, ev *event, username, sub string) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.recordCheckin", s.DB.dialect.q.recordCheckin)
+	defer func() { endSpan(span, err) }()
+
+	if _, err = s.DB.ExecContext(ctx, s.DB.dialect.q.recordCheckin, username, ev.ID, sub); err != nil {
+		return fmt.Errorf("failed to record check-in: %w", err)
+	}
+	return nil
+}
+
+// hasCheckin reports whether GeCo ever confirmed the check-in of username for
+// ev, or for any event if ev is nil.
+func (s *Server) hasCheckin(ctx context.Context, username string, ev *event) (ok bool, err error) {
+	query, args := s.DB.dialect.q.hasAnyCheckin, []any{username}
+	if ev != nil {
+		query, args = s.DB.dialect.q.hasCheckin, []any{username, ev.ID}
+	}
+	ctx, span := s.DB.startSpan(ctx, "db.hasCheckin", query)
+	defer func() { endSpan(span, err) }()
+
+	var n int
+	if err = s.DB.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to get check-in: %w", err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	gms "github.com/dolthub/go-mysql-server/server"
+	"github.com/dolthub/go-mysql-server/sql"
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/sirupsen/logrus"
+)
+
+const testDBName = "freeradius"
+
+// newTestDB starts an in-memory MySQL compatible server and returns a handle
+// to it. The fixtures of test-migrations, the tables of FreeRADIUS, Kea and
+// the bouncer, are loaded and the schema is migrated. The bouncer tables
+// exist before as in production, since migrations extend them.
+func newTestDB(t *testing.T) db {
+	t.Helper()
+	logrus.SetOutput(io.Discard)
+	pro := memory.NewDBProvider(memory.NewDatabase(testDBName))
+	engine := sqle.NewDefault(pro)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv, err := gms.NewServer(gms.Config{Protocol: "tcp", Listener: l}, engine, sql.NewContext, memory.NewSessionBuilder(pro), nil)
+	if err != nil {
+		t.Fatalf("failed to create MySQL server: %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(func() { srv.Close() })
+
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	d, err := OpenDB(mysqlDialect.name, "root", "", "127.0.0.1", port, testDBName)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	fixtures := migrate.MigrationSet{TableName: "test_migrations"}
+	source := migrate.FileMigrationSource{Dir: "../test-migrations/mysql"}
+	if _, err := fixtures.Exec(d.DB, "mysql", source, migrate.Up); err != nil {
+		t.Fatalf("failed to load fixtures: %v", err)
+	}
+	if _, err := MigrateUp(t.Context(), d, os.DirFS("../migrations"), migrateTestLockTimeout); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
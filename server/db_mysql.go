@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// mysqlDialect is for MySQL and MariaDB, with the FreeRADIUS and Kea schemas
+// of MySQL.
+var mysqlDialect = &dialect{
+	name:   "mysql",
+	driver: "mysql",
+	system: semconv.DBSystemMySQL,
+	dsn: func(user, password, server, port, database string) string {
+		return fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?multiStatements=true&parseTime=true", user, password, server, port, database)
+	},
+	getMigrationLock: func(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (bool, error) {
+		var locked sql.NullInt64
+		err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?);`, name, int(timeout.Seconds())).Scan(&locked)
+		return locked.Valid && locked.Int64 == 1, err
+	},
+	q: queries{
+		getUserProperties: `
+SELECT INET_NTOA(l.address) AS user_ip, u.username AS user_mac, u.nasipaddress AS switch_ip
+FROM (radacct u join lease4 l ON((u.username = lower(hex(l.hwaddr)))))
+WHERE (u.acctstoptime IS NULL) AND INET_NTOA(l.address)=?
+GROUP BY user_mac, switch_ip, user_ip;`,
+		getUserPropertiesByMAC: `
+SELECT INET_NTOA(l.address) AS user_ip, u.username AS user_mac, u.nasipaddress AS switch_ip
+FROM (radacct u join lease4 l ON((u.username = lower(hex(l.hwaddr)))))
+WHERE (u.acctstoptime IS NULL) AND u.username=?
+GROUP BY user_mac, switch_ip, user_ip;`,
+		getLastMACOfUser: `SELECT mac FROM login_logs WHERE username=? ORDER BY id DESC LIMIT 1;`,
+		insertBounceJob:  `INSERT INTO bouncer_jobs(clientMAC, targetVLAN, event_id) VALUES(?, ?, ?);`,
+		insertLoginLog:   `INSERT INTO login_logs(username, mac, event_id, action) VALUES(?, ?, ?, ?);`,
+		getSwitchVLAN: `
+SELECT primary_vlan AS vlan
+FROM bouncer_switch_ip AS ip
+JOIN bouncer_switch_map AS map ON ip.switch_id = map.id
+WHERE ip=?;`,
+		getBouncerBacklog: `SELECT COUNT(*), COALESCE(TIMESTAMPDIFF(SECOND, MIN(last_update), NOW()), 0) FROM bouncer_jobs WHERE failed_at IS NULL;`,
+		listEvents:        `SELECT id, name, lan_id, userstatus_endpoint, hostname, networks, title, logo, starts_at, ends_at FROM events ORDER BY id;`,
+
+		getBounceJobOfMAC:   `SELECT targetVLAN, retires, last_update, lease_owner, failed_at FROM bouncer_jobs WHERE clientMAC=? ORDER BY id DESC LIMIT 1;`,
+		hasAcctSessionSince: `SELECT COUNT(*) FROM radacct WHERE username=? AND acctstoptime IS NULL AND acctstarttime >= ?;`,
+		getLastLoginOfUser:  `SELECT mac, action, created_at FROM login_logs WHERE username=? ORDER BY id DESC LIMIT 1;`,
+		listSwitches: `
+SELECT map.primary_vlan, map.hostname, map.location, ip.ip
+FROM bouncer_switch_map AS map
+LEFT JOIN bouncer_switch_ip AS ip ON ip.switch_id = map.id
+ORDER BY map.primary_vlan, ip.ip;`,
+
+		listClaimableBounceJobs: `
+SELECT id FROM bouncer_jobs
+WHERE failed_at IS NULL AND (lease_until IS NULL OR lease_until < ?)
+ORDER BY id LIMIT ?;`,
+		// The lease is assigned last, MySQL evaluates the assignments in order.
+		claimBounceJob: `
+UPDATE bouncer_jobs
+SET retires = retires + CASE WHEN lease_owner IS NULL THEN 0 ELSE 1 END,
+    last_error = CASE WHEN lease_owner IS NULL THEN last_error ELSE ? END,
+    lease_owner=?, lease_until=?
+WHERE id=? AND failed_at IS NULL AND (lease_until IS NULL OR lease_until < ?);`,
+		getQueuedBounceJob:   `SELECT id, clientMAC, targetVLAN, retires, lease_owner, lease_until, last_error, failed_at FROM bouncer_jobs WHERE id=?;`,
+		extendBounceJobLease: `UPDATE bouncer_jobs SET lease_until=? WHERE id=? AND lease_owner=? AND lease_until >= ?;`,
+		deleteBounceJob:      `DELETE FROM bouncer_jobs WHERE id=? AND lease_owner=?;`,
+		releaseBounceJob: `
+UPDATE bouncer_jobs SET retires=?, last_error=?, lease_owner=NULL, lease_until=?, failed_at=?
+WHERE id=? AND lease_owner=? AND retires=?;`,
+		requeueBounceJob: `UPDATE bouncer_jobs SET retires=0, lease_owner=NULL, lease_until=NULL, failed_at=NULL WHERE id=? AND failed_at IS NOT NULL;`,
+
+		hasEventClosure:               `SELECT COUNT(*) FROM event_closures WHERE event_id=? AND ends_at=?;`,
+		lastEventClosure:              `SELECT MAX(ends_at) FROM event_closures WHERE event_id=? AND ends_at < ?;`,
+		insertEventClosure:            `INSERT INTO event_closures(event_id, ends_at, closed_at, devices) VALUES(?, ?, ?, 0);`,
+		updateEventClosure:            `UPDATE event_closures SET devices=? WHERE event_id=? AND ends_at=?;`,
+		listPatchedMACsOfEvent:        `SELECT l.mac FROM login_logs l WHERE l.event_id=? AND l.created_at >= ? AND l.action='patch' AND NOT EXISTS (SELECT 1 FROM login_logs n WHERE n.mac=l.mac AND n.event_id=l.event_id AND n.id > l.id);`,
+		listPatchedMACsOfDefaultEvent: `SELECT l.mac FROM login_logs l WHERE l.event_id IS NULL AND l.created_at >= ? AND l.action='patch' AND NOT EXISTS (SELECT 1 FROM login_logs n WHERE n.mac=l.mac AND n.event_id IS NULL AND n.id > l.id);`,
+
+		recordCheckin: `
+INSERT INTO geco_checkins(username, event_id, sub) VALUES(?, ?, ?)
+ON DUPLICATE KEY UPDATE sub = VALUES(sub), checked_at = CURRENT_TIMESTAMP;`,
+		hasCheckin:     `SELECT COUNT(*) FROM geco_checkins WHERE username=? AND event_id=?;`,
+		hasAnyCheckin:  `SELECT COUNT(*) FROM geco_checkins WHERE username=?;`,
+		insertAuditLog: `INSERT INTO audit_log(actor, action, target, detail, reason) VALUES(?, ?, ?, ?, ?);`,
+		listAuditLog:   `SELECT created_at, actor, action, target, detail, reason FROM audit_log ORDER BY id DESC LIMIT ?;`,
+
+		insertVoucherBatch: `INSERT INTO voucher_batches(id, created_by, label, max_uses, valid_until, vlan) VALUES(?, ?, ?, ?, ?, ?);`,
+		insertVoucher:      `INSERT INTO vouchers(code, batch_id) VALUES(?, ?);`,
+		getVoucher: `
+SELECT b.max_uses, b.valid_until, b.vlan, v.uses
+FROM vouchers v JOIN voucher_batches b ON v.batch_id = b.id
+WHERE v.code=?;`,
+		claimVoucher:   `UPDATE vouchers SET uses = uses + 1, first_used_at = COALESCE(first_used_at, ?) WHERE code=? AND uses=?;`,
+		releaseVoucher: `UPDATE vouchers SET uses = uses - 1 WHERE code=? AND uses > 0;`,
+		listVoucherBatches: `
+SELECT b.id, b.created_at, b.created_by, b.label, b.max_uses, b.valid_until, b.vlan,
+    COUNT(v.code), COALESCE(SUM(CASE WHEN v.uses > 0 THEN 1 ELSE 0 END), 0)
+FROM voucher_batches b LEFT JOIN vouchers v ON v.batch_id = b.id
+GROUP BY b.id, b.created_at, b.created_by, b.label, b.max_uses, b.valid_until, b.vlan
+ORDER BY b.created_at DESC LIMIT ?;`,
+		getVoucherBatch: `SELECT id, created_at, created_by, label, max_uses, valid_until, vlan FROM voucher_batches WHERE id=?;`,
+		listVouchers:    `SELECT code, uses FROM vouchers WHERE batch_id=? ORDER BY code;`,
+
+		findBlock: `
+SELECT id, kind, value, action, reason, author, created_at, expires_at
+FROM blocklist
+WHERE ((kind = 'sub' AND value = ?) OR (kind = 'username' AND value = ?) OR (kind = 'mac' AND value = ?))
+    AND (expires_at IS NULL OR expires_at > ?)
+ORDER BY CASE action WHEN 'block' THEN 0 ELSE 1 END, id DESC LIMIT 1;`,
+		insertBlock:   `INSERT INTO blocklist(kind, value, action, reason, author, expires_at) VALUES(?, ?, ?, ?, ?, ?);`,
+		deleteBlock:   `DELETE FROM blocklist WHERE id=?;`,
+		getBlock:      `SELECT id, kind, value, action, reason, author, created_at, expires_at FROM blocklist WHERE id=?;`,
+		listBlocklist: `SELECT id, kind, value, action, reason, author, created_at, expires_at FROM blocklist ORDER BY id DESC LIMIT ?;`,
+
+		listWebhooks:            `SELECT id, url, secret, events, created_by, created_at FROM webhooks ORDER BY id;`,
+		getWebhook:              `SELECT id, url, secret, events, created_by, created_at FROM webhooks WHERE id=?;`,
+		insertWebhook:           `INSERT INTO webhooks(url, secret, events, created_by) VALUES(?, ?, ?, ?);`,
+		deleteWebhook:           `DELETE FROM webhooks WHERE id=?;`,
+		deleteWebhookDeliveries: `DELETE FROM webhook_deliveries WHERE webhook_id=?;`,
+		insertWebhookDeliveries: `INSERT INTO webhook_deliveries(webhook_id, event_type, payload, status, next_attempt_at) SELECT id, ?, ?, 'pending', ? FROM webhooks WHERE CONCAT(',', events, ',') LIKE CONCAT('%,', ?, ',%');`,
+		listDueWebhookDeliveries: `
+SELECT d.id, d.event_type, d.payload, d.attempts, w.url, w.secret
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+ORDER BY d.id LIMIT ?;`,
+		claimWebhookDelivery:  `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at=? WHERE id=? AND status = 'pending' AND attempts=?;`,
+		finishWebhookDelivery: `UPDATE webhook_deliveries SET status=?, last_status=?, last_error=?, delivered_at=? WHERE id=?;`,
+		listWebhookDeliveries: `
+SELECT d.id, w.url, d.event_type, d.status, d.attempts, d.last_status, d.last_error, d.created_at, d.delivered_at
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+ORDER BY d.id DESC LIMIT ?;`,
+		sweepWebhookDeliveries: `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < ?;`,
+
+		insertOutboxEvent:       `INSERT INTO event_outbox(event_type, payload, next_attempt_at) VALUES(?, ?, ?);`,
+		listPendingOutboxEvents: `SELECT id, event_type, payload, attempts, next_attempt_at FROM event_outbox WHERE published_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT ?;`,
+		claimOutboxEvent:        `UPDATE event_outbox SET attempts = attempts + 1, next_attempt_at=? WHERE id=? AND published_at IS NULL AND failed_at IS NULL AND attempts=?;`,
+		finishOutboxEvent:       `UPDATE event_outbox SET published_at=?, failed_at=?, last_error=? WHERE id=?;`,
+		sweepOutboxEvents:       `DELETE FROM event_outbox WHERE published_at < ? OR failed_at < ? OR created_at < ?;`,
+
+		releaseMigrationLock: `SELECT RELEASE_LOCK(?);`,
+
+		ensureRateLimitBucket: `
+INSERT INTO rate_limit_buckets(bucket_key, tokens, updated_at) VALUES(?, ?, ?)
+ON DUPLICATE KEY UPDATE bucket_key = bucket_key;`,
+		lockRateLimitBucket:   `SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key=? FOR UPDATE;`,
+		updateRateLimitBucket: `UPDATE rate_limit_buckets SET tokens=?, updated_at=? WHERE bucket_key=?;`,
+		sweepRateLimitBuckets: `DELETE FROM rate_limit_buckets WHERE updated_at < ?;`,
+	},
+}
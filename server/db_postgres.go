@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/url"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// postgresLockPollInterval is how often the migration lock is tried, as
+// PostgreSQL has no advisory lock with a timeout.
+const postgresLockPollInterval = 500 * time.Millisecond
+
+// postgresDialect is for PostgreSQL, with the FreeRADIUS and Kea schemas of
+// PostgreSQL: radacct.nasipaddress is an inet, lease4.address a bigint and
+// lease4.hwaddr a bytea.
+var postgresDialect = &dialect{
+	name:   "postgres",
+	driver: "pgx",
+	system: semconv.DBSystemPostgreSQL,
+	dsn: func(user, password, server, port, database string) string {
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(user, password),
+			Host:   net.JoinHostPort(server, port),
+			Path:   "/" + database,
+		}
+		return u.String()
+	},
+	getMigrationLock: func(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (bool, error) {
+		deadline := time.Now().Add(timeout)
+		for {
+			var locked bool
+			if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1));`, name).Scan(&locked); err != nil {
+				return false, err
+			}
+			if locked || time.Now().After(deadline) {
+				return locked, nil
+			}
+			select {
+			case <-time.After(postgresLockPollInterval):
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+	},
+	q: queries{
+		getUserProperties: `
+SELECT host('0.0.0.0'::inet + l.address) AS user_ip, u.username AS user_mac, host(u.nasipaddress) AS switch_ip
+FROM radacct u JOIN lease4 l ON u.username = encode(l.hwaddr, 'hex')
+WHERE u.acctstoptime IS NULL AND l.address = $1::inet - '0.0.0.0'::inet
+GROUP BY user_mac, switch_ip, user_ip;`,
+		getUserPropertiesByMAC: `
+SELECT host('0.0.0.0'::inet + l.address) AS user_ip, u.username AS user_mac, host(u.nasipaddress) AS switch_ip
+FROM radacct u JOIN lease4 l ON u.username = encode(l.hwaddr, 'hex')
+WHERE u.acctstoptime IS NULL AND u.username = $1
+GROUP BY user_mac, switch_ip, user_ip;`,
+		getLastMACOfUser: `SELECT mac FROM login_logs WHERE username=$1 ORDER BY id DESC LIMIT 1;`,
+		insertBounceJob:  `INSERT INTO bouncer_jobs(clientMAC, targetVLAN, event_id) VALUES($1, $2, $3);`,
+		insertLoginLog:   `INSERT INTO login_logs(username, mac, event_id, action) VALUES($1, $2, $3, $4);`,
+		getSwitchVLAN: `
+SELECT primary_vlan AS vlan
+FROM bouncer_switch_ip AS ip
+JOIN bouncer_switch_map AS map ON ip.switch_id = map.id
+WHERE ip=$1;`,
+		getBouncerBacklog: `SELECT COUNT(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(last_update))::BIGINT, 0) FROM bouncer_jobs WHERE failed_at IS NULL;`,
+		listEvents:        `SELECT id, name, lan_id, userstatus_endpoint, hostname, networks, title, logo, starts_at, ends_at FROM events ORDER BY id;`,
+
+		getBounceJobOfMAC:   `SELECT targetVLAN, retires, last_update, lease_owner, failed_at FROM bouncer_jobs WHERE clientMAC=$1 ORDER BY id DESC LIMIT 1;`,
+		hasAcctSessionSince: `SELECT COUNT(*) FROM radacct WHERE username=$1 AND acctstoptime IS NULL AND acctstarttime >= $2;`,
+		getLastLoginOfUser:  `SELECT mac, action, created_at FROM login_logs WHERE username=$1 ORDER BY id DESC LIMIT 1;`,
+		listSwitches: `
+SELECT map.primary_vlan, map.hostname, map.location, ip.ip
+FROM bouncer_switch_map AS map
+LEFT JOIN bouncer_switch_ip AS ip ON ip.switch_id = map.id
+ORDER BY map.primary_vlan, ip.ip;`,
+
+		listClaimableBounceJobs: `
+SELECT id FROM bouncer_jobs
+WHERE failed_at IS NULL AND (lease_until IS NULL OR lease_until < $1)
+ORDER BY id LIMIT $2;`,
+		claimBounceJob: `
+UPDATE bouncer_jobs
+SET retires = retires + CASE WHEN lease_owner IS NULL THEN 0 ELSE 1 END,
+    last_error = CASE WHEN lease_owner IS NULL THEN last_error ELSE $1 END,
+    lease_owner=$2, lease_until=$3
+WHERE id=$4 AND failed_at IS NULL AND (lease_until IS NULL OR lease_until < $5);`,
+		getQueuedBounceJob:   `SELECT id, clientMAC, targetVLAN, retires, lease_owner, lease_until, last_error, failed_at FROM bouncer_jobs WHERE id=$1;`,
+		extendBounceJobLease: `UPDATE bouncer_jobs SET lease_until=$1 WHERE id=$2 AND lease_owner=$3 AND lease_until >= $4;`,
+		deleteBounceJob:      `DELETE FROM bouncer_jobs WHERE id=$1 AND lease_owner=$2;`,
+		releaseBounceJob: `
+UPDATE bouncer_jobs SET retires=$1, last_error=$2, lease_owner=NULL, lease_until=$3, failed_at=$4
+WHERE id=$5 AND lease_owner=$6 AND retires=$7;`,
+		requeueBounceJob: `UPDATE bouncer_jobs SET retires=0, lease_owner=NULL, lease_until=NULL, failed_at=NULL WHERE id=$1 AND failed_at IS NOT NULL;`,
+
+		hasEventClosure:               `SELECT COUNT(*) FROM event_closures WHERE event_id=$1 AND ends_at=$2;`,
+		lastEventClosure:              `SELECT MAX(ends_at) FROM event_closures WHERE event_id=$1 AND ends_at < $2;`,
+		insertEventClosure:            `INSERT INTO event_closures(event_id, ends_at, closed_at, devices) VALUES($1, $2, $3, 0);`,
+		updateEventClosure:            `UPDATE event_closures SET devices=$1 WHERE event_id=$2 AND ends_at=$3;`,
+		listPatchedMACsOfEvent:        `SELECT l.mac FROM login_logs l WHERE l.event_id=$1 AND l.created_at >= $2 AND l.action='patch' AND NOT EXISTS (SELECT 1 FROM login_logs n WHERE n.mac=l.mac AND n.event_id=l.event_id AND n.id > l.id);`,
+		listPatchedMACsOfDefaultEvent: `SELECT l.mac FROM login_logs l WHERE l.event_id IS NULL AND l.created_at >= $1 AND l.action='patch' AND NOT EXISTS (SELECT 1 FROM login_logs n WHERE n.mac=l.mac AND n.event_id IS NULL AND n.id > l.id);`,
+
+		recordCheckin: `
+INSERT INTO geco_checkins(username, event_id, sub) VALUES($1, $2, $3)
+ON CONFLICT (username, event_id) DO UPDATE SET sub = EXCLUDED.sub, checked_at = CURRENT_TIMESTAMP;`,
+		hasCheckin:     `SELECT COUNT(*) FROM geco_checkins WHERE username=$1 AND event_id=$2;`,
+		hasAnyCheckin:  `SELECT COUNT(*) FROM geco_checkins WHERE username=$1;`,
+		insertAuditLog: `INSERT INTO audit_log(actor, action, target, detail, reason) VALUES($1, $2, $3, $4, $5);`,
+		listAuditLog:   `SELECT created_at, actor, action, target, detail, reason FROM audit_log ORDER BY id DESC LIMIT $1;`,
+
+		insertVoucherBatch: `INSERT INTO voucher_batches(id, created_by, label, max_uses, valid_until, vlan) VALUES($1, $2, $3, $4, $5, $6);`,
+		insertVoucher:      `INSERT INTO vouchers(code, batch_id) VALUES($1, $2);`,
+		getVoucher: `
+SELECT b.max_uses, b.valid_until, b.vlan, v.uses
+FROM vouchers v JOIN voucher_batches b ON v.batch_id = b.id
+WHERE v.code=$1;`,
+		claimVoucher:   `UPDATE vouchers SET uses = uses + 1, first_used_at = COALESCE(first_used_at, $1) WHERE code=$2 AND uses=$3;`,
+		releaseVoucher: `UPDATE vouchers SET uses = uses - 1 WHERE code=$1 AND uses > 0;`,
+		listVoucherBatches: `
+SELECT b.id, b.created_at, b.created_by, b.label, b.max_uses, b.valid_until, b.vlan,
+    COUNT(v.code), COALESCE(SUM(CASE WHEN v.uses > 0 THEN 1 ELSE 0 END), 0)
+FROM voucher_batches b LEFT JOIN vouchers v ON v.batch_id = b.id
+GROUP BY b.id, b.created_at, b.created_by, b.label, b.max_uses, b.valid_until, b.vlan
+ORDER BY b.created_at DESC LIMIT $1;`,
+		getVoucherBatch: `SELECT id, created_at, created_by, label, max_uses, valid_until, vlan FROM voucher_batches WHERE id=$1;`,
+		listVouchers:    `SELECT code, uses FROM vouchers WHERE batch_id=$1 ORDER BY code;`,
+
+		findBlock: `
+SELECT id, kind, value, action, reason, author, created_at, expires_at
+FROM blocklist
+WHERE ((kind = 'sub' AND value = $1) OR (kind = 'username' AND value = $2) OR (kind = 'mac' AND value = $3))
+    AND (expires_at IS NULL OR expires_at > $4)
+ORDER BY CASE action WHEN 'block' THEN 0 ELSE 1 END, id DESC LIMIT 1;`,
+		insertBlock:   `INSERT INTO blocklist(kind, value, action, reason, author, expires_at) VALUES($1, $2, $3, $4, $5, $6);`,
+		deleteBlock:   `DELETE FROM blocklist WHERE id=$1;`,
+		getBlock:      `SELECT id, kind, value, action, reason, author, created_at, expires_at FROM blocklist WHERE id=$1;`,
+		listBlocklist: `SELECT id, kind, value, action, reason, author, created_at, expires_at FROM blocklist ORDER BY id DESC LIMIT $1;`,
+
+		listWebhooks:            `SELECT id, url, secret, events, created_by, created_at FROM webhooks ORDER BY id;`,
+		getWebhook:              `SELECT id, url, secret, events, created_by, created_at FROM webhooks WHERE id=$1;`,
+		insertWebhook:           `INSERT INTO webhooks(url, secret, events, created_by) VALUES($1, $2, $3, $4);`,
+		deleteWebhook:           `DELETE FROM webhooks WHERE id=$1;`,
+		deleteWebhookDeliveries: `DELETE FROM webhook_deliveries WHERE webhook_id=$1;`,
+		insertWebhookDeliveries: `INSERT INTO webhook_deliveries(webhook_id, event_type, payload, status, next_attempt_at) SELECT id, $1, $2, 'pending', $3 FROM webhooks WHERE ',' || events || ',' LIKE '%,' || $4 || ',%';`,
+		listDueWebhookDeliveries: `
+SELECT d.id, d.event_type, d.payload, d.attempts, w.url, w.secret
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+WHERE d.status = 'pending' AND d.next_attempt_at <= $1
+ORDER BY d.id LIMIT $2;`,
+		claimWebhookDelivery:  `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at=$1 WHERE id=$2 AND status = 'pending' AND attempts=$3;`,
+		finishWebhookDelivery: `UPDATE webhook_deliveries SET status=$1, last_status=$2, last_error=$3, delivered_at=$4 WHERE id=$5;`,
+		listWebhookDeliveries: `
+SELECT d.id, w.url, d.event_type, d.status, d.attempts, d.last_status, d.last_error, d.created_at, d.delivered_at
+FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+ORDER BY d.id DESC LIMIT $1;`,
+		sweepWebhookDeliveries: `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1;`,
+
+		insertOutboxEvent:       `INSERT INTO event_outbox(event_type, payload, next_attempt_at) VALUES($1, $2, $3);`,
+		listPendingOutboxEvents: `SELECT id, event_type, payload, attempts, next_attempt_at FROM event_outbox WHERE published_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT $1;`,
+		claimOutboxEvent:        `UPDATE event_outbox SET attempts = attempts + 1, next_attempt_at=$1 WHERE id=$2 AND published_at IS NULL AND failed_at IS NULL AND attempts=$3;`,
+		finishOutboxEvent:       `UPDATE event_outbox SET published_at=$1, failed_at=$2, last_error=$3 WHERE id=$4;`,
+		sweepOutboxEvents:       `DELETE FROM event_outbox WHERE published_at < $1 OR failed_at < $2 OR created_at < $3;`,
+
+		releaseMigrationLock: `SELECT pg_advisory_unlock(hashtext($1));`,
+
+		ensureRateLimitBucket: `
+INSERT INTO rate_limit_buckets(bucket_key, tokens, updated_at) VALUES($1, $2, $3)
+ON CONFLICT (bucket_key) DO NOTHING;`,
+		lockRateLimitBucket:   `SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key=$1 FOR UPDATE;`,
+		updateRateLimitBucket: `UPDATE rate_limit_buckets SET tokens=$1, updated_at=$2 WHERE bucket_key=$3;`,
+		sweepRateLimitBuckets: `DELETE FROM rate_limit_buckets WHERE updated_at < $1;`,
+	},
+}
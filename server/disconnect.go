@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// disconnectHandler moves the device of the logged in user back into the
+// captive VLAN and ends the session, so shared or borrowed devices can be
+// released. The session ends even if the device cannot be moved, e.g. because
+// another device got its IP, so users can always log out.
+func disconnectHandler(s *Server) gin.HandlerFunc {
+	logout := LogoutHandler(s.OIDCProvider)
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+		username, ok := session.Get(sessionUserName).(string)
+		if !ok {
+			logout(ctx)
+			return
+		}
+
+		boundMAC, _ := session.Get(sessionDeviceMAC).(string)
+		s.disconnectDevice(ctx.Request.Context(), currentEvent(ctx), clientIP(ctx), boundMAC, username)
+		logout(ctx)
+	}
+}
+
+// disconnectDevice creates a bounce job moving the device of username at
+// userIP back into the captive VLAN and records it in the login logs. The
+// device must be boundMAC, the one the user logged in from, so another device
+// which got the IP is not bounced. Failures are only logged, as the session
+// ends anyway. It does nothing if no captive VLAN is configured.
+func (s *Server) disconnectDevice(ctx context.Context, ev *event, userIP, boundMAC, username string) {
+	log := withTrace(ctx, s.Log).With().Str("username", username).Str("user IP", userIP).Logger()
+	if s.EventConfig.CaptiveVLAN == 0 {
+		log.Info().Msg("No captive VLAN configured, the device stays in its VLAN.")
+		return
+	}
+
+	up, err := s.locateUser(ctx, userIP)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to find source switch, the device stays in its VLAN")
+		return
+	}
+	if up.userMAC != boundMAC {
+		err := fmt.Errorf("%w: MAC %s, logged in from %q", errDeviceChanged, up.userMAC, boundMAC)
+		log.Warn().Err(err).Msg("refused to disconnect another device")
+		return
+	}
+
+	vlan := s.EventConfig.CaptiveVLAN
+	if err := s.createNewBounceJob(ctx, ev.dbID(), up.userMAC, vlan, nil); err != nil {
+		log.Error().Err(err).Str("user MAC", up.userMAC).Msg("failed to create a bounce job to the captive VLAN")
+		return
+	}
+	metricBounceJobsCreated.WithLabelValues(up.switchIP, strconv.Itoa(vlan)).Inc()
+
+	if err := s.createNewLoginLog(ctx, ev.dbID(), loginLogDisconnect, username, up.userMAC); err != nil {
+		log.Error().Err(err).Str("user MAC", up.userMAC).Msg("failed to log disconnect")
+		// ignore error as its only logging
+	}
+
+	log.Info().Str("user MAC", up.userMAC).Msg("Device disconnected.")
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDisconnect(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	_, page = b.get(t, "/")
+	resp, page := b.post(t, "/logout", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("POST /logout ended on %s with %s:\n%s", resp.Request.URL, resp.Status, page)
+	}
+
+	want := []bounceJob{{mac: fixtureMAC, vlan: fixtureVLAN}, {mac: fixtureMAC, vlan: testCaptiveVLAN}}
+	if got := bounceJobs(t, env.S.DB); len(got) != 2 || got[1] != want[1] {
+		t.Errorf("bounce jobs = %v, want %v", got, want)
+	}
+	var action string
+	err := env.S.DB.QueryRowContext(t.Context(), `SELECT action FROM login_logs WHERE username = ? ORDER BY id DESC LIMIT 1;`, env.IdP.User.Username).Scan(&action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != loginLogDisconnect {
+		t.Errorf("last login log action = %q, want %q", action, loginLogDisconnect)
+	}
+
+	// The session has ended.
+	resp, _ = b.get(t, "/patch")
+	if resp.Request.URL.Path != "/" {
+		t.Errorf("GET /patch after disconnect ended on %s, want /", resp.Request.URL.Path)
+	}
+}
+
+func TestDisconnectUnknownDevice(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	b.login(t)
+	_, page := b.get(t, "/")
+
+	// The fixtures only know the device with IP 127.0.0.1.
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, env.URL+"/logout",
+		strings.NewReader(url.Values{csrfFormField: {csrfTokenFrom(t, page)}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Errorf("POST /logout ended on %s with %s, want /", resp.Request.URL, resp.Status)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+	// The session has ended anyway.
+	if resp, _ := b.get(t, "/patch"); resp.Request.URL.Path != "/" {
+		t.Errorf("GET /patch after logout ended on %s, want /", resp.Request.URL.Path)
+	}
+}
+
+func TestDisconnectOtherDevice(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	// Another device got the IP of the patched one.
+	for _, query := range []string{
+		`UPDATE lease4 SET hwaddr = 'abcdeg';`,
+		`UPDATE radacct SET username = '` + otherMAC + `';`,
+	} {
+		if _, err := env.S.DB.ExecContext(t.Context(), query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, page = b.get(t, "/")
+	if resp, page := b.post(t, "/logout", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Errorf("POST /logout ended on %s with %s, want /:\n%s", resp.Request.URL, resp.Status, page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 {
+		t.Errorf("bounce jobs = %v, want only the one of the patch", got)
+	}
+	if resp, _ := b.get(t, "/patch"); resp.Request.URL.Path != "/" {
+		t.Errorf("GET /patch after logout ended on %s, want /", resp.Request.URL.Path)
+	}
+}
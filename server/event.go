@@ -0,0 +1,272 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ctxEventKey holds the event of a request in the gin context.
+	ctxEventKey = "event"
+
+	defaultEventTitle = "PolyLAN"
+	defaultEventLogo  = "/static/images/polylan.png"
+)
+
+// EventConfig configures the time window of the default event and the
+// teardown of ended events.
+type EventConfig struct {
+	// Start and End of the default event, open ended if zero.
+	Start time.Time
+	End   time.Time
+	// CaptiveVLAN is the VLAN devices are bounced back into at the end of
+	// their event. The teardown is disabled if 0.
+	CaptiveVLAN      int
+	TeardownInterval time.Duration
+	// CacheTTL is how long the events table is cached, 0 disables the cache.
+	CacheTTL time.Duration
+}
+
+// eventCache holds the events table for EventConfig.CacheTTL, as every
+// request selects its event.
+type eventCache struct {
+	mu       sync.Mutex
+	events   []*event
+	loadedAt time.Time
+}
+
+// event is a LAN party served by the portal. Several events may run at the
+// same time, each selected by the hostname of the portal or the network of
+// the client. The default event is configured by GecoAPIConfig.
+type event struct {
+	// ID is 0 for the default event.
+	ID   int64
+	Name string
+	// LanID and UserstatusEndpointFmt select the GeCo LAN party.
+	LanID                 string
+	UserstatusEndpointFmt string
+
+	Hostname string
+	Networks []*net.IPNet
+
+	// Title and Logo brand the pages.
+	Title string
+	Logo  string
+
+	StartsAt sql.NullTime
+	EndsAt   sql.NullTime
+}
+
+// dbID is the event_id of the login logs and bounce jobs, NULL for the
+// default event.
+func (e *event) dbID() sql.NullInt64 {
+	return sql.NullInt64{Int64: e.ID, Valid: e.ID != 0}
+}
+
+// activeAt reports whether t is within the time window of the event. The
+// window is open ended if the start or end is not set.
+func (e *event) activeAt(t time.Time) bool {
+	return (!e.StartsAt.Valid || !t.Before(e.StartsAt.Time)) && (!e.EndsAt.Valid || t.Before(e.EndsAt.Time))
+}
+
+// closedMessage tells the user why devices cannot be patched at t, or returns
+// "" during the event.
+func (e *event) closedMessage(t time.Time) string {
+	switch {
+	case e.StartsAt.Valid && t.Before(e.StartsAt.Time):
+		return fmt.Sprintf("%s has not started yet, it starts on %s.", e.Title, e.StartsAt.Time.Local().Format("02.01. 15:04"))
+	case e.EndsAt.Valid && !t.Before(e.EndsAt.Time):
+		return fmt.Sprintf("%s is over, see you next time!", e.Title)
+	}
+	return ""
+}
+
+// matches rates how specific the event matches a client of host and ip: 3 if
+// both the hostname and the network match, 2 for the hostname, 1 for the
+// network and 0 for events without either, which match all clients. It is
+// negative if the event does not match.
+func (e *event) matches(host string, ip net.IP) int {
+	if e.Hostname == "" && len(e.Networks) == 0 {
+		return 0
+	}
+	score := 0
+	if e.Hostname != "" && strings.EqualFold(e.Hostname, host) {
+		score += 2
+	}
+	if ip != nil && slices.ContainsFunc(e.Networks, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		score++
+	}
+	if score == 0 {
+		return -1
+	}
+	return score
+}
+
+// defaultEvent is the event configured by GecoAPIConfig.
+func (s *Server) defaultEvent() *event {
+	e := &event{
+		Name:  defaultEventTitle,
+		Title: defaultEventTitle,
+		Logo:  defaultEventLogo,
+	}
+	if s.GecoAPIConfig != nil {
+		e.LanID = s.GecoAPIConfig.LanID
+		e.UserstatusEndpointFmt = s.GecoAPIConfig.UserstatusEndpointFmt
+	}
+	if s.EventConfig != nil {
+		e.StartsAt = sql.NullTime{Time: s.EventConfig.Start, Valid: !s.EventConfig.Start.IsZero()}
+		e.EndsAt = sql.NullTime{Time: s.EventConfig.End, Valid: !s.EventConfig.End.IsZero()}
+	}
+	return e
+}
+
+// listEvents returns the events of the events table, cached for
+// EventConfig.CacheTTL. The events must not be modified.
+func (s *Server) listEvents(ctx context.Context) ([]*event, error) {
+	if s.EventConfig == nil || s.EventConfig.CacheTTL <= 0 {
+		return s.loadEvents(ctx)
+	}
+	c := &s.events
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loadedAt.IsZero() && time.Since(c.loadedAt) < s.EventConfig.CacheTTL {
+		return c.events, nil
+	}
+	events, err := s.loadEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Appending to the cached events must not write to them.
+	c.events, c.loadedAt = slices.Clip(events), time.Now()
+	return c.events, nil
+}
+
+// InvalidateEvents drops the cached events, so changes to the events table
+// apply to the next request.
+func (s *Server) InvalidateEvents() {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	s.events.events, s.events.loadedAt = nil, time.Time{}
+}
+
+// loadEvents reads the events table.
+func (s *Server) loadEvents(ctx context.Context) (events []*event, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listEvents", s.DB.dialect.q.listEvents)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listEvents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %w", err)
+	}
+	defer rows.Close()
+	def := s.defaultEvent()
+	for rows.Next() {
+		e := &event{}
+		var endpoint, hostname, networks, title, logo sql.NullString
+		err := rows.Scan(&e.ID, &e.Name, &e.LanID, &endpoint, &hostname, &networks, &title, &logo, &e.StartsAt, &e.EndsAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event: %w", err)
+		}
+		e.UserstatusEndpointFmt = cmp.Or(endpoint.String, def.UserstatusEndpointFmt)
+		e.Hostname = hostname.String
+		e.Title = cmp.Or(title.String, e.Name)
+		e.Logo = cmp.Or(logo.String, defaultEventLogo)
+		for _, cidr := range strings.Split(networks.String, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network of event %d: %w", e.ID, err)
+			}
+			e.Networks = append(e.Networks, n)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// eventFor selects the event of a client connecting to host from ip. Of the
+// matching events, one whose time window is open is preferred over upcoming
+// ones and those over past ones, then the more specific match wins. If no
+// event matches, the default event is used.
+func (s *Server) eventFor(ctx context.Context, host, ip string) (*event, error) {
+	events, err := s.listEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// phase orders events by their time window relative to now.
+	phase := func(e *event) int {
+		switch {
+		case e.activeAt(now):
+			return 0
+		case e.StartsAt.Valid && now.Before(e.StartsAt.Time):
+			return 1
+		default:
+			return 2
+		}
+	}
+	clientIP := net.ParseIP(ip)
+	var best *event
+	bestScore := -1
+	for _, e := range events {
+		score := e.matches(host, clientIP)
+		if score < 0 {
+			continue
+		}
+		if best == nil || phase(e) < phase(best) || (phase(e) == phase(best) && score > bestScore) {
+			best, bestScore = e, score
+		}
+	}
+	if best == nil {
+		return s.defaultEvent(), nil
+	}
+	return best, nil
+}
+
+// eventMiddleware selects the event of the request for the handlers, see
+// currentEvent.
+func (s *Server) eventMiddleware(ctx *gin.Context) {
+	host, _, err := net.SplitHostPort(ctx.Request.Host)
+	if err != nil {
+		host = ctx.Request.Host
+	}
+	ev, err := s.eventFor(ctx.Request.Context(), host, clientIP(ctx))
+	if err != nil {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to select event")
+		ctx.Set(ctxEventKey, s.defaultEvent())
+		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+		ctx.Abort()
+		return
+	}
+	ctx.Set(ctxEventKey, ev)
+	ctx.Next()
+}
+
+// currentEvent returns the event selected by eventMiddleware.
+func currentEvent(ctx *gin.Context) *event {
+	if ev, ok := ctx.Get(ctxEventKey); ok {
+		return ev.(*event)
+	}
+	return nil
+}
+
+// renderHTML renders the page with the branding of the current event.
+func renderHTML(ctx *gin.Context, code int, page string, pageContent gin.H) {
+	if ev := currentEvent(ctx); ev != nil {
+		pageContent["event"] = ev
+	}
+	ctx.HTML(code, page, pageContent)
+}
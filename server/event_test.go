@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertEvent adds an event with the window from start to end relative to
+// now, or open ended if zero.
+func insertEvent(t *testing.T, d db, name, hostname, networks string, start, end time.Duration) int64 {
+	t.Helper()
+	now := time.Now()
+	var startsAt, endsAt any
+	if start != 0 {
+		startsAt = now.Add(start)
+	}
+	if end != 0 {
+		endsAt = now.Add(end)
+	}
+	null := func(s string) any {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	_, err := d.ExecContext(t.Context(), `
+INSERT INTO events(name, lan_id, hostname, networks, title, starts_at, ends_at)
+VALUES(?, '7', ?, ?, ?, ?, ?);`, name, null(hostname), null(networks), name, startsAt, endsAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := d.QueryRowContext(t.Context(), `SELECT id FROM events WHERE name = ?;`, name).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEventFor(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.S.DB
+	insertEvent(t, d, "side", "side.lan", "", -time.Hour, time.Hour)
+	insertEvent(t, d, "side-net", "", "10.50.0.0/16", -time.Hour, time.Hour)
+	insertEvent(t, d, "side-both", "side.lan", "10.60.0.0/16", -time.Hour, time.Hour)
+	insertEvent(t, d, "past", "", "10.70.0.0/16", -2*time.Hour, -time.Hour)
+	insertEvent(t, d, "upcoming", "", "10.70.0.0/16", time.Hour, 2*time.Hour)
+
+	tests := []struct {
+		host, ip string
+		want     string
+	}{
+		{host: "side.lan", ip: "10.0.0.1", want: "side"},
+		{host: "SIDE.lan", ip: "10.0.0.1", want: "side"},
+		{host: "login.lan", ip: "10.50.1.2", want: "side-net"},
+		{host: "side.lan", ip: "10.60.1.2", want: "side-both"},
+		{host: "login.lan", ip: "10.70.1.2", want: "upcoming"},
+		{host: "login.lan", ip: "10.0.0.1", want: defaultEventTitle},
+	}
+	for _, tt := range tests {
+		ev, err := env.S.eventFor(t.Context(), tt.host, tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Name != tt.want {
+			t.Errorf("eventFor(%q, %q) = %q, want %q", tt.host, tt.ip, ev.Name, tt.want)
+		}
+	}
+}
+
+func TestEventCache(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.EventConfig.CacheTTL = time.Hour
+	eventOf := func() string {
+		t.Helper()
+		ev, err := env.S.eventFor(t.Context(), "side.lan", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev.Name
+	}
+
+	if got := eventOf(); got != defaultEventTitle {
+		t.Fatalf("event = %q, want %q", got, defaultEventTitle)
+	}
+	insertEvent(t, env.S.DB, "side", "side.lan", "", -time.Hour, time.Hour)
+	if got := eventOf(); got != defaultEventTitle {
+		t.Errorf("event = %q, want the cached %q", got, defaultEventTitle)
+	}
+	env.S.InvalidateEvents()
+	if got := eventOf(); got != "side" {
+		t.Errorf("event after the invalidation = %q, want side", got)
+	}
+
+}
+
+func TestPatchTaggedWithEvent(t *testing.T) {
+	env := newTestEnv(t)
+	id := insertEvent(t, env.S.DB, "SideLAN", "", "127.0.0.0/8", 0, 0)
+	b := env.newBrowser(t)
+
+	if _, page := b.get(t, "/"); !strings.Contains(page, "Welcome to SideLAN!") {
+		t.Errorf("index page is not branded for the event:\n%s", page)
+	}
+	page := b.login(t)
+	b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+
+	if got, _ := env.Geco.LanID.Load().(string); got != "7" {
+		t.Errorf("GeCo was asked for LAN %q, want 7", got)
+	}
+	for _, table := range []string{"bouncer_jobs", "login_logs"} {
+		var got int64
+		if err := env.S.DB.QueryRowContext(t.Context(), `SELECT event_id FROM `+table+`;`).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != id {
+			t.Errorf("%s tagged with event %d, want %d", table, got, id)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fixture values of test-migrations/mysql/99_test.up.sql
+const (
+	fixtureMAC  = "616263646566"
+	fixtureVLAN = 527
+)
+
+type bounceJob struct {
+	mac  string
+	vlan int
+}
+
+func bounceJobs(t *testing.T, d db) []bounceJob {
+	t.Helper()
+	rows, err := d.QueryContext(t.Context(), `SELECT clientMAC, targetVLAN FROM bouncer_jobs ORDER BY id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var jobs []bounceJob
+	for rows.Next() {
+		var j bounceJob
+		if err := rows.Scan(&j.mac, &j.vlan); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func loginLogs(t *testing.T, d db) map[string]string {
+	t.Helper()
+	rows, err := d.QueryContext(t.Context(), `SELECT username, mac FROM login_logs;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	logs := map[string]string{}
+	for rows.Next() {
+		var username, mac string
+		if err := rows.Scan(&username, &mac); err != nil {
+			t.Fatal(err)
+		}
+		logs[username] = mac
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return logs
+}
+
+func TestLoginAndPatch(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+
+	page := b.login(t)
+	if !strings.Contains(page, env.IdP.User.Username) {
+		t.Errorf("patch page does not greet %q:\n%s", env.IdP.User.Username, page)
+	}
+
+	resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	want := []bounceJob{{mac: fixtureMAC, vlan: fixtureVLAN}}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("bounce jobs = %v, want %v", got, want)
+	}
+	if got := loginLogs(t, env.S.DB)[env.IdP.User.Username]; got != fixtureMAC {
+		t.Errorf("login log of %q has MAC %q, want %q", env.IdP.User.Username, got, fixtureMAC)
+	}
+}
+
+func TestPatchRequiresCheckin(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		msg    string
+	}{
+		{name: "not checked in", status: http.StatusUnprocessableEntity, msg: "check-in first"},
+		{name: "unauthorized", status: http.StatusUnauthorized, msg: "Failed to check user status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.Geco.Status.Store(int32(tt.status))
+			b := env.newBrowser(t)
+
+			page := b.login(t)
+			resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("POST /patch: %s, want %d", resp.Status, http.StatusForbidden)
+			}
+			if !strings.Contains(page, tt.msg) {
+				t.Errorf("page does not contain %q:\n%s", tt.msg, page)
+			}
+			if env.Geco.Requests.Load() != 1 {
+				t.Errorf("GeCo got %d requests, want 1", env.Geco.Requests.Load())
+			}
+			if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+				t.Errorf("bounce jobs = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestPatchUnknownDevice(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+
+	// The fixtures only know the device with IP 127.0.0.1.
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, env.URL+"/patch",
+		strings.NewReader(url.Values{csrfFormField: {csrfTokenFrom(t, page)}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST /patch: %s, want %d", resp.Status, http.StatusInternalServerError)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestPatchDeviceChanged(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+
+	// The lease of the IP moves to another device after the login started.
+	for _, stmt := range []string{
+		`UPDATE lease4 SET hwaddr = 'ghijkl';`,
+		`INSERT INTO radacct(username, nasipaddress, acctstoptime) VALUES ('6768696a6b6c', '10.233.254.27', NULL);`,
+	} {
+		if _, err := env.S.DB.ExecContext(t.Context(), stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(page, "log in again") {
+		t.Errorf("POST /patch: %s, want %d:\n%s", resp.Status, http.StatusConflict, page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestPatchRequiresCSRFToken(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	b.login(t)
+
+	resp, _ := b.post(t, "/patch", url.Values{csrfFormField: {"forged"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /patch: %s, want %d", resp.Status, http.StatusForbidden)
+	}
+	if env.Geco.Requests.Load() != 0 {
+		t.Errorf("GeCo got %d requests, want 0", env.Geco.Requests.Load())
+	}
+}
+
+func TestCallbackRejectsInvalidState(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+
+	// Only start the login, the state is kept in the session.
+	noRedirect := *b.client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noRedirect.Get(env.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, _ = b.get(t, "/callback?state=forged&code=forged")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /callback: %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+	resp, _ = b.get(t, "/patch")
+	if resp.Request.URL.Path != "/" {
+		t.Errorf("GET /patch without login ended on %s, want /", resp.Request.URL.Path)
+	}
+}
+
+func TestMaintenanceUntilReady(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.dbReady.Store(false)
+	b := env.newBrowser(t)
+
+	for _, path := range []string{"/", "/login", "/readiness"} {
+		resp, _ := b.get(t, path)
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("GET %s: %s, want %d", path, resp.Status, http.StatusServiceUnavailable)
+		}
+	}
+	if resp, _ := b.get(t, "/liveness"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /liveness: %s, want %d", resp.Status, http.StatusOK)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockGeco serves the GeCo user status ("me") endpoint. Requests without an
+// access token issued by the mock OIDC provider get 401, all others Status.
+type mockGeco struct {
+	*httptest.Server
+	// Status is returned for authorised requests, e.g. 200 if the user is
+	// checked in or 422 if not.
+	Status atomic.Int32
+	// Requests counts the user status requests.
+	Requests atomic.Int32
+	// LanID is the LAN party ID of the last request.
+	LanID atomic.Value
+	// Delay holds the answers back, e.g. to keep a request in flight.
+	Delay atomic.Int64
+}
+
+func newMockGeco(t *testing.T, idp *mockOIDC) *mockGeco {
+	t.Helper()
+	g := &mockGeco{}
+	g.Status.Store(http.StatusOK)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/lan_parties/{id}/me", func(w http.ResponseWriter, r *http.Request) {
+		g.Requests.Add(1)
+		g.LanID.Store(r.PathValue("id"))
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, valid := idp.validAccessToken(token); !ok || !valid {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		time.Sleep(time.Duration(g.Delay.Load()))
+		status := int(g.Status.Load())
+		writeJSON(w, status, map[string]any{"lan_party_id": r.PathValue("id"), "status": http.StatusText(status)})
+	})
+	g.Server = httptest.NewServer(mux)
+	t.Cleanup(g.Close)
+	return g
+}
+
+// userstatusEndpointFmt is the endpoint format for GecoAPIConfig.
+func (g *mockGeco) userstatusEndpointFmt() string {
+	return g.URL + "/api/v1/lan_parties/%s/me"
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+const (
+	migrateTestLockTimeout = 5 * time.Second
+	testCaptiveVLAN        = 999
+	testQuarantineVLAN     = 666
+	testAPIClient          = "helpdesk"
+	testAPIToken           = "0123456789abcdef"
+	testAPIReadToken       = "readonly01234567"
+	testMaxRetries         = 2
+)
+
+// testEnv is the portal wired to the mock OIDC provider, the mock GeCo API
+// and an in-memory DB.
+type testEnv struct {
+	*httptest.Server
+	S    *Server
+	IdP  *mockOIDC
+	Geco *mockGeco
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	log := zerolog.New(zerolog.NewTestWriter(t))
+	idp := newMockOIDC(t)
+	geco := newMockGeco(t, idp)
+
+	// The redirect URL must be known before the portal is started.
+	portal := httptest.NewUnstartedServer(nil)
+	t.Cleanup(portal.Close)
+	redirectURL := "http://" + portal.Listener.Addr().String() + "/callback"
+
+	s := &Server{
+		Log:          log,
+		DB:           newTestDB(t),
+		OIDCProvider: NewOIDCProvider(log, idp.URL, redirectURL, idp.ClientID, idp.ClientSecret),
+		GecoAPIConfig: &GecoAPIConfig{
+			LanID:                 "1",
+			UserstatusEndpointFmt: geco.userstatusEndpointFmt(),
+		},
+		// The tests claim client IPs by X-Forwarded-For.
+		HTTPConfig: &HTTPConfig{SessionMaxAge: time.Hour, TrustedProxies: []string{"127.0.0.1"}},
+		RateLimitConfig: &RateLimitConfig{
+			PerIP:      RateBudget{Tokens: 100, Per: time.Minute},
+			PerSession: RateBudget{Tokens: 100, Per: time.Minute},
+		},
+		SecurityHeadersConfig: &SecurityHeadersConfig{},
+		ReadinessConfig: &ReadinessConfig{
+			CheckTimeout: time.Second,
+		},
+		EventConfig: &EventConfig{
+			CaptiveVLAN:      testCaptiveVLAN,
+			TeardownInterval: time.Minute,
+		},
+		BlocklistConfig: &BlocklistConfig{
+			QuarantineVLAN: testQuarantineVLAN,
+		},
+		APIConfig: &APIConfig{
+			Tokens: map[string]APIToken{
+				testAPIClient: {Secret: testAPIToken, Scopes: []string{apiScopeRead, apiScopePatch, apiScopeBouncer}},
+				"overlay":     {Secret: testAPIReadToken, Scopes: []string{apiScopeRead}},
+			},
+		},
+		ProgressConfig: &ProgressConfig{
+			PollInterval: 10 * time.Millisecond,
+			Timeout:      time.Minute,
+		},
+		BouncerQueueConfig: &BouncerQueueConfig{
+			Lease:      time.Minute,
+			MaxRetries: testMaxRetries,
+		},
+		// Deliveries are sent by the tests calling deliverWebhooks.
+		WebhookConfig: &WebhookConfig{
+			Interval:     time.Hour,
+			Timeout:      time.Second,
+			MaxAttempts:  testMaxRetries,
+			RetryBackoff: time.Minute,
+		},
+		// Events are published by the tests setting a publisher and calling
+		// publishEvents.
+		PublisherConfig: &PublisherConfig{
+			Interval:     time.Hour,
+			Timeout:      time.Second,
+			RetryBackoff: time.Minute,
+			MaxAttempts:  testMaxRetries,
+		},
+		AdminConfig: &AdminConfig{
+			Usernames: []string{idp.User.Username},
+		},
+		StartupBackoff: Backoff{Initial: 10 * time.Millisecond, Max: 100 * time.Millisecond},
+		SessionSecret:  "0123456789abcdef0123456789abcdef",
+		Assets:         os.DirFS(".."),
+	}
+	if err := s.OIDCProvider.Discover(t.Context(), s.StartupBackoff); err != nil {
+		t.Fatal(err)
+	}
+	s.dbReady.Store(true)
+
+	r, err := s.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal.Config.Handler = r
+	portal.Start()
+
+	return &testEnv{Server: portal, S: s, IdP: idp, Geco: geco}
+}
+
+// testBrowser follows redirects and keeps the cookies like a browser.
+type testBrowser struct {
+	client *http.Client
+	base   string
+}
+
+func (e *testEnv) newBrowser(t *testing.T) *testBrowser {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBrowser{client: &http.Client{Jar: jar}, base: e.URL}
+}
+
+// get requests path of the portal and returns the final response and body.
+func (b *testBrowser) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+	return b.do(t, http.MethodGet, path, nil)
+}
+
+// post submits form to path of the portal.
+func (b *testBrowser) post(t *testing.T, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	return b.do(t, http.MethodPost, path, form)
+}
+
+func (b *testBrowser) do(t *testing.T, method, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(t.Context(), method, b.base+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(content)
+}
+
+var csrfTokenPattern = regexp.MustCompile(`name="` + csrfFormField + `" value="([^"]+)"`)
+
+// csrfTokenFrom extracts the CSRF token from a rendered form.
+func csrfTokenFrom(t *testing.T, page string) string {
+	t.Helper()
+	m := csrfTokenPattern.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("no CSRF token in page:\n%s", page)
+	}
+	return m[1]
+}
+
+// login runs /login and /callback against the mock OIDC provider and
+// returns the patch page it ends on.
+func (b *testBrowser) login(t *testing.T) string {
+	t.Helper()
+	resp, page := b.get(t, "/login")
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/patch" {
+		t.Fatalf("login ended on %s with %s:\n%s", resp.Request.URL, resp.Status, page)
+	}
+	return page
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadinessConfig holds the thresholds of the readiness checks.
+type ReadinessConfig struct {
+	// CheckTimeout bounds every single check.
+	CheckTimeout time.Duration
+	// CacheTTL is how long results are reused, so frequent probes of several
+	// replicas do not hammer the GeCo API.
+	CacheTTL time.Duration
+	// MaxBouncerBacklog is the number of queued bounce jobs above which the
+	// bouncer check fails. Zero disables the check.
+	MaxBouncerBacklog int
+	// MaxBouncerJobAge is the age of the oldest queued bounce job above which
+	// the bouncer check fails. Zero disables the check.
+	MaxBouncerJobAge time.Duration
+	// Strict fails the probe if the GeCo API or the bouncers are unhealthy.
+	// Otherwise they only degrade the report, as restarting or removing the
+	// instance does not help.
+	Strict bool
+}
+
+const (
+	checkStatusOK       = "ok"
+	checkStatusDegraded = "degraded"
+	checkStatusFail     = "fail"
+)
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// readinessChecker runs the readiness checks and caches the report.
+type readinessChecker struct {
+	s *Server
+
+	mu      sync.Mutex
+	report  readinessReport
+	checked time.Time
+	// running is closed once the checks in progress are done.
+	running chan struct{}
+}
+
+type readinessCheck struct {
+	run func(ctx context.Context) (detail string, err error)
+	// critical checks fail the probe, the others only degrade it unless
+	// ReadinessConfig.Strict is set.
+	critical bool
+}
+
+func (r *readinessChecker) checks() map[string]readinessCheck {
+	strict := r.s.ReadinessConfig.Strict
+	return map[string]readinessCheck{
+		"db":      {r.checkDB, true},
+		"oidc":    {r.checkOIDC, true},
+		"geco":    {r.checkGeco, strict},
+		"bouncer": {r.checkBouncerBacklog, strict},
+	}
+}
+
+// run returns the cached report, or waits for the checks if it is stale.
+// Concurrent probes share the checks, which are not canceled with the
+// request of a probe.
+func (r *readinessChecker) run(ctx context.Context) readinessReport {
+	r.mu.Lock()
+	if time.Since(r.checked) < r.s.ReadinessConfig.CacheTTL {
+		defer r.mu.Unlock()
+		return r.report
+	}
+	if r.running == nil {
+		r.running = make(chan struct{})
+		go r.check(context.WithoutCancel(ctx), r.running)
+	}
+	running := r.running
+	r.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return readinessReport{
+			Status: checkStatusFail,
+			Checks: map[string]checkResult{
+				"probe": {Status: checkStatusFail, Error: ctx.Err().Error()},
+			},
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report
+}
+
+// check runs all checks, each bounded by CheckTimeout, caches the report and
+// closes done.
+func (r *readinessChecker) check(ctx context.Context, done chan struct{}) {
+	checks := r.checks()
+	results := make(map[string]checkResult, len(checks))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, r.s.ReadinessConfig.CheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			detail, err := check.run(checkCtx)
+			res := checkResult{Status: checkStatusOK, Detail: detail, Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status = checkStatusDegraded
+				if check.critical {
+					res.Status = checkStatusFail
+				}
+				res.Error = err.Error()
+			}
+			resultsMu.Lock()
+			results[name] = res
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	report := readinessReport{Status: checkStatusOK, Checks: results}
+	for _, res := range results {
+		switch {
+		case res.Status == checkStatusFail:
+			report.Status = checkStatusFail
+		case res.Status == checkStatusDegraded && report.Status == checkStatusOK:
+			report.Status = checkStatusDegraded
+		}
+	}
+
+	r.mu.Lock()
+	r.report = report
+	r.checked = time.Now()
+	r.running = nil
+	r.mu.Unlock()
+	close(done)
+}
+
+func (r *readinessChecker) checkDB(ctx context.Context) (string, error) {
+	return "", r.s.DB.PingContext(ctx)
+}
+
+// checkOIDC fetches the discovery document and the JWKS of the issuer.
+func (r *readinessChecker) checkOIDC(ctx context.Context) (string, error) {
+	if !r.s.OIDCProvider.Ready() {
+		return "", errors.New("issuer not discovered yet")
+	}
+	discoveryURL := strings.TrimSuffix(r.s.OIDCProvider.issuer, "/") + "/.well-known/openid-configuration"
+	if err := probeURL(ctx, discoveryURL, true); err != nil {
+		return "", fmt.Errorf("discovery: %w", err)
+	}
+
+	var claims struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := r.s.OIDCProvider.provider().Claims(&claims); err != nil {
+		return "", fmt.Errorf("failed to parse discovery claims: %w", err)
+	}
+	if err := probeURL(ctx, claims.JWKSURL, true); err != nil {
+		return "", fmt.Errorf("jwks: %w", err)
+	}
+	return "", nil
+}
+
+// checkGeco requests the user status endpoints of the default event and the
+// events which are not over without a token. Any response but a server error
+// means the API is reachable.
+func (r *readinessChecker) checkGeco(ctx context.Context) (string, error) {
+	events, err := r.s.listEvents(ctx)
+	if err != nil {
+		return "", err
+	}
+	urls := []string{fmt.Sprintf(r.s.GecoAPIConfig.UserstatusEndpointFmt, r.s.GecoAPIConfig.LanID)}
+	now := time.Now()
+	for _, e := range events {
+		if e.EndsAt.Valid && !now.Before(e.EndsAt.Time) {
+			continue
+		}
+		if u := fmt.Sprintf(e.UserstatusEndpointFmt, e.LanID); !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+
+	var errs []error
+	for _, u := range urls {
+		if err := probeURL(ctx, u, false); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u, err))
+		}
+	}
+	return fmt.Sprintf("%d endpoints", len(urls)), errors.Join(errs...)
+}
+
+func (r *readinessChecker) checkBouncerBacklog(ctx context.Context) (detail string, err error) {
+	ctx, span := r.s.DB.startSpan(ctx, "db.getBouncerBacklog", r.s.DB.dialect.q.getBouncerBacklog)
+	defer func() { endSpan(span, err) }()
+
+	var queued int
+	var oldestSeconds int64
+	if err := r.s.DB.QueryRowContext(ctx, r.s.DB.dialect.q.getBouncerBacklog).Scan(&queued, &oldestSeconds); err != nil {
+		return "", fmt.Errorf("failed to get bouncer backlog: %w", err)
+	}
+	oldest := time.Duration(oldestSeconds) * time.Second
+	detail = fmt.Sprintf("%d jobs queued, oldest %v", queued, oldest)
+
+	cfg := r.s.ReadinessConfig
+	if cfg.MaxBouncerBacklog > 0 && queued > cfg.MaxBouncerBacklog {
+		return detail, fmt.Errorf("backlog of %d jobs exceeds %d", queued, cfg.MaxBouncerBacklog)
+	}
+	if cfg.MaxBouncerJobAge > 0 && oldest > cfg.MaxBouncerJobAge {
+		return detail, fmt.Errorf("oldest job is %v old, exceeds %v", oldest, cfg.MaxBouncerJobAge)
+	}
+	return detail, nil
+}
+
+// probeURL sends a GET request to url. If strict, the response must be
+// successful, otherwise only server errors count as failure.
+func probeURL(ctx context.Context, url string, strict bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 || (strict && resp.StatusCode >= 300) {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// livenessHandler only reflects the health of the process. Dependencies are
+// covered by the readiness probe, so an outage does not restart the pod.
+func livenessHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	}
+}
+
+// readinessHandler reports whether this instance should receive traffic,
+// with a JSON breakdown of the checks. It fails while shutting down.
+func readinessHandler(s *Server) gin.HandlerFunc {
+	checker := &readinessChecker{s: s}
+	return func(ctx *gin.Context) {
+		if s.shuttingDown.Load() {
+			ctx.JSON(http.StatusServiceUnavailable, readinessReport{
+				Status: checkStatusFail,
+				Checks: map[string]checkResult{
+					"shutdown": {Status: checkStatusFail, Error: "shutting down"},
+				},
+			})
+			return
+		}
+		if !s.dependenciesReady() {
+			ctx.JSON(http.StatusServiceUnavailable, readinessReport{
+				Status: checkStatusFail,
+				Checks: map[string]checkResult{
+					"startup": {Status: checkStatusFail, Error: "waiting for dependencies"},
+				},
+			})
+			return
+		}
+
+		report := checker.run(ctx.Request.Context())
+		code := http.StatusOK
+		if report.Status == checkStatusFail {
+			code = http.StatusServiceUnavailable
+		}
+		ctx.JSON(code, report)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readiness requests /readiness and returns the status code and report.
+func (e *testEnv) readiness(t *testing.T) (int, readinessReport) {
+	t.Helper()
+	resp, err := e.Client().Get(e.URL + "/readiness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report readinessReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, report
+}
+
+func TestReadiness(t *testing.T) {
+	env := newTestEnv(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	setEndpoint := func(id int64, endpoint string) {
+		t.Helper()
+		if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE events SET userstatus_endpoint = ? WHERE id = ?;`, endpoint, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := insertEvent(t, env.S.DB, "current", "", "", -time.Hour, time.Hour)
+	// Events which are over are not checked.
+	setEndpoint(insertEvent(t, env.S.DB, "past", "", "", -2*time.Hour, -time.Hour), down.URL+"/%s")
+
+	code, report := env.readiness(t)
+	if code != http.StatusOK || report.Status != checkStatusOK {
+		t.Fatalf("readiness = %d %+v, want %d %s", code, report, http.StatusOK, checkStatusOK)
+	}
+	if got := report.Checks["geco"].Detail; got != "2 endpoints" {
+		t.Errorf("geco detail = %q, want the endpoints of the default and the current event", got)
+	}
+
+	// The GeCo API of an event is down.
+	setEndpoint(current, down.URL+"/%s")
+	code, report = env.readiness(t)
+	geco := report.Checks["geco"]
+	if code != http.StatusOK || report.Status != checkStatusDegraded || geco.Status != checkStatusDegraded || !strings.Contains(geco.Error, down.URL) {
+		t.Errorf("readiness = %d %+v, want %d and GeCo degraded by %s", code, report, http.StatusOK, down.URL)
+	}
+	if db := report.Checks["db"]; db.Status != checkStatusOK {
+		t.Errorf("db check = %+v, want %s", db, checkStatusOK)
+	}
+
+	env.S.ReadinessConfig.Strict = true
+	if code, report = env.readiness(t); code != http.StatusServiceUnavailable || report.Status != checkStatusFail {
+		t.Errorf("strict readiness = %d %+v, want %d %s", code, report, http.StatusServiceUnavailable, checkStatusFail)
+	}
+}
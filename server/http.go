@@ -1,28 +1,153 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // Server is the server struct
 type Server struct {
-	Log           zerolog.Logger
-	DB            db
-	OIDCProvider  *OIDCProvider
-	GecoAPIConfig *GecoAPIConfig
-	SessionSecret string
+	Log                   zerolog.Logger
+	DB                    db
+	OIDCProvider          *OIDCProvider
+	GecoAPIConfig         *GecoAPIConfig
+	HTTPConfig            *HTTPConfig
+	RateLimitConfig       *RateLimitConfig
+	SecurityHeadersConfig *SecurityHeadersConfig
+	ReadinessConfig       *ReadinessConfig
+	EventConfig           *EventConfig
+	BlocklistConfig       *BlocklistConfig
+	APIConfig             *APIConfig
+	ProgressConfig        *ProgressConfig
+	BouncerQueueConfig    *BouncerQueueConfig
+	WebhookConfig         *WebhookConfig
+	PublisherConfig       *PublisherConfig
+	AdminConfig           *AdminConfig
+	// Publisher publishes the events of the outbox on the message bus. It is
+	// nil if none is configured.
+	Publisher EventPublisher
+	// StartupBackoff is used to retry the dependencies at startup.
+	StartupBackoff Backoff
+	SessionSecret  string
+	// Assets holds the templates and static directories.
+	Assets fs.FS
+
+	// shuttingDown makes the readiness probe fail while draining.
+	shuttingDown atomic.Bool
+	// dbReady is set by ConnectDB once the DB is usable.
+	dbReady atomic.Bool
+	// events caches the events table, see listEvents.
+	events eventCache
+	// gecoClient calls the GeCo API, see gecoHTTPClient.
+	gecoClient     *http.Client
+	gecoClientOnce sync.Once
+}
+
+// HTTPConfig holds the limits and shutdown behaviour of the HTTP servers.
+type HTTPConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// ShutdownDelay is how long the readiness probe fails before the listener
+	// is closed, so the load balancer stops sending new requests.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are drained.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable native TLS on the main listener.
+	// The files are polled every TLSReloadInterval and reloaded on change.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	// TrustedHTTPSProxy states that a proxy in front terminates HTTPS.
+	TrustedHTTPSProxy bool
+	// TrustedProxies are the IPs or CIDRs of the proxies whose
+	// X-Forwarded-For header is honoured, see clientIP.
+	TrustedProxies []string
+
+	// SessionMaxAge is how long the session cookie lasts at most.
+	SessionMaxAge time.Duration
+}
+
+func (c *HTTPConfig) tlsEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// secureCookies reports whether clients reach us via HTTPS only.
+func (c *HTTPConfig) secureCookies() bool {
+	return c.tlsEnabled() || c.TrustedHTTPSProxy
+}
+
+func (c *HTTPConfig) newServer(listen string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              listen,
+		Handler:           h,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// serve runs srv until ctx is cancelled and then drains in-flight requests
+// within the configured shutdown timeout.
+func (s *Server) serve(ctx context.Context, srv *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.HTTPConfig.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
-// ListenAndServe sets up the HTTP server and starts listening
-func (s *Server) ListenAndServe(listen string) error {
+// router sets up the routes of the portal and the probes.
+func (s *Server) router() (*gin.Engine, error) {
 	r := gin.Default()
+	r.RemoteIPHeaders = []string{"X-Forwarded-For"}
+	if err := r.SetTrustedProxies(s.HTTPConfig.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	r.Use(otelgin.Middleware(ServiceName))
+	r.Use(metricsMiddleware)
+	r.Use(s.securityHeadersMiddleware)
 
 	// To store custom types in our cookies,
 	// we must first register them using gob.Register
@@ -30,60 +155,135 @@ func (s *Server) ListenAndServe(listen string) error {
 
 	store := cookie.NewStore([]byte(s.SessionSecret))
 	store.Options(sessions.Options{
-		MaxAge:   int(4 * 24 * time.Hour.Seconds()), // 4 days for the entire LAN duration
-		Secure:   false,                             // localhost
+		MaxAge:   int(s.HTTPConfig.SessionMaxAge.Seconds()),
+		Secure:   s.HTTPConfig.secureCookies(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
 	r.Use(sessions.Sessions("auth-session", store))
 
-	r.Static("/static", "static")
-	r.LoadHTMLGlob("templates/*.gohtml")
+	static, err := fs.Sub(s.Assets, "static")
+	if err != nil {
+		return nil, err
+	}
+	r.StaticFS("/static", &gin.OnlyFilesFS{FileSystem: http.FS(static)})
+	templates, err := template.ParseFS(s.Assets, "templates/*.gohtml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	r.SetHTMLTemplate(templates)
 
-	r.GET("/", indexHandler())
+	// The portal is in maintenance until the DB and the OIDC issuer are ready.
+	// Every request is served for the event of its hostname or network, and
+	// sessions end with the event.
+	portal := r.Group("/", s.maintenanceMiddleware, s.eventMiddleware, s.sessionExpiryMiddleware)
+	portal.GET("/", indexHandler())
 
-	r.GET("/login", LoginHandler(s.OIDCProvider))
-	r.GET("/callback", CallbackHandler(s.OIDCProvider, "/patch"))
-	r.GET("/patch", IsAuthenticatedMiddleware, patchHandler(s))
-	r.GET("/logout", LogoutHandler(s.OIDCProvider))
+	limits := s.newRateLimitStore()
 
-	r.GET("/switch", IsAuthenticatedMiddleware, switchVLANHandler(s))
-	r.POST("/switch", IsAuthenticatedMiddleware, switchVLANSubmitHandler(s))
-	r.GET("/switch/success", IsAuthenticatedMiddleware, switchVLANSuccessHandler(s))
+	portal.GET("/login", s.rateLimitMiddleware(limits, "login"), s.bindDeviceMiddleware, LoginHandler(s.OIDCProvider))
+	portal.GET("/callback", s.rateLimitMiddleware(limits, "callback"), CallbackHandler(s, "/patch"))
+	portal.GET("/patch", IsAuthenticatedMiddleware, patchPageHandler())
+	portal.POST("/patch", IsAuthenticatedMiddleware, s.csrfMiddleware, s.rateLimitMiddleware(limits, "patch"), patchHandler(s))
+	portal.GET("/progress", progressHandler(s))
+	portal.POST("/logout", s.csrfMiddleware, s.rateLimitMiddleware(limits, "logout"), disconnectHandler(s))
+	portal.POST("/voucher", s.csrfMiddleware, s.rateLimitMiddleware(limits, "voucher"), voucherHandler(s))
 
-	r.GET("/liveness", livenessHandler(s))
+	portal.GET("/switch", IsAuthenticatedMiddleware, s.rateLimitMiddleware(limits, "switch"), switchVLANHandler(s))
+	portal.POST("/switch", IsAuthenticatedMiddleware, s.csrfMiddleware, s.rateLimitMiddleware(limits, "switch"), switchVLANSubmitHandler(s))
+	portal.GET("/switch/success", IsAuthenticatedMiddleware, switchVLANSuccessHandler(s))
+
+	admin := portal.Group("/admin", IsAuthenticatedMiddleware, s.adminMiddleware)
+	admin.GET("/patch", adminPatchPageHandler(s))
+	admin.POST("/patch", s.csrfMiddleware, adminPatchHandler(s))
+	admin.GET("/vouchers", adminVouchersPageHandler(s))
+	admin.POST("/vouchers", s.csrfMiddleware, adminVouchersHandler(s))
+	admin.GET("/vouchers/:id", adminVoucherBatchHandler(s))
+	admin.GET("/blocklist", adminBlocklistPageHandler(s))
+	admin.POST("/blocklist", s.csrfMiddleware, adminBlockHandler(s))
+	admin.POST("/blocklist/:id/delete", s.csrfMiddleware, adminUnblockHandler(s))
+	admin.GET("/webhooks", adminWebhooksPageHandler(s))
+	admin.POST("/webhooks", s.csrfMiddleware, adminAddWebhookHandler(s))
+	admin.POST("/webhooks/:id/delete", s.csrfMiddleware, adminRemoveWebhookHandler(s))
+
+	// The API is used by tools, it is neither branded nor in maintenance.
+	r.GET(apiPrefix+"/openapi.json", openAPIHandler())
+	api := r.Group(apiPrefix, s.apiMiddleware)
+	for _, route := range apiRoutes {
+		api.Handle(route.method, route.path, s.apiScopeMiddleware(route.scope), route.handler(s))
+	}
+	r.NoRoute(func(ctx *gin.Context) {
+		if strings.HasPrefix(ctx.Request.URL.Path, apiPrefix+"/") {
+			apiNotFoundHandler(ctx)
+		}
+	})
+
+	r.GET("/liveness", livenessHandler())
 	r.GET("/readiness", readinessHandler(s))
 
-	s.Log.Info().Str("addr", listen).Msg("Listening...")
-	return http.ListenAndServe(listen, r)
+	return r, nil
 }
 
-func indexHandler() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		// TODO check source IP/session to either login/switch
-
-		session := sessions.Default(ctx)
-		ctx.HTML(http.StatusOK, "index.gohtml", gin.H{
-			"isAuthenticated": session.Get(sessionUserSub) != nil,
-			"username":        session.Get(sessionUserName),
-		})
+// ListenAndServe sets up the HTTP server and starts listening. When ctx is
+// cancelled, readiness starts failing and after the shutdown delay in-flight
+// requests are drained. It returns nil after a graceful shutdown.
+func (s *Server) ListenAndServe(ctx context.Context, listen string) error {
+	r, err := s.router()
+	if err != nil {
+		return err
 	}
-}
 
-// executed every few seconds in order to check the container status.
-func livenessHandler(s *Server) gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		if err := s.DB.PingContext(ctx.Request.Context()); err != nil {
+	// Keep accepting requests for a while after the shutdown signal but
+	// report not ready, so no new logins are routed to this instance.
+	drainCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drainCtx.Done():
+			return
+		}
+		s.shuttingDown.Store(true)
+		s.Log.Info().Dur("delay", s.HTTPConfig.ShutdownDelay).Msg("Shutting down, readiness is failing.")
+		select {
+		case <-time.After(s.HTTPConfig.ShutdownDelay):
+		case <-drainCtx.Done():
 			return
 		}
-		ctx.Writer.Write([]byte("ok"))
+		s.Log.Info().Dur("timeout", s.HTTPConfig.ShutdownTimeout).Msg("Draining in-flight requests...")
+		cancel()
+	}()
+
+	srv := s.HTTPConfig.newServer(listen, r)
+	if s.HTTPConfig.tlsEnabled() {
+		reloader, err := newCertReloader(s.Log, s.HTTPConfig.TLSCertFile, s.HTTPConfig.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		go reloader.watch(drainCtx, s.HTTPConfig.TLSReloadInterval)
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
 	}
+
+	s.Log.Info().Str("addr", listen).Bool("tls", srv.TLSConfig != nil).Msg("Listening...")
+	return s.serve(drainCtx, srv)
 }
 
-// executed once to verify the successfull startup of your container.
-func readinessHandler(s *Server) gin.HandlerFunc {
+func indexHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		ctx.Writer.Write([]byte("ready"))
+		// TODO check source IP/session to either login/switch
+
+		session := sessions.Default(ctx)
+		pageContent := gin.H{
+			"isAuthenticated": session.Get(sessionUserSub) != nil,
+			"username":        session.Get(sessionUserName),
+		}
+		if token, err := csrfToken(ctx); err == nil {
+			pageContent["csrfToken"] = token
+		}
+		renderHTML(ctx, http.StatusOK, "index.gohtml", pageContent)
 	}
 }
 
@@ -96,6 +296,10 @@ func renderError(ctx *gin.Context, page string, code int, msg string) {
 	if uname := session.Get(sessionUserName); uname != nil {
 		pageContent["username"] = uname
 	}
+	// Error pages may offer to retry a state-changing action.
+	if token, err := csrfToken(ctx); err == nil {
+		pageContent["csrfToken"] = token
+	}
 
-	ctx.HTML(code, page, pageContent)
+	renderHTML(ctx, code, page, pageContent)
 }
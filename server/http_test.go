@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestShutdownDrain checks that on the shutdown signal the readiness fails
+// first while requests are still served, and in-flight requests complete.
+func TestShutdownDrain(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.HTTPConfig.ShutdownDelay = 500 * time.Millisecond
+	env.S.HTTPConfig.ShutdownTimeout = 5 * time.Second
+	b := env.newBrowser(t)
+	page := b.login(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	// The shutdown signal is handled as by the serve command.
+	ctx, stop := signal.NotifyContext(t.Context(), syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- env.S.ListenAndServe(ctx, addr) }()
+
+	readiness := func() int {
+		resp, err := http.Get("http://" + addr + "/readiness")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for readiness() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("server not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The patch waits for GeCo while the signal arrives.
+	env.Geco.Delay.Store(int64(time.Second))
+	requests := env.Geco.Requests.Load()
+	form := url.Values{csrfFormField: {csrfTokenFrom(t, page)}}
+	patched := make(chan int, 1)
+	go func() {
+		resp, err := b.client.PostForm("http://"+addr+"/patch", form)
+		if err != nil {
+			patched <- 0
+			return
+		}
+		resp.Body.Close()
+		patched <- resp.StatusCode
+	}()
+	for env.Geco.Requests.Load() == requests {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+
+	// The listener stays open during the shutdown delay, reporting not ready.
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	select {
+	case code := <-patched:
+		t.Fatalf("POST /patch finished with %d before the drain", code)
+	default:
+	}
+
+	if code := <-patched; code != http.StatusOK {
+		t.Errorf("in-flight POST /patch = %d, want %d", code, http.StatusOK)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe() = %v", err)
+	}
+	if code := readiness(); code != 0 {
+		t.Errorf("readiness after the drain = %d, want the listener closed", code)
+	}
+}
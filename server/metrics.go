@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "login"
+
+var (
+	metricOIDCCallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "oidc",
+		Name:      "callbacks_total",
+		Help:      "Number of OIDC callbacks by outcome.",
+	}, []string{"outcome"})
+
+	metricGecoStatusDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "geco",
+		Name:      "userstatus_request_duration_seconds",
+		Help:      "Latency of the GeCo user status requests by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	metricDBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Latency of the database lookups by query.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+
+	metricDBLookupMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "lookup_misses_total",
+		Help:      "Number of database lookups which did not find a row by query.",
+	}, []string{"query"})
+
+	metricBounceJobsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "bouncer",
+		Name:      "jobs_created_total",
+		Help:      "Number of bounce jobs created by switch and target VLAN.",
+	}, []string{"switch", "vlan"})
+
+	metricBouncerQueue = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "bouncer",
+		Name:      "queue_operations_total",
+		Help:      "Number of bounce jobs claimed, acked, failed, given up and requeued through the API by operation.",
+	}, []string{"op"})
+
+	metricBlocklistHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "blocklist",
+		Name:      "hits_total",
+		Help:      "Number of patches of blocked or quarantined users or devices by action.",
+	}, []string{"action"})
+
+	metricWebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "Number of webhook delivery attempts by outcome.",
+	}, []string{"outcome"})
+
+	metricOutboxPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "outbox",
+		Name:      "publish_total",
+		Help:      "Number of attempts to publish events of the outbox on the message bus by outcome.",
+	}, []string{"outcome"})
+
+	metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	metricHTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	metricRateLimitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "Number of requests rejected by the rate limiter by route and bucket kind.",
+	}, []string{"route", "kind"})
+)
+
+// Outcomes of the OIDC callback, used as label values of metricOIDCCallbacks.
+const (
+	oidcOutcomeSuccess        = "success"
+	oidcOutcomeInvalidState   = "invalid_state"
+	oidcOutcomeExchangeFailed = "exchange_failed"
+	oidcOutcomeVerifyFailed   = "verify_failed"
+	oidcOutcomeInvalidNonce   = "invalid_nonce"
+	oidcOutcomeClaimsFailed   = "claims_failed"
+	oidcOutcomeSessionFailed  = "session_failed"
+)
+
+// Queries observed by metricDBQueryDuration and metricDBLookupMisses.
+const (
+	queryLocateUser    = "locate_user"
+	queryLocateMAC     = "locate_mac"
+	queryGetSwitchVLAN = "get_switch_vlan"
+)
+
+// Operations of the bounce job queue, used as label values of
+// metricBouncerQueue.
+const (
+	queueOpClaim   = "claim"
+	queueOpAck     = "ack"
+	queueOpFail    = "fail"
+	queueOpGiveUp  = "give_up"
+	queueOpRequeue = "requeue"
+)
+
+// Outcomes of webhook delivery attempts, used as label values of
+// metricWebhookDeliveries.
+const (
+	webhookOutcomeDelivered = "delivered"
+	webhookOutcomeRetry     = "retry"
+	webhookOutcomeFailed    = "failed"
+)
+
+// Outcomes of attempts to publish outbox events, used as label values of
+// metricOutboxPublished.
+const (
+	outboxOutcomePublished = "published"
+	outboxOutcomeRetry     = "retry"
+	outboxOutcomeFailed    = "failed"
+)
+
+// routeUnmatched labels the requests which matched no route, so unknown
+// paths do not each get series of their own.
+const routeUnmatched = "unmatched"
+
+// metricsMiddleware counts the requests and observes their latency by the
+// template of the route, e.g. /admin/vouchers/:id.
+func metricsMiddleware(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = routeUnmatched
+	}
+	method := ctx.Request.Method
+	metricHTTPRequests.WithLabelValues(route, method, strconv.Itoa(ctx.Writer.Status())).Inc()
+	metricHTTPRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the Prometheus metrics at /metrics.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// ListenAndServeMetrics registers the DB pool collector and serves the
+// Prometheus metrics on a separate listener until ctx is cancelled.
+func (s *Server) ListenAndServeMetrics(ctx context.Context, listen string) error {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(s.DB.DB, "login"))
+
+	s.Log.Info().Str("addr", listen).Msg("Serving metrics...")
+	return s.serve(ctx, s.HTTPConfig.newServer(listen, metricsHandler()))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the exposition of the metrics endpoint.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+// metricValue returns the value of series, e.g. name{label="value"}, in the
+// exposition, or 0 if it is not there.
+func metricValue(t *testing.T, exposition, series string) float64 {
+	t.Helper()
+	scanner := bufio.NewScanner(strings.NewReader(exposition))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), series+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("invalid value of %s: %v", series, err)
+		}
+		return v
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	jobAck := apiPrefix + "/jobs/:id/ack"
+	series := []string{
+		`login_oidc_callbacks_total{outcome="success"}`,
+		`login_db_query_duration_seconds_count{query="locate_user"}`,
+		`login_http_requests_total{code="307",method="GET",route="/callback"}`,
+		`login_http_request_duration_seconds_count{method="GET",route="/callback"}`,
+		`login_http_requests_total{code="404",method="POST",route="` + jobAck + `"}`,
+		`login_http_request_duration_seconds_count{method="POST",route="` + jobAck + `"}`,
+		`login_http_requests_total{code="404",method="GET",route="unmatched"}`,
+	}
+	before := scrapeMetrics(t)
+
+	env.newBrowser(t).login(t)
+	var notFound apiError
+	if resp := env.api(t, http.MethodPost, jobPath(12345, "ack"), testAPIToken, apiLeaseRequest{Worker: "a"}, &notFound); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("POST %s: %s, want %d", jobPath(12345, "ack"), resp.Status, http.StatusNotFound)
+	}
+	if resp, _ := env.newBrowser(t).get(t, "/does-not-exist"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /does-not-exist: %s, want %d", resp.Status, http.StatusNotFound)
+	}
+
+	after := scrapeMetrics(t)
+	for _, s := range series {
+		if got, was := metricValue(t, after, s), metricValue(t, before, s); got <= was {
+			t.Errorf("%s = %v, want more than %v", s, got, was)
+		}
+	}
+	// The failed request is labelled with the template of its route.
+	if strings.Contains(after, "/jobs/12345/ack") {
+		t.Errorf("metrics contain the path of the request:\n%s", after)
+	}
+}
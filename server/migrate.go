@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+// migrationLockName is the advisory lock held while migrating, so only one
+// instance migrates at a time.
+const migrationLockName = "login-ng-migrations"
+
+// MigrationStatus is the state of a single migration.
+type MigrationStatus struct {
+	ID string
+	// AppliedAt is nil if the migration is pending.
+	AppliedAt *time.Time
+}
+
+// migrationSource returns the migrations of the dialect, which are kept in a
+// directory of the dialect's name.
+func (d db) migrationSource(migrations fs.FS) (migrate.MigrationSource, error) {
+	dir, err := fs.Sub(migrations, d.dialect.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s migrations: %w", d.dialect.name, err)
+	}
+	return migrate.HttpFileSystemMigrationSource{FileSystem: http.FS(dir)}, nil
+}
+
+// withMigrationLock runs fn while holding the advisory migration lock. It
+// waits up to timeout for other instances to finish migrating.
+func (d db) withMigrationLock(ctx context.Context, timeout time.Duration, fn func() error) error {
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	locked, err := d.dialect.getMigrationLock(ctx, conn, migrationLockName, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to get migration lock: %w", err)
+	}
+	if !locked {
+		return fmt.Errorf("timed out after %v waiting for the migration lock held by another instance", timeout)
+	}
+	defer conn.ExecContext(context.Background(), d.dialect.q.releaseMigrationLock, migrationLockName)
+
+	return fn()
+}
+
+// MigrateUp applies all pending migrations and returns how many were applied.
+func MigrateUp(ctx context.Context, d db, migrations fs.FS, lockTimeout time.Duration) (int, error) {
+	source, err := d.migrationSource(migrations)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = d.withMigrationLock(ctx, lockTimeout, func() (err error) {
+		n, err = migrate.ExecContext(ctx, d.DB, d.dialect.name, source, migrate.Up)
+		return err
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	return n, nil
+}
+
+// MigrateDown rolls back the last steps migrations and returns how many were
+// rolled back.
+func MigrateDown(ctx context.Context, d db, migrations fs.FS, steps int, lockTimeout time.Duration) (int, error) {
+	source, err := d.migrationSource(migrations)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = d.withMigrationLock(ctx, lockTimeout, func() (err error) {
+		n, err = migrate.ExecMaxContext(ctx, d.DB, d.dialect.name, source, migrate.Down, steps)
+		return err
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to roll back migrations: %w", err)
+	}
+	return n, nil
+}
+
+// MigrateRedo rolls back the last migration and applies it again.
+func MigrateRedo(ctx context.Context, d db, migrations fs.FS, lockTimeout time.Duration) error {
+	source, err := d.migrationSource(migrations)
+	if err != nil {
+		return err
+	}
+	err = d.withMigrationLock(ctx, lockTimeout, func() error {
+		n, err := migrate.ExecMaxContext(ctx, d.DB, d.dialect.name, source, migrate.Down, 1)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("no migration applied")
+		}
+		_, err = migrate.ExecMaxContext(ctx, d.DB, d.dialect.name, source, migrate.Up, 1)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to redo migration: %w", err)
+	}
+	return nil
+}
+
+// GetMigrationStatus lists all known migrations and whether they are applied.
+func GetMigrationStatus(d db, migrations fs.FS) ([]MigrationStatus, error) {
+	source, err := d.migrationSource(migrations)
+	if err != nil {
+		return nil, err
+	}
+	known, err := source.FindMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find migrations: %w", err)
+	}
+	records, err := migrate.GetMigrationRecords(d.DB, d.dialect.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	applied := make(map[string]time.Time, len(records))
+	for _, r := range records {
+		applied[r.Id] = r.AppliedAt
+	}
+	status := make([]MigrationStatus, 0, len(known))
+	for _, m := range known {
+		st := MigrationStatus{ID: m.Id}
+		if at, ok := applied[m.Id]; ok {
+			st.AppliedAt = &at
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// ErrSchemaBehind is returned by CheckSchema if migrations are pending.
+var ErrSchemaBehind = errors.New("schema is behind")
+
+// CheckSchema returns an error if migrations are pending, i.e. the schema is
+// behind the running version.
+func CheckSchema(d db, migrations fs.FS) error {
+	source, err := d.migrationSource(migrations)
+	if err != nil {
+		return err
+	}
+	planned, _, err := migrate.PlanMigration(d.DB, d.dialect.name, source, migrate.Up, 0)
+	if err != nil {
+		return fmt.Errorf("failed to plan migrations: %w", err)
+	}
+	if len(planned) > 0 {
+		return fmt.Errorf("%w: %d migrations pending, starting with %s", ErrSchemaBehind, len(planned), planned[0].Id)
+	}
+	return nil
+}
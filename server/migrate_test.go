@@ -0,0 +1,35 @@
+package server
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestDialectMigrations checks that every dialect has the same migrations, so
+// the schema versions match whichever database is used.
+func TestDialectMigrations(t *testing.T) {
+	var want []string
+	for i, d := range []*dialect{mysqlDialect, postgresDialect} {
+		source, err := db{dialect: d}.migrationSource(os.DirFS("../migrations"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrations, err := source.FindMigrations()
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		var ids []string
+		for _, m := range migrations {
+			ids = append(ids, m.Id)
+		}
+
+		if i == 0 {
+			want = ids
+			continue
+		}
+		if !slices.Equal(ids, want) {
+			t.Errorf("%s migrations = %v, want %v as for %s", d.name, ids, want, mysqlDialect.name)
+		}
+	}
+}
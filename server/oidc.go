@@ -8,11 +8,14 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/oauth2"
 )
 
@@ -24,33 +27,74 @@ const (
 	sessionCodeVerifierKey = "codeVerifier"
 )
 
+// tracedHTTPClient is used for the calls to the OIDC provider so they show up
+// as child spans of the incoming request.
+var tracedHTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// discoveryTimeout bounds a single attempt to fetch the discovery document.
+const discoveryTimeout = 10 * time.Second
+
+// OIDCProvider is initialised lazily: the issuer is discovered in the
+// background by Discover, the handlers must only be used once Ready.
 type OIDCProvider struct {
-	log zerolog.Logger
+	log    zerolog.Logger
+	issuer string
+	config oauth2.Config
+
+	discovered atomic.Pointer[discoveredProvider]
+}
+
+type discoveredProvider struct {
 	*oidc.Provider
 	oauth2.Config
 }
 
-func NewOIDCProvider(log zerolog.Logger, issuer, redirectURL, clientID, clientSecret string) (*OIDCProvider, error) {
-	provider, err := oidc.NewProvider(context.Background(), issuer)
-	if err != nil {
-		return nil, err
+func NewOIDCProvider(log zerolog.Logger, issuer, redirectURL, clientID, clientSecret string) *OIDCProvider {
+	return &OIDCProvider{
+		log:    log,
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			// "openid" is a required scope for OpenID Connect flows.
+			Scopes: []string{oidc.ScopeOpenID, oidcScopePolylan},
+		},
 	}
+}
+
+// Discover fetches the discovery document of the issuer, retrying with
+// backoff until it succeeds. It only returns an error if ctx is done.
+func (a *OIDCProvider) Discover(ctx context.Context, backoff Backoff) error {
+	err := backoff.retry(ctx, a.log, "discover the OIDC issuer", func(ctx context.Context) error {
+		discoveryCtx, cancel := context.WithTimeout(oidc.ClientContext(ctx, tracedHTTPClient), discoveryTimeout)
+		defer cancel()
+		provider, err := oidc.NewProvider(discoveryCtx, a.issuer)
+		if err != nil {
+			return err
+		}
 
-	oauth2config := oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectURL,
+		oauth2config := a.config
 		// Discovery returns the OAuth2 endpoints.
-		Endpoint: provider.Endpoint(),
-		// "openid" is a required scope for OpenID Connect flows.
-		Scopes: []string{oidc.ScopeOpenID, oidcScopePolylan},
+		oauth2config.Endpoint = provider.Endpoint()
+		a.discovered.Store(&discoveredProvider{Provider: provider, Config: oauth2config})
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	a.log.Info().Str("issuer", a.issuer).Msg("OIDC issuer discovered.")
+	return nil
+}
 
-	return &OIDCProvider{
-		log:      log,
-		Provider: provider,
-		Config:   oauth2config,
-	}, nil
+// Ready reports whether the issuer was discovered.
+func (a *OIDCProvider) Ready() bool {
+	return a.discovered.Load() != nil
+}
+
+// provider returns the discovered provider. It must only be called once Ready.
+func (a *OIDCProvider) provider() *discoveredProvider {
+	return a.discovered.Load()
 }
 
 func (a *OIDCProvider) verifyIDToken(ctx context.Context, token *oauth2.Token) (*oidc.IDToken, error) {
@@ -60,30 +104,32 @@ func (a *OIDCProvider) verifyIDToken(ctx context.Context, token *oauth2.Token) (
 	}
 
 	oidcConfig := &oidc.Config{
-		ClientID: a.ClientID,
+		ClientID: a.config.ClientID,
 	}
 
-	return a.Verifier(oidcConfig).Verify(ctx, rawIDToken)
+	return a.provider().Verifier(oidcConfig).Verify(ctx, rawIDToken)
 }
 
 func LoginHandler(auth *OIDCProvider) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		log := withTrace(ctx.Request.Context(), auth.log)
+
 		state, err := randString(16)
 		if err != nil {
-			auth.log.Error().Err(err).Msg("failed to generate state")
+			log.Error().Err(err).Msg("failed to generate state")
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
 			return
 		}
 		nonce, err := randString(16)
 		if err != nil {
-			auth.log.Error().Err(err).Msg("failed to generate nonce")
+			log.Error().Err(err).Msg("failed to generate nonce")
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
 			return
 		}
 
 		codeVerifier, err := randString(16)
 		if err != nil {
-			auth.log.Error().Err(err).Msg("failed to generate code verifier")
+			log.Error().Err(err).Msg("failed to generate code verifier")
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
 		}
 		hash := sha256.New()
@@ -95,12 +141,12 @@ func LoginHandler(auth *OIDCProvider) gin.HandlerFunc {
 		session.Set(sessionNonceKey, nonce)
 		session.Set(sessionCodeVerifierKey, codeVerifier)
 		if err := session.Save(); err != nil {
-			auth.log.Error().Err(err).Msg("failed to save session")
+			log.Error().Err(err).Msg("failed to save session")
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		ctx.Redirect(http.StatusTemporaryRedirect, auth.AuthCodeURL(
+		ctx.Redirect(http.StatusTemporaryRedirect, auth.provider().AuthCodeURL(
 			state,
 			oidc.Nonce(nonce),
 			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
@@ -109,35 +155,45 @@ func LoginHandler(auth *OIDCProvider) gin.HandlerFunc {
 	}
 }
 
-func CallbackHandler(auth *OIDCProvider, postLoginRedirectURL string) gin.HandlerFunc {
+func CallbackHandler(s *Server, postLoginRedirectURL string) gin.HandlerFunc {
+	auth := s.OIDCProvider
 	return func(ctx *gin.Context) {
+		log := withTrace(ctx.Request.Context(), auth.log)
+
 		session := sessions.Default(ctx)
 		if ctx.Query("state") != session.Get(sessionStateKey) {
-			auth.log.Error().Msg("invalid state parameter")
+			log.Error().Msg("invalid state parameter")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeInvalidState).Inc()
 			renderError(ctx, "index.gohtml", http.StatusBadRequest, "Invalid state parameter.")
 			return
 		}
 
-		token, err := auth.Exchange(
-			ctx.Request.Context(),
+		exchangeCtx, span := tracer.Start(ctx.Request.Context(), "oidc.Exchange")
+		exchangeCtx = context.WithValue(exchangeCtx, oauth2.HTTPClient, tracedHTTPClient)
+		token, err := auth.provider().Exchange(
+			exchangeCtx,
 			ctx.Query("code"),
 			oauth2.SetAuthURLParam("code_verifier", session.Get(sessionCodeVerifierKey).(string)),
 		)
+		endSpan(span, err)
 		if err != nil {
-			auth.log.Error().Err(err).Msg("failed to exchange code")
+			log.Error().Err(err).Msg("failed to exchange code")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeExchangeFailed).Inc()
 			renderError(ctx, "index.gohtml", http.StatusUnauthorized, "Failed to exchange an authorization code for a token.")
 			return
 		}
 
 		idToken, err := auth.verifyIDToken(ctx.Request.Context(), token)
 		if err != nil {
-			auth.log.Error().Err(err).Msg("failed to verify token")
+			log.Error().Err(err).Msg("failed to verify token")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeVerifyFailed).Inc()
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Failed to verify ID Token.")
 			return
 		}
 
 		if idToken.Nonce != session.Get(sessionNonceKey) {
-			auth.log.Error().Msg("invalid nonce parameter")
+			log.Error().Msg("invalid nonce parameter")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeInvalidNonce).Inc()
 			renderError(ctx, "index.gohtml", http.StatusBadRequest, "Invalid nonce parameter.")
 			return
 		}
@@ -146,7 +202,8 @@ func CallbackHandler(auth *OIDCProvider, postLoginRedirectURL string) gin.Handle
 			Username string `json:"username"`
 		}
 		if err := idToken.Claims(&claims); err != nil {
-			auth.log.Error().Msg("failed to parse custom claims")
+			log.Error().Msg("failed to parse custom claims")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeClaimsFailed).Inc()
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Failed to get parse custom claims.")
 			return
 		}
@@ -154,35 +211,53 @@ func CallbackHandler(auth *OIDCProvider, postLoginRedirectURL string) gin.Handle
 		session.Set(sessionUserAccessToken, token.AccessToken)
 		session.Set(sessionUserSub, idToken.Subject)
 		session.Set(sessionUserName, claims.Username)
+		session.Set(sessionLoginAt, time.Now().Unix())
 		if err := session.Save(); err != nil {
-			auth.log.Error().Err(err).Msg("failed to save session")
+			log.Error().Err(err).Msg("failed to save session")
+			metricOIDCCallbacks.WithLabelValues(oidcOutcomeSessionFailed).Inc()
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, err.Error())
 			return
 		}
 
+		metricOIDCCallbacks.WithLabelValues(oidcOutcomeSuccess).Inc()
+
+		// The login itself writes nothing to the DB, the event is queued alone.
+		mac, _ := session.Get(sessionDeviceMAC).(string)
+		authenticated := outboxEvent{webhookLoginAuthenticated, webhookLogin{
+			Username: claims.Username,
+			IP:       clientIP(ctx),
+			MAC:      mac,
+			Event:    currentEvent(ctx).Name,
+		}}
+		if err := s.queueEvents(ctx.Request.Context(), s.DB, time.Now(), authenticated); err != nil {
+			log.Error().Err(err).Msg("failed to queue login event")
+		}
 		ctx.Redirect(http.StatusTemporaryRedirect, postLoginRedirectURL)
 	}
 }
 
 func LogoutHandler(auth *OIDCProvider) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		log := withTrace(ctx.Request.Context(), auth.log)
 		session := sessions.Default(ctx)
 
 		session.Clear()
 
 		if err := session.Save(); err != nil {
-			auth.log.Error().Err(err).Msg("failed to save session")
+			log.Error().Err(err).Msg("failed to save session")
 			renderError(ctx, "index.gohtml", http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		ctx.Redirect(http.StatusTemporaryRedirect, "/")
+		// See Other, so the browser follows with GET after the POST.
+		ctx.Redirect(http.StatusSeeOther, "/")
 	}
 }
 
 func IsAuthenticatedMiddleware(ctx *gin.Context) {
 	if sessions.Default(ctx).Get(sessionUserSub) == nil {
 		ctx.Redirect(http.StatusSeeOther, "/")
+		ctx.Abort()
 	} else {
 		ctx.Next()
 	}
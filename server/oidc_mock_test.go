@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const mockOIDCKeyID = "test-key"
+
+// mockOIDCUser is the user the mock OIDC provider logs in without asking.
+type mockOIDCUser struct {
+	Sub      string
+	Username string
+}
+
+// mockOIDC is an in-process OIDC provider serving discovery, JWKS, an
+// authorization endpoint which approves immediately and a token endpoint
+// enforcing PKCE with S256.
+type mockOIDC struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	User         mockOIDCUser
+
+	signer jose.Signer
+	key    *rsa.PrivateKey
+
+	mu           sync.Mutex
+	codes        map[string]mockOIDCGrant
+	accessTokens map[string]mockOIDCUser
+}
+
+type mockOIDCGrant struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	user          mockOIDCUser
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", mockOIDCKeyID),
+	)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	m := &mockOIDC{
+		ClientID:     "login-ng",
+		ClientSecret: "secret",
+		User:         mockOIDCUser{Sub: "42", Username: "alice"},
+		signer:       signer,
+		key:          key,
+		codes:        map[string]mockOIDCGrant{},
+		accessTokens: map[string]mockOIDCUser{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("GET /jwks", m.jwks)
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// validAccessToken returns the user an access token was issued to.
+func (m *mockOIDC) validAccessToken(token string) (mockOIDCUser, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.accessTokens[token]
+	return user, ok
+}
+
+func (m *mockOIDC) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *mockOIDC) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &m.key.PublicKey,
+		KeyID:     mockOIDCKeyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+func (m *mockOIDC) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != m.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := rand.Text()
+	m.mu.Lock()
+	m.codes[code] = mockOIDCGrant{
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		user:          m.User,
+	}
+	m.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != m.ClientID || clientSecret != m.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	m.mu.Lock()
+	grant, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+	if !ok || grant.redirectURI != r.PostFormValue("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iss":      m.URL,
+		"sub":      grant.user.Sub,
+		"aud":      m.ClientID,
+		"iat":      now.Unix(),
+		"exp":      now.Add(time.Hour).Unix(),
+		"nonce":    grant.nonce,
+		"username": grant.user.Username,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signed, err := m.signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, err := signed.CompactSerialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := rand.Text()
+	m.mu.Lock()
+	m.accessTokens[accessToken] = grant.user
+	m.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIVersion is the version of the API in the OpenAPI document.
+const openAPIVersion = "1.0.0"
+
+// openAPIErrors are the error statuses every API route may answer.
+var openAPIErrors = []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError, http.StatusServiceUnavailable}
+
+// openAPIDocument generates the OpenAPI 3 document of routes. The schemas of
+// the request and response bodies are derived from their Go types: fields are
+// named by their json tag, required unless omitempty, and described by their
+// doc tag. Bearer schemes have no scopes in OpenAPI, so the scope of a route
+// is in its description and x-scope.
+func openAPIDocument(routes []apiRoute) map[string]any {
+	schemas := openAPISchemas{}
+	errorSchema := schemas.of(reflect.TypeFor[apiError]())
+
+	paths := map[string]any{}
+	for _, route := range routes {
+		// gin notation to OpenAPI notation: /devices/:device -> /devices/{device}
+		segments := strings.Split(route.path, "/")
+		for i, seg := range segments {
+			if name, ok := strings.CutPrefix(seg, ":"); ok {
+				segments[i] = "{" + name + "}"
+			}
+		}
+		path := strings.Join(segments, "/")
+
+		op := map[string]any{
+			"operationId": route.operationID,
+			"summary":     route.summary,
+			"description": "Requires a token with the scope " + route.scope + ".",
+			"x-scope":     route.scope,
+		}
+		if len(route.params) > 0 {
+			params := make([]any, len(route.params))
+			for i, p := range route.params {
+				params[i] = map[string]any{
+					"name":        p.name,
+					"in":          "path",
+					"required":    true,
+					"description": p.doc,
+					"schema":      map[string]any{"type": "string"},
+				}
+			}
+			op["parameters"] = params
+		}
+		if route.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  openAPIJSON(schemas.of(reflect.TypeOf(route.request))),
+			}
+		}
+		responses := map[string]any{
+			"200": map[string]any{
+				"description": http.StatusText(http.StatusOK),
+				"content":     openAPIJSON(schemas.of(reflect.TypeOf(route.response))),
+			},
+		}
+		for _, status := range slices.Concat(route.errors, openAPIErrors) {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content":     openAPIJSON(errorSchema),
+			}
+		}
+		op["responses"] = responses
+
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   ServiceName + " API",
+			"version": openAPIVersion,
+		},
+		"servers":  []any{map[string]any{"url": apiPrefix}},
+		"security": []any{map[string]any{"bearer": []any{}}},
+		"paths":    paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIJSON(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// openAPISchemas are the schemas of the components of the document by name.
+type openAPISchemas map[string]any
+
+// of returns the schema of t. Structs are added to the components and
+// referenced by their name without the api prefix.
+func (c openAPISchemas) of(t reflect.Type) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.of(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": c.of(t.Elem())}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "api")
+		if _, ok := c[name]; !ok {
+			// Set before the fields, so recursive types terminate.
+			c[name] = nil
+			c[name] = c.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	panic(fmt.Sprintf("openapi: unsupported type %s", t))
+}
+
+func (c openAPISchemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema := c.of(f.Type)
+		// Siblings of $ref are ignored, so references are not described.
+		if doc := f.Tag.Get("doc"); doc != "" && schema["$ref"] == nil {
+			schema["description"] = doc
+		}
+		properties[name] = schema
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// openAPIHandler serves the OpenAPI document of the API.
+func openAPIHandler() gin.HandlerFunc {
+	doc := openAPIDocument(apiRoutes)
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, doc)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// outboxBatchSize is the most events published per interval.
+	outboxBatchSize = 100
+	// maxOutboxBackoff caps the delay between attempts.
+	maxOutboxBackoff = 5 * time.Minute
+	// outboxRetention is how long published events are kept.
+	outboxRetention = 24 * time.Hour
+	// outboxFailedRetention is how long failed events are kept for
+	// inspection, and unpublished ones for a publisher.
+	outboxFailedRetention = 7 * 24 * time.Hour
+)
+
+// execer runs statements on the DB or in a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// outboxEvent is an event for the message bus and the webhooks. The data
+// types are those of the webhooks.
+type outboxEvent struct {
+	eventType string
+	data      any
+}
+
+// pendingEvent is an event of the outbox which is not published yet.
+type pendingEvent struct {
+	id        int64
+	eventType string
+	payload   string
+	attempts  int
+	// nextAttemptAt is when the event is retried, or taken over if the
+	// replica publishing it died.
+	nextAttemptAt time.Time
+}
+
+// queueEvents writes events to the outbox and their webhook deliveries with
+// ex. Given the transaction of the change they report, they are published
+// and delivered only if it commits. The outbox is written even without a
+// publisher in this process, e.g. in the patch command, as any replica with
+// one publishes it.
+func (s *Server) queueEvents(ctx context.Context, ex execer, now time.Time, events ...outboxEvent) (err error) {
+	if len(events) == 0 {
+		return nil
+	}
+	ctx, span := s.DB.startSpan(ctx, "db.queueEvents", s.DB.dialect.q.insertOutboxEvent)
+	defer func() { endSpan(span, err) }()
+
+	for _, e := range events {
+		payload, err := newWebhookPayload(e.eventType, e.data, now)
+		if err != nil {
+			return err
+		}
+		if _, err := ex.ExecContext(ctx, s.DB.dialect.q.insertOutboxEvent, e.eventType, payload, now); err != nil {
+			return fmt.Errorf("failed to queue event: %w", err)
+		}
+		if err := s.queueWebhookDeliveries(ctx, ex, e.eventType, payload, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitEvent queues an event which reports no change of the DB, e.g. a
+// refused login. Failures are only logged, events never fail the action they
+// report.
+func (s *Server) emitEvent(ctx context.Context, e outboxEvent) {
+	if err := s.queueEvents(ctx, s.DB, time.Now(), e); err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Str("event type", e.eventType).Msg("failed to queue event")
+	}
+}
+
+// RunOutbox publishes the pending events of the outbox every Interval until
+// ctx is done. Without a publisher it only sweeps the outbox.
+func (s *Server) RunOutbox(ctx context.Context) {
+	ticker := time.NewTicker(s.PublisherConfig.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.dbReady.Load() {
+			continue
+		}
+		run := s.publishEvents
+		if s.Publisher == nil {
+			run = s.sweepOutbox
+		}
+		if err := run(ctx, time.Now()); err != nil {
+			s.Log.Error().Err(err).Msg("Failed to process the outbox.")
+		}
+	}
+}
+
+// publishEvents publishes the pending events in the order they were queued.
+// Like webhook deliveries, every attempt is claimed first, so each is
+// published by one replica only. Publishing stops at the first event which is
+// not due at now, because it failed or another replica is publishing it, so
+// later events never overtake it. An event which failed MaxAttempts times is
+// marked failed and skipped, so it does not hold back the later ones.
+func (s *Server) publishEvents(ctx context.Context, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.publishEvents", s.DB.dialect.q.claimOutboxEvent)
+	defer func() { endSpan(span, err) }()
+	q := s.DB.dialect.q
+
+	if err = s.sweepOutbox(ctx, now); err != nil {
+		return err
+	}
+
+	rows, err := s.DB.QueryContext(ctx, q.listPendingOutboxEvents, outboxBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list outbox: %w", err)
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var e pendingEvent
+		if err = rows.Scan(&e.id, &e.eventType, &e.payload, &e.attempts, &e.nextAttemptAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read outbox: %w", err)
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to list outbox: %w", err)
+	}
+
+	for _, e := range pending {
+		if e.nextAttemptAt.After(now) {
+			return nil
+		}
+		res, err := s.DB.ExecContext(ctx, q.claimOutboxEvent, now.Add(s.outboxBackoff(e.attempts+1)), e.id, e.attempts)
+		if err != nil {
+			return fmt.Errorf("failed to claim event: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to claim event: %w", err)
+		} else if n == 0 {
+			return nil
+		}
+		e.attempts++
+
+		pubCtx, cancel := context.WithTimeout(ctx, s.PublisherConfig.Timeout)
+		pubErr := s.Publisher.Publish(pubCtx, e.eventType, []byte(e.payload))
+		cancel()
+
+		publishedAt, failedAt, lastError := sql.NullTime{Time: time.Now(), Valid: true}, sql.NullTime{}, sql.NullString{}
+		giveUp := pubErr != nil && e.attempts >= s.PublisherConfig.MaxAttempts
+		if pubErr != nil {
+			publishedAt, lastError = sql.NullTime{}, sql.NullString{String: pubErr.Error(), Valid: true}
+		}
+		if giveUp {
+			failedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+		if _, err := s.DB.ExecContext(ctx, q.finishOutboxEvent, publishedAt, failedAt, lastError, e.id); err != nil {
+			return fmt.Errorf("failed to record event: %w", err)
+		}
+		log := withTrace(ctx, s.Log).With().Int64("event", e.id).Str("event type", e.eventType).Int("attempt", e.attempts).Logger()
+		switch {
+		case giveUp:
+			metricOutboxPublished.WithLabelValues(outboxOutcomeFailed).Inc()
+			log.Error().Err(pubErr).Msg("failed to publish event, giving up")
+		case pubErr != nil:
+			metricOutboxPublished.WithLabelValues(outboxOutcomeRetry).Inc()
+			log.Warn().Err(pubErr).Msg("failed to publish event, retrying")
+			return nil
+		default:
+			metricOutboxPublished.WithLabelValues(outboxOutcomePublished).Inc()
+		}
+	}
+	return nil
+}
+
+// sweepOutbox deletes the events published before outboxRetention, and those
+// which failed or were never published before outboxFailedRetention, e.g.
+// if no replica has a publisher.
+func (s *Server) sweepOutbox(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-outboxFailedRetention)
+	if _, err := s.DB.ExecContext(ctx, s.DB.dialect.q.sweepOutboxEvents, now.Add(-outboxRetention), cutoff, cutoff); err != nil {
+		return fmt.Errorf("failed to sweep outbox: %w", err)
+	}
+	return nil
+}
+
+// outboxBackoff returns the delay before the attempt after the given one.
+func (s *Server) outboxBackoff(attempt int) time.Duration {
+	d := s.PublisherConfig.RetryBackoff
+	for i := 1; i < attempt && d < maxOutboxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxOutboxBackoff)
+}
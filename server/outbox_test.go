@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// publishedEvent is an event received from the message bus.
+type publishedEvent struct {
+	subject string
+	payload webhookPayload
+}
+
+// recordingPublisher records the published events, or fails with err.
+type recordingPublisher struct {
+	mu     sync.Mutex
+	err    error
+	events []publishedEvent
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, eventType string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	var e publishedEvent
+	e.subject = eventType
+	if err := json.Unmarshal(payload, &e.payload); err != nil {
+		return err
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error { return nil }
+
+func (p *recordingPublisher) published() []publishedEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]publishedEvent(nil), p.events...)
+}
+
+// subjects returns the subjects of events.
+func subjects(events []publishedEvent) []string {
+	s := make([]string, len(events))
+	for i, e := range events {
+		s[i] = e.subject
+	}
+	return s
+}
+
+func TestOutboxRollback(t *testing.T) {
+	env := newTestEnv(t)
+	p := &recordingPublisher{}
+	env.S.Publisher = p
+	err := env.S.addWebhook(t.Context(), WebhookRequest{URL: "https://example.com/hook", Secret: testWebhookSecret, Events: webhookEventTypes, Author: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An event whose change is rolled back is never published nor delivered.
+	tx, err := env.S.DB.BeginTx(t.Context(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(t.Context(), env.S.DB.dialect.q.insertBounceJob, fixtureMAC, fixtureVLAN, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.S.queueEvents(t.Context(), tx, time.Now(), outboxEvent{webhookBounceCreated, webhookBounce{MAC: fixtureMAC, TargetVLAN: fixtureVLAN}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither is the completion of a job whose lease was lost.
+	if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, fixtureMAC, fixtureVLAN, nil); err != nil {
+		t.Fatal(err)
+	}
+	jobs := env.claim(t, "a", 1)
+	if len(jobs) != 1 {
+		t.Fatalf("claim of a = %+v, want the job", jobs)
+	}
+	var conflict apiError
+	if resp := env.api(t, http.MethodPost, jobPath(jobs[0].ID, "ack"), testAPIToken, apiLeaseRequest{Worker: "b"}, &conflict); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("ack by b: %s, want %d", resp.Status, http.StatusConflict)
+	}
+
+	if err := env.S.publishEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(p.published()); len(got) != 1 || got[0] != webhookBounceCreated {
+		t.Errorf("published %v, want only the committed %s", got, webhookBounceCreated)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 {
+		t.Errorf("bounce jobs = %v, want the committed one", got)
+	}
+	deliveries, err := env.S.listWebhookDeliveries(t.Context(), webhookPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].EventType != webhookBounceCreated {
+		t.Errorf("webhook deliveries = %+v, want only the committed %s", deliveries, webhookBounceCreated)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	env := newTestEnv(t)
+	p := &recordingPublisher{err: errors.New("broker down")}
+	env.S.Publisher = p
+	for _, mac := range []string{fixtureMAC, otherMAC} {
+		if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, mac, fixtureVLAN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	if err := env.S.publishEvents(t.Context(), now); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.err = nil
+	p.mu.Unlock()
+	// The failed event is not retried before the backoff, and the later one
+	// does not overtake it.
+	if err := env.S.publishEvents(t.Context(), now); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.published(); len(got) != 0 {
+		t.Fatalf("published %v before the backoff, want none", subjects(got))
+	}
+
+	// The DB rounds the time of the next attempt to microseconds.
+	if err := env.S.publishEvents(t.Context(), now.Add(env.S.PublisherConfig.RetryBackoff+time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	got := p.published()
+	if len(got) != 2 || got[0].payload.Data.(map[string]any)["mac"] != fixtureMAC || got[1].payload.Data.(map[string]any)["mac"] != otherMAC {
+		t.Fatalf("published %+v, want the jobs of %s and %s in order", got, fixtureMAC, otherMAC)
+	}
+	if err := env.S.publishEvents(t.Context(), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.published(); len(got) != 2 {
+		t.Errorf("published %v after publishing again, want each event once", subjects(got))
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	// Events are queued without a publisher, like by the patch command or a
+	// replica without -events-publisher.
+	env := newTestEnv(t)
+	if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, fixtureMAC, fixtureVLAN, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another replica publishes them.
+	p := &recordingPublisher{}
+	relay := &Server{Log: env.S.Log, DB: env.S.DB, PublisherConfig: env.S.PublisherConfig, Publisher: p}
+	if err := relay.publishEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(p.published()); len(got) != 1 || got[0] != webhookBounceCreated {
+		t.Errorf("published %v, want %s", got, webhookBounceCreated)
+	}
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	env := newTestEnv(t)
+	p := &recordingPublisher{err: errors.New("message too large")}
+	env.S.Publisher = p
+	for _, mac := range []string{fixtureMAC, otherMAC} {
+		if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, mac, fixtureVLAN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first event fails every attempt, the second one the first.
+	now := time.Now()
+	for i := range env.S.PublisherConfig.MaxAttempts {
+		if err := env.S.publishEvents(t.Context(), now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.mu.Lock()
+	p.err = nil
+	p.mu.Unlock()
+	if err := env.S.publishEvents(t.Context(), now.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.published(); len(got) != 1 || got[0].payload.Data.(map[string]any)["mac"] != otherMAC {
+		t.Fatalf("published %+v, want only the job of %s", got, otherMAC)
+	}
+
+	var failed int
+	var lastError string
+	err := env.S.DB.QueryRowContext(t.Context(), `SELECT COUNT(*), MAX(last_error) FROM event_outbox WHERE failed_at IS NOT NULL;`).Scan(&failed, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 || lastError != "message too large" {
+		t.Errorf("%d failed events with the error %q, want the first one", failed, lastError)
+	}
+}
+
+func TestOutboxLoginFailed(t *testing.T) {
+	env := newTestEnv(t)
+	p := &recordingPublisher{}
+	env.S.Publisher = p
+
+	b := env.newBrowser(t)
+	page := b.login(t)
+	env.Geco.Status.Store(http.StatusUnprocessableEntity)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("POST /patch before the check-in: %s:\n%s", resp.Status, page)
+	}
+	if err := env.S.publishEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(p.published()); len(got) != 2 || got[1] != webhookLoginFailed {
+		t.Errorf("published %v, want %s after %s", got, webhookLoginFailed, webhookLoginAuthenticated)
+	}
+}
+
+// startNATS starts an embedded NATS server and returns its URL.
+func startNATS(t *testing.T) string {
+	t.Helper()
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	return ns.ClientURL()
+}
+
+func TestOutboxNATS(t *testing.T) {
+	env := newTestEnv(t)
+	natsURL := startNATS(t)
+	p, err := NewEventPublisher(PublisherNATS, natsURL, "login", zerolog.New(zerolog.NewTestWriter(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	env.S.Publisher = p
+
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	sub, err := nc.SubscribeSync("login.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+	if err := env.S.publishEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"login." + webhookLoginAuthenticated, "login." + webhookBounceCreated, "login." + webhookLoginSucceeded}
+	for _, subject := range want {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", subject, err)
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal(msg.Data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Subject != subject || "login."+payload.Type != subject || payload.ID == "" {
+			t.Errorf("received %s %+v, want %s", msg.Subject, payload, subject)
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Errorf("received %s, want no more events", msg.Subject)
+	}
+}
+
+// startMQTT starts an embedded MQTT broker, whose inline client the tests
+// subscribe with, and returns it with its URL.
+func startMQTT(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+	broker := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker, "tcp://" + tcp.Address()
+}
+
+func TestOutboxMQTT(t *testing.T) {
+	env := newTestEnv(t)
+	broker, brokerURL := startMQTT(t)
+	received := make(chan publishedEvent, 10)
+	err := broker.Subscribe("login/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		e := publishedEvent{subject: pk.TopicName}
+		if err := json.Unmarshal(pk.Payload, &e.payload); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewEventPublisher(PublisherMQTT, brokerURL, "login", zerolog.New(zerolog.NewTestWriter(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	env.S.Publisher = p
+
+	if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, fixtureMAC, fixtureVLAN, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The client connects in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pendingEvents(t, env.S.DB)) > 0 && time.Now().Before(deadline) {
+		if err := env.S.publishEvents(t.Context(), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case e := <-received:
+		if e.subject != "login/bounce/created" || e.payload.Type != webhookBounceCreated || e.payload.Data.(map[string]any)["mac"] != fixtureMAC {
+			t.Errorf("received %s %+v, want the bounce job of %s", e.subject, e.payload, fixtureMAC)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+// pendingEvents returns the types of the events of the outbox which are not
+// published yet.
+func pendingEvents(t *testing.T, d db) []string {
+	t.Helper()
+	rows, err := d.QueryContext(t.Context(), `SELECT event_type FROM event_outbox WHERE published_at IS NULL;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var types []string
+	for rows.Next() {
+		var typ string
+		if err := rows.Scan(&typ); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, typ)
+	}
+	return types
+}
@@ -1,79 +1,228 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 )
 
+// errDeviceChanged is returned if the device patched is not the one the login
+// started from.
+var errDeviceChanged = errors.New("device changed since login")
+
+// bindDeviceMiddleware locates the device of the client before the login and
+// remembers it in the session, so /patch moves the device the user logged in
+// from. Clients which cannot be located, e.g. staff outside the LAN, may log
+// in but not patch.
+func (s *Server) bindDeviceMiddleware(ctx *gin.Context) {
+	session := sessions.Default(ctx)
+	up, err := s.locateUser(ctx.Request.Context(), clientIP(ctx))
+	if err != nil {
+		withTrace(ctx.Request.Context(), s.Log).Warn().Err(err).Str("user IP", clientIP(ctx)).Msg("login from unknown device")
+		session.Delete(sessionDeviceIP)
+		session.Delete(sessionDeviceMAC)
+		session.Delete(sessionDeviceSwitch)
+	} else {
+		session.Set(sessionDeviceIP, up.userIP)
+		session.Set(sessionDeviceMAC, up.userMAC)
+		session.Set(sessionDeviceSwitch, up.switchIP)
+	}
+	// Saved by the login handler.
+	ctx.Next()
+}
+
+// patchPageHandler shows the page which submits the patch request. Patching
+// changes network state, so it is only done on POST with a CSRF token.
+func patchPageHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, err := csrfToken(ctx)
+		if err != nil {
+			renderError(ctx, "patch.gohtml", http.StatusInternalServerError, "Internal error")
+			return
+		}
+
+		session := sessions.Default(ctx)
+		renderHTML(ctx, http.StatusOK, "patch.gohtml", gin.H{
+			"username":  session.Get(sessionUserName),
+			"csrfToken": token,
+		})
+	}
+}
+
 func patchHandler(s *Server) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		err := s.userIsCheckedin(ctx)
+		ev := currentEvent(ctx)
+		if msg := ev.closedMessage(time.Now()); msg != "" {
+			s.emitLoginFailed(ctx, msg)
+			renderError(ctx, "patch.gohtml", http.StatusForbidden, msg)
+			return
+		}
+
+		err := s.userIsCheckedin(ctx, ev)
 		if err != nil {
+			s.emitLoginFailed(ctx, err.Error())
 			renderError(ctx, "patch.gohtml", http.StatusForbidden, err.Error())
 			return
 		}
 
+		// Remembered so staff can patch the user's devices by hand.
+		session := sessions.Default(ctx)
+		username, sub := session.Get(sessionUserName).(string), session.Get(sessionUserSub).(string)
+		if err := s.recordCheckin(ctx.Request.Context(), ev, username, sub); err != nil {
+			withTrace(ctx.Request.Context(), s.Log).Warn().Err(err).Str("username", username).Msg("failed to record check-in")
+		}
+
 		err = s.patchIntoVLAN(ctx)
 		if err != nil {
-			renderError(ctx, "patch.gohtml", http.StatusInternalServerError, "Failed to patch into the network.")
+			code, msg := http.StatusInternalServerError, "Failed to patch into the network."
+			switch {
+			case errors.Is(err, errBlocked):
+				code = http.StatusForbidden
+			case errors.Is(err, errDeviceChanged):
+				code = http.StatusConflict
+			}
+			var ue *userError
+			if errors.As(err, &ue) {
+				msg = ue.msg
+			}
+			log := withTrace(ctx.Request.Context(), s.Log)
+			entry := log.Warn()
+			if code == http.StatusInternalServerError {
+				entry = log.Error()
+			}
+			entry.Err(err).Str("username", username).Str("user IP", clientIP(ctx)).Msg("failed to patch")
+			s.emitLoginFailed(ctx, msg)
+			renderError(ctx, "patch.gohtml", code, msg)
 			return
 		}
 
-		session := sessions.Default(ctx)
-		ctx.HTML(http.StatusOK, "success.gohtml", gin.H{
+		renderHTML(ctx, http.StatusOK, "success.gohtml", gin.H{
 			"username": session.Get(sessionUserName),
 		})
 	}
 }
 
 func (s *Server) patchIntoVLAN(ctx *gin.Context) error {
+	log := withTrace(ctx.Request.Context(), s.Log)
+
 	// find source switch
-	userIP := strings.Split(ctx.Request.RemoteAddr, ":")[0]
-	if xff, ok := ctx.Request.Header["X-Forwarded-For"]; ok {
-		userIP = xff[0]
+	up, err := s.locateUser(ctx.Request.Context(), clientIP(ctx))
+	if err != nil {
+		return &userError{"Unable to locate the switch the user is connected to.", err}
 	}
-	up, err := s.locateUser(ctx.Request.Context(), userIP)
+
+	session := sessions.Default(ctx)
+	sub, username := session.Get(sessionUserSub).(string), session.Get(sessionUserName).(string)
+	if boundMAC, _ := session.Get(sessionDeviceMAC).(string); boundMAC != up.userMAC {
+		return &userError{
+			"This is not the device you logged in from, or its address changed. Please log in again from the device you want to connect.",
+			fmt.Errorf("%w: MAC %s, logged in from %q", errDeviceChanged, up.userMAC, boundMAC),
+		}
+	}
+	ev := currentEvent(ctx)
+	_, err = s.patchDevice(ctx.Request.Context(), ev, up, sub, username, 0, &webhookLogin{Username: username, IP: up.userIP, Event: ev.Name}, nil)
 	if err != nil {
-		s.Log.Error().Err(err).Str("user IP", userIP).Msg("failed to find source switch")
-		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Unable to locate the switch the user is connected to.")
 		return err
 	}
+	if err := rememberBounce(ctx, up.userMAC); err != nil {
+		log.Warn().Err(err).Msg("failed to save session")
+	}
+	return nil
+}
 
-	// map switch to vlan
-	targetVLAN, err := s.getSwitchVLAN(ctx.Request.Context(), up.switchIP)
+// emitLoginFailed reports that the user of the session could not be patched,
+// with the message shown to the user.
+func (s *Server) emitLoginFailed(ctx *gin.Context, msg string) {
+	username, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+	s.emitEvent(ctx.Request.Context(), outboxEvent{webhookLoginFailed, webhookLogin{
+		Username: username,
+		IP:       clientIP(ctx),
+		Event:    currentEvent(ctx).Name,
+		Error:    msg,
+	}})
+}
+
+// patchDevice moves the located device of username into vlan, or the VLAN of
+// the switch it is connected to if vlan is 0, and returns the VLAN. The GeCo
+// subject sub is empty if unknown. Blocked devices are refused and
+// quarantined ones moved into the quarantine VLAN, reported as blocklist.hit
+// with the bounce job. The bounce job and login log are tagged with ev. If
+// login is set, the device is patched by the login of the user, which is
+// completed with the device and reported as login.succeeded with the bounce
+// job. If audit is set, it is written with the bounce job, its detail
+// completed with the VLAN.
+func (s *Server) patchDevice(ctx context.Context, ev *event, up *userProperties, sub, username string, vlan int, login *webhookLogin, audit *auditEntry) (int, error) {
+	log := withTrace(ctx, s.Log)
+
+	targetVLAN, hit, err := s.blockedVLAN(ctx, sub, username, up, vlan)
 	if err != nil {
-		s.Log.Error().Err(err).Str("switch IP", up.switchIP).Msg("VLAN for switch not found")
-		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Unkown switch IP")
-		return err
+		return 0, err
+	}
+
+	// map switch to vlan
+	if targetVLAN == 0 {
+		targetVLAN, err = s.getSwitchVLAN(ctx, up.switchIP)
+		if err != nil {
+			log.Error().Err(err).Str("switch IP", up.switchIP).Msg("VLAN for switch not found")
+			return 0, err
+		}
 	}
 
 	// create bounce job
-	err = s.createNewBounceJob(ctx.Request.Context(), up.userMAC, targetVLAN)
+	var events []outboxEvent
+	if hit != nil {
+		events = append(events, *hit)
+	}
+	if login != nil {
+		login.MAC, login.SwitchIP, login.VLAN = up.userMAC, up.switchIP, targetVLAN
+		events = append(events, outboxEvent{webhookLoginSucceeded, *login})
+	}
+	if audit != nil {
+		audit.Detail += fmt.Sprintf(" vlan=%d", targetVLAN)
+	}
+	err = s.createNewBounceJob(ctx, ev.dbID(), up.userMAC, targetVLAN, audit, events...)
 	if err != nil {
-		s.Log.Error().Err(err).
+		log.Error().Err(err).
 			Str("user MAC", up.userMAC).
 			Int("target VLAN", targetVLAN).
 			Msg("failed to create a new bounce job")
-		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal Server Error: Please contact the support.")
-		return err
+		return 0, err
 	}
+	metricBounceJobsCreated.WithLabelValues(up.switchIP, strconv.Itoa(targetVLAN)).Inc()
 
 	// log
-	session := sessions.Default(ctx)
-	username := session.Get(sessionUserName).(string)
-	err = s.createNewLoginLog(ctx.Request.Context(), username, up.userMAC)
+	err = s.createNewLoginLog(ctx, ev.dbID(), loginLogPatch, username, up.userMAC)
 	if err != nil {
-		s.Log.Error().Err(err).
+		log.Error().Err(err).
 			Str("username", username).
 			Str("user MAC", up.userMAC).
 			Msg("failed to log login")
 		// ignore error as its only logging
 	}
 
-	return nil
+	return targetVLAN, nil
+}
+
+// userError is an error whose message can be shown to the user.
+type userError struct {
+	msg string
+	err error
+}
+
+func (e *userError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e *userError) Unwrap() error { return e.err }
+
+// clientIP returns the IP of the client. Behind a trusted proxy, e.g. the
+// HAProxy, this is the last address in X-Forwarded-For not of a trusted
+// proxy. X-Forwarded-For of other peers is ignored, as clients may set it.
+func clientIP(ctx *gin.Context) string {
+	return ctx.ClientIP()
 }
 
 func switchVLANHandler(s *Server) gin.HandlerFunc {
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// ProgressConfig configures how the progress of a bounce job is reported on
+// the success page.
+type ProgressConfig struct {
+	// PollInterval is how often the bounce job and accounting are checked.
+	PollInterval time.Duration
+	// Timeout is how long after the patch the user is asked to re-plug if the
+	// device is not connected yet.
+	Timeout time.Duration
+}
+
+// States of a bounce job as shown on the success page.
+const (
+	// bounceQueued waits for the bouncer to pick up the job.
+	bounceQueued = "queued"
+	// bounceBouncing is retried by the bouncer.
+	bounceBouncing = "bouncing"
+	// bounceReconnecting was done by the bouncer, the device has not
+	// reconnected yet.
+	bounceReconnecting = "reconnecting"
+	// bounceConnected reconnected on the new VLAN.
+	bounceConnected = "connected"
+	// bounceTimeout did not connect within the timeout.
+	bounceTimeout = "timeout"
+	// bounceFailed was given up by the bouncer, see BouncerQueueConfig.
+	bounceFailed = "failed"
+)
+
+// bounceProgress is sent as the data of a progress event.
+type bounceProgress struct {
+	State   string `json:"state"`
+	Message string `json:"message"`
+	// Final is set for the last event of the stream.
+	Final bool `json:"final"`
+}
+
+var bounceMessages = map[string]string{
+	bounceQueued:       "Your device is queued to be moved into the network.",
+	bounceBouncing:     "Your port is being reset, this may take a few attempts.",
+	bounceReconnecting: "Your port has been reset, waiting for your device to reconnect.",
+	bounceConnected:    "You are connected to the Internet. Have fun!",
+	bounceTimeout:      "Your device did not reconnect in time. Please unplug your network cable and plug it back in.",
+	bounceFailed:       "Your port could not be reset. Please unplug your network cable and plug it back in, or ask the helpdesk.",
+}
+
+// rememberBounce keeps the device moved by the bounce job created now in the
+// session for progressHandler.
+func rememberBounce(ctx *gin.Context, mac string) error {
+	session := sessions.Default(ctx)
+	session.Set(sessionBounceMAC, mac)
+	session.Set(sessionBounceAt, time.Now().Unix())
+	return session.Save()
+}
+
+// pendingBounceJob is a bounce job the bouncer has not done yet.
+type pendingBounceJob struct {
+	TargetVLAN int
+	Retries    int
+	UpdatedAt  time.Time
+	// LeaseOwner is the bouncer which claimed the job through the API.
+	LeaseOwner sql.NullString
+	FailedAt   sql.NullTime
+}
+
+// state is bounceQueued, bounceBouncing or bounceFailed.
+func (j *pendingBounceJob) state() string {
+	if j.FailedAt.Valid {
+		return bounceFailed
+	}
+	if j.Retries > 0 || j.LeaseOwner.Valid {
+		return bounceBouncing
+	}
+	return bounceQueued
+}
+
+// getBounceJob returns the latest pending bounce job of mac, or nil if there
+// is none. The bouncer deletes jobs once done.
+func (s *Server) getBounceJob(ctx context.Context, mac string) (job *pendingBounceJob, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.getBounceJob", s.DB.dialect.q.getBounceJobOfMAC)
+	defer func() { endSpan(span, err) }()
+
+	job = new(pendingBounceJob)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getBounceJobOfMAC, mac).Scan(&job.TargetVLAN, &job.Retries, &job.UpdatedAt, &job.LeaseOwner, &job.FailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bounce job: %w", err)
+	}
+	return job, nil
+}
+
+// bounceState returns the state of the bounce job of mac created at since.
+// Once the job is done, the device reconnects with a new accounting session.
+func (s *Server) bounceState(ctx context.Context, mac string, since, now time.Time) (state string, err error) {
+	job, err := s.getBounceJob(ctx, mac)
+	if err != nil {
+		return "", err
+	}
+	if job != nil {
+		state = job.state()
+		if state == bounceFailed {
+			return state, nil
+		}
+	} else {
+		connected, err := s.hasAcctSessionSince(ctx, mac, since)
+		if err != nil {
+			return "", err
+		}
+		if connected {
+			return bounceConnected, nil
+		}
+		state = bounceReconnecting
+	}
+	if now.Sub(since) >= s.ProgressConfig.Timeout {
+		return bounceTimeout, nil
+	}
+	return state, nil
+}
+
+// hasAcctSessionSince reports whether the device mac has an open accounting
+// session which started at since or later.
+func (s *Server) hasAcctSessionSince(ctx context.Context, mac string, since time.Time) (ok bool, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.hasAcctSessionSince", s.DB.dialect.q.hasAcctSessionSince)
+	defer func() { endSpan(span, err) }()
+
+	var n int
+	if err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.hasAcctSessionSince, mac, since).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to check accounting: %w", err)
+	}
+	return n > 0, nil
+}
+
+// progressHandler streams the state of the last bounce job of the session as
+// server-sent events until the device is connected or the timeout is over.
+// Clients without a bounce job get 204, so the browser does not reconnect.
+func progressHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+		mac, _ := session.Get(sessionBounceMAC).(string)
+		bounceAt, _ := session.Get(sessionBounceAt).(int64)
+		if mac == "" {
+			ctx.Status(http.StatusNoContent)
+			return
+		}
+		since := time.Unix(bounceAt, 0)
+		log := withTrace(ctx.Request.Context(), s.Log).With().Str("user MAC", mac).Logger()
+
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no")
+		// The stream outlives the write timeout of the server.
+		rc := http.NewResponseController(ctx.Writer)
+		ticker := time.NewTicker(s.ProgressConfig.PollInterval)
+		defer ticker.Stop()
+		last := ""
+		for {
+			_ = rc.SetWriteDeadline(time.Now().Add(s.ProgressConfig.PollInterval + s.HTTPConfig.WriteTimeout))
+			state, err := s.bounceState(ctx.Request.Context(), mac, since, time.Now())
+			if err != nil {
+				// The browser reconnects.
+				log.Error().Err(err).Msg("failed to get bounce progress")
+				return
+			}
+			final := state == bounceConnected || state == bounceTimeout || state == bounceFailed
+			if state != last {
+				ctx.SSEvent("progress", bounceProgress{State: state, Message: bounceMessages[state], Final: final})
+				last = state
+			} else {
+				// Keeps proxies from closing the idle stream.
+				_, _ = ctx.Writer.WriteString(":\n\n")
+			}
+			ctx.Writer.Flush()
+			// Clients reconnect to another instance while this one drains.
+			if final || s.shuttingDown.Load() {
+				return
+			}
+
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// progressStream is the event stream of /progress.
+type progressStream struct {
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+func (b *testBrowser) progress(t *testing.T) *progressStream {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, b.base+"/progress", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return &progressStream{resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+// next returns the data of the next progress event, skipping keep-alives.
+func (p *progressStream) next(t *testing.T) bounceProgress {
+	t.Helper()
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading progress: %v", err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		if !ok {
+			continue
+		}
+		var progress bounceProgress
+		if err := json.Unmarshal([]byte(data), &progress); err != nil {
+			t.Fatalf("invalid progress %q: %v", data, err)
+		}
+		return progress
+	}
+}
+
+func TestProgress(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	stream := b.progress(t)
+	if ct := stream.resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("GET /progress: Content-Type %q, want text/event-stream", ct)
+	}
+	// The bouncer retries the job, deletes it once done and the device
+	// reconnects with a new accounting session.
+	steps := []struct {
+		stmt  string
+		args  []any
+		state string
+	}{
+		{state: bounceQueued},
+		{stmt: `UPDATE bouncer_jobs SET retires = 1;`, state: bounceBouncing},
+		{stmt: `DELETE FROM bouncer_jobs;`, state: bounceReconnecting},
+		{stmt: `UPDATE radacct SET acctstarttime = ?;`, args: []any{time.Now()}, state: bounceConnected},
+	}
+	for _, step := range steps {
+		if step.stmt != "" {
+			if _, err := env.S.DB.ExecContext(t.Context(), step.stmt, step.args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := stream.next(t)
+		if got.State != step.state || got.Message == "" {
+			t.Fatalf("progress = %+v, want state %q", got, step.state)
+		}
+		if got.Final != (step.state == bounceConnected) {
+			t.Errorf("progress %q final = %t", got.State, got.Final)
+		}
+	}
+}
+
+func TestProgressTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.ProgressConfig.Timeout = 0
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	if got := b.progress(t).next(t); got.State != bounceTimeout || !got.Final || !strings.Contains(got.Message, "plug") {
+		t.Errorf("progress = %+v, want final %q", got, bounceTimeout)
+	}
+}
+
+func TestProgressWithoutBounce(t *testing.T) {
+	env := newTestEnv(t)
+	b := env.newBrowser(t)
+	b.login(t)
+
+	if resp := b.progress(t).resp; resp.StatusCode != http.StatusNoContent {
+		t.Errorf("GET /progress: %s, want %d", resp.Status, http.StatusNoContent)
+	}
+}
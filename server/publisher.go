@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// Kinds of message buses events are published on.
+const (
+	PublisherNATS = "nats"
+	PublisherMQTT = "mqtt"
+)
+
+// PublisherConfig configures the publishing of the outbox on a message bus.
+type PublisherConfig struct {
+	// Interval is how often pending events are published.
+	Interval time.Duration
+	// Timeout bounds every publish.
+	Timeout time.Duration
+	// RetryBackoff is the delay before the first retry, doubled on every
+	// further attempt. It must be longer than Timeout, so events in flight
+	// are not published twice.
+	RetryBackoff time.Duration
+	// MaxAttempts is the number of attempts after which an event is marked
+	// failed and the later events are published.
+	MaxAttempts int
+}
+
+// EventPublisher publishes events on a message bus, see RunOutbox.
+type EventPublisher interface {
+	// Publish sends the JSON payload of an event of eventType and returns
+	// once the broker has it.
+	Publish(ctx context.Context, eventType string, payload []byte) error
+	// Close disconnects from the broker.
+	Close() error
+}
+
+// NewEventPublisher connects to the broker at url of kind, nats or mqtt.
+// Events are published below prefix: login.succeeded is sent to the subject
+// <prefix>.login.succeeded on NATS and the topic <prefix>/login/succeeded on
+// MQTT. Credentials are taken from url. The connection is retried in the
+// background, so the broker need not be up at startup.
+func NewEventPublisher(kind, url, prefix string, log zerolog.Logger) (EventPublisher, error) {
+	switch kind {
+	case PublisherNATS:
+		return newNATSPublisher(url, prefix, log)
+	case PublisherMQTT:
+		return newMQTTPublisher(url, prefix, log)
+	}
+	return nil, fmt.Errorf("unknown event publisher %q", kind)
+}
+
+// natsPublisher publishes on core NATS subjects.
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+func newNATSPublisher(url, prefix string, log zerolog.Logger) (*natsPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name(ServiceName),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("Disconnected from NATS.")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Str("url", c.ConnectedUrlRedacted()).Msg("Reconnected to NATS.")
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	return &natsPublisher{conn: conn, prefix: prefix}, nil
+}
+
+// Publish flushes after publishing, so the server has received the message.
+func (p *natsPublisher) Publish(ctx context.Context, eventType string, payload []byte) error {
+	if !p.conn.IsConnected() {
+		return errors.New("not connected to NATS")
+	}
+	if err := p.conn.Publish(p.prefix+"."+eventType, payload); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("failed to flush to NATS: %w", err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+// mqttPublisher publishes with QoS 1, so messages are acknowledged by the
+// broker.
+type mqttPublisher struct {
+	client mqtt.Client
+	prefix string
+}
+
+func newMQTTPublisher(url, prefix string, log zerolog.Logger) (*mqttPublisher, error) {
+	id, err := randString(8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate MQTT client ID: %w", err)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(url).
+		// Unique per replica, the broker disconnects clients with the same ID.
+		SetClientID(ServiceName + "-" + id).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warn().Err(err).Msg("Disconnected from MQTT broker.")
+		}).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Info().Msg("Connected to MQTT broker.")
+		})
+	client := mqtt.NewClient(opts)
+	// With ConnectRetry the token completes once connected, which is not
+	// waited for.
+	client.Connect()
+	return &mqttPublisher{client: client, prefix: prefix}, nil
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, eventType string, payload []byte) error {
+	if !p.client.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+	topic := p.prefix + "/" + strings.ReplaceAll(eventType, ".", "/")
+	token := p.client.Publish(topic, 1, false, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("failed to publish to MQTT: %w", ctx.Err())
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to publish to MQTT: %w", err)
+	}
+	return nil
+}
+
+// mqttDisconnectQuiesce is how long, in milliseconds, in-flight messages
+// are given on Close.
+const mqttDisconnectQuiesce = 250
+
+func (p *mqttPublisher) Close() error {
+	p.client.Disconnect(mqttDisconnectQuiesce)
+	return nil
+}
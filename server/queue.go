@@ -0,0 +1,502 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BouncerQueueConfig configures the queue the bouncers claim bounce jobs from
+// through the API, instead of polling bouncer_jobs.
+type BouncerQueueConfig struct {
+	// Lease is how long a claimed job is held without heartbeat before it is
+	// handed to another bouncer.
+	Lease time.Duration
+	// MaxRetries is the number of failed attempts after which a job is given
+	// up.
+	MaxRetries int
+	// RetryDelay is how long a failed job waits before it is claimed again.
+	RetryDelay time.Duration
+}
+
+const (
+	// maxClaimJobs is the most jobs handed out by one claim.
+	maxClaimJobs = 100
+	// maxJobLease is the longest lease a bouncer can ask for.
+	maxJobLease = time.Hour
+	// maxWorkerLength keeps the lease owner within its column.
+	maxWorkerLength = 128
+	// leaseExpiredError is the last error of jobs whose lease ran out.
+	leaseExpiredError = "lease expired"
+)
+
+// States of a job in the queue.
+const (
+	jobQueued = "queued"
+	jobLeased = "leased"
+	jobFailed = "failed"
+	jobDone   = "done"
+)
+
+var (
+	// errJobNotFound is returned for jobs which are done or never existed.
+	errJobNotFound = errors.New("bounce job not found")
+	// errLeaseLost is returned if the job is not leased by the bouncer, e.g.
+	// because the lease expired and another bouncer claimed it.
+	errLeaseLost = errors.New("bounce job is not leased by the bouncer")
+	// errJobNotFailed is returned when requeueing a job which has not failed.
+	errJobNotFailed = errors.New("bounce job has not failed")
+)
+
+// queuedBounceJob is a row of bouncer_jobs as seen by the queue.
+type queuedBounceJob struct {
+	ID         int64
+	MAC        string
+	TargetVLAN int
+	Retries    int
+	// LeaseOwner is the API client and worker holding the lease. The lease
+	// ends when a job fails, LeaseUntil is then when it is retried.
+	LeaseOwner sql.NullString
+	LeaseUntil sql.NullTime
+	LastError  sql.NullString
+	FailedAt   sql.NullTime
+}
+
+func (j *queuedBounceJob) state(now time.Time) string {
+	switch {
+	case j.FailedAt.Valid:
+		return jobFailed
+	case j.LeaseOwner.Valid && !j.LeaseUntil.Time.Before(now):
+		return jobLeased
+	}
+	return jobQueued
+}
+
+func (s *Server) getQueuedBounceJob(ctx context.Context, id int64) (job *queuedBounceJob, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.getQueuedBounceJob", s.DB.dialect.q.getQueuedBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	job = new(queuedBounceJob)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getQueuedBounceJob, id).
+		Scan(&job.ID, &job.MAC, &job.TargetVLAN, &job.Retries, &job.LeaseOwner, &job.LeaseUntil, &job.LastError, &job.FailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bounce job: %w", err)
+	}
+	return job, nil
+}
+
+// claimBounceJobs leases up to n jobs to owner until now+lease, oldest
+// first. Jobs are claimed one by one with a conditional update, so concurrent
+// bouncers never get the same job. An expired lease counts as a failed attempt
+// of the previous owner, jobs out of retries are given up instead of handed
+// out again.
+func (s *Server) claimBounceJobs(ctx context.Context, owner string, n int, lease time.Duration, now time.Time) (jobs []*queuedBounceJob, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.claimBounceJobs", s.DB.dialect.q.claimBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listClaimableBounceJobs, now, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list claimable bounce jobs: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read claimable bounce jobs: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list claimable bounce jobs: %w", err)
+	}
+
+	for _, id := range ids {
+		res, err := s.DB.ExecContext(ctx, s.DB.dialect.q.claimBounceJob, leaseExpiredError, owner, now.Add(lease), id, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim bounce job: %w", err)
+		}
+		if claimed, err := res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("failed to claim bounce job: %w", err)
+		} else if claimed == 0 {
+			// Claimed by another bouncer in the meantime.
+			continue
+		}
+		job, err := s.getQueuedBounceJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Retries >= s.BouncerQueueConfig.MaxRetries {
+			if err := s.releaseBounceJob(ctx, job, owner, job.Retries, leaseExpiredError, now); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		metricBouncerQueue.WithLabelValues(queueOpClaim).Inc()
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// extendBounceJobLease renews the lease of owner on the job until now+lease.
+// Leases which expired cannot be renewed, the job may be claimed by another
+// bouncer already.
+func (s *Server) extendBounceJobLease(ctx context.Context, job *queuedBounceJob, owner string, lease time.Duration, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.extendBounceJobLease", s.DB.dialect.q.extendBounceJobLease)
+	defer func() { endSpan(span, err) }()
+
+	until := now.Add(lease)
+	res, err := s.DB.ExecContext(ctx, s.DB.dialect.q.extendBounceJobLease, until, job.ID, owner, now)
+	if err != nil {
+		return fmt.Errorf("failed to extend bounce job lease: %w", err)
+	}
+	if err := expectOneRow(res, errLeaseLost); err != nil {
+		return err
+	}
+	job.LeaseUntil = sql.NullTime{Time: until, Valid: true}
+	return nil
+}
+
+// ackBounceJob deletes the job done by owner, like bouncers polling the table
+// do.
+func (s *Server) ackBounceJob(ctx context.Context, job *queuedBounceJob, owner string) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.ackBounceJob", s.DB.dialect.q.deleteBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, s.DB.dialect.q.deleteBounceJob, job.ID, owner)
+	if err != nil {
+		return fmt.Errorf("failed to delete bounce job: %w", err)
+	}
+	if err := expectOneRow(res, errLeaseLost); err != nil {
+		return err
+	}
+	done := outboxEvent{webhookBounceCompleted, webhookBounce{JobID: job.ID, MAC: job.MAC, TargetVLAN: job.TargetVLAN, Retries: job.Retries}}
+	if err = s.queueEvents(ctx, tx, time.Now(), done); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete bounce job: %w", err)
+	}
+	metricBouncerQueue.WithLabelValues(queueOpAck).Inc()
+	return nil
+}
+
+// releaseBounceJob ends the lease of owner after a failed attempt, with
+// retries failed attempts in total. The job is claimable again after
+// RetryDelay, or given up once out of retries.
+func (s *Server) releaseBounceJob(ctx context.Context, job *queuedBounceJob, owner string, retries int, reason string, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.releaseBounceJob", s.DB.dialect.q.releaseBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	var retryAt, failedAt sql.NullTime
+	var events []outboxEvent
+	op := queueOpFail
+	if retries >= s.BouncerQueueConfig.MaxRetries {
+		failedAt = sql.NullTime{Time: now, Valid: true}
+		op = queueOpGiveUp
+		events = append(events, outboxEvent{webhookBounceFailed, webhookBounce{JobID: job.ID, MAC: job.MAC, TargetVLAN: job.TargetVLAN, Retries: retries, Error: reason}})
+	} else {
+		retryAt = sql.NullTime{Time: now.Add(s.BouncerQueueConfig.RetryDelay), Valid: true}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, s.DB.dialect.q.releaseBounceJob, retries, reason, retryAt, failedAt, job.ID, owner, job.Retries)
+	if err != nil {
+		return fmt.Errorf("failed to release bounce job: %w", err)
+	}
+	if err := expectOneRow(res, errLeaseLost); err != nil {
+		return err
+	}
+	if err = s.queueEvents(ctx, tx, now, events...); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to release bounce job: %w", err)
+	}
+	job.Retries, job.LastError = retries, sql.NullString{String: reason, Valid: true}
+	job.LeaseOwner, job.LeaseUntil, job.FailedAt = sql.NullString{}, retryAt, failedAt
+	if failedAt.Valid {
+		withTrace(ctx, s.Log).Warn().Int64("job", job.ID).Str("user MAC", job.MAC).Str("reason", reason).Msg("bounce job failed")
+	}
+	metricBouncerQueue.WithLabelValues(op).Inc()
+	return nil
+}
+
+// requeueBounceJob resets the retries of a failed job, so it is claimed
+// again.
+func (s *Server) requeueBounceJob(ctx context.Context, job *queuedBounceJob) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.requeueBounceJob", s.DB.dialect.q.requeueBounceJob)
+	defer func() { endSpan(span, err) }()
+
+	res, err := s.DB.ExecContext(ctx, s.DB.dialect.q.requeueBounceJob, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to requeue bounce job: %w", err)
+	}
+	if err := expectOneRow(res, errJobNotFailed); err != nil {
+		return err
+	}
+	job.Retries, job.LeaseOwner, job.LeaseUntil, job.FailedAt = 0, sql.NullString{}, sql.NullTime{}, sql.NullTime{}
+	metricBouncerQueue.WithLabelValues(queueOpRequeue).Inc()
+	return nil
+}
+
+// expectOneRow returns miss if the conditional statement did not match the
+// row.
+func expectOneRow(res sql.Result, miss error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return miss
+	}
+	return nil
+}
+
+type apiQueueJob struct {
+	ID         int64      `json:"id"`
+	MAC        string     `json:"mac"`
+	TargetVLAN int        `json:"target_vlan"`
+	Retries    int        `json:"retries" doc:"Failed attempts so far, including expired leases."`
+	State      string     `json:"state" doc:"queued, leased, failed or done."`
+	LeaseUntil *time.Time `json:"lease_until,omitempty" doc:"When the lease runs out, or when the job is claimable again after a failed attempt."`
+	LastError  string     `json:"last_error,omitempty" doc:"Reason of the last failed attempt."`
+}
+
+func newAPIQueueJob(job *queuedBounceJob, now time.Time) apiQueueJob {
+	res := apiQueueJob{
+		ID:         job.ID,
+		MAC:        job.MAC,
+		TargetVLAN: job.TargetVLAN,
+		Retries:    job.Retries,
+		State:      job.state(now),
+		LastError:  job.LastError.String,
+	}
+	if job.LeaseUntil.Valid {
+		res.LeaseUntil = &job.LeaseUntil.Time
+	}
+	return res
+}
+
+type apiClaimRequest struct {
+	Worker       string `json:"worker" doc:"Name of the bouncer instance. Leases are held by the API client and worker."`
+	Max          int    `json:"max,omitempty" doc:"Most jobs to claim, 1 by default and at most 100."`
+	LeaseSeconds int    `json:"lease_seconds,omitempty" doc:"Lease duration, bouncer-lease by default and at most an hour."`
+}
+
+type apiQueueJobList struct {
+	Jobs []apiQueueJob `json:"jobs"`
+}
+
+type apiLeaseRequest struct {
+	Worker       string `json:"worker"`
+	LeaseSeconds int    `json:"lease_seconds,omitempty" doc:"Lease duration, bouncer-lease by default and at most an hour."`
+}
+
+type apiFailRequest struct {
+	Worker string `json:"worker"`
+	Reason string `json:"reason" doc:"Why the attempt failed, e.g. the error of the switch."`
+}
+
+type apiRequeueRequest struct {
+	Reason string `json:"reason" doc:"Recorded in the audit log."`
+}
+
+// bindQueueRequest decodes the JSON body into req and returns the lease owner
+// of worker, which is empty for requests without one.
+func bindQueueRequest(ctx *gin.Context, req any, worker func() string) (owner string, ok bool) {
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, "The body must be a JSON object.")
+		return "", false
+	}
+	if worker == nil {
+		return "", true
+	}
+	w := worker()
+	if w == "" || len(w) > maxWorkerLength {
+		apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, fmt.Sprintf("worker must have 1 to %d characters.", maxWorkerLength))
+		return "", false
+	}
+	return apiClient(ctx) + "/" + w, true
+}
+
+// leaseDuration returns the lease requested in seconds, or the default lease.
+func (s *Server) leaseDuration(ctx *gin.Context, seconds int) (time.Duration, bool) {
+	lease := time.Duration(seconds) * time.Second
+	if seconds == 0 {
+		lease = s.BouncerQueueConfig.Lease
+	}
+	if lease <= 0 || lease > maxJobLease {
+		apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, "lease_seconds must be between 1 and 3600.")
+		return 0, false
+	}
+	return lease, true
+}
+
+// queuedJobParam returns the job of the id path parameter.
+func (s *Server) queuedJobParam(ctx *gin.Context) (*queuedBounceJob, bool) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		apiAbort(ctx, http.StatusNotFound, apiCodeNotFound, "No such job.")
+		return nil, false
+	}
+	job, err := s.getQueuedBounceJob(ctx.Request.Context(), id)
+	if err != nil {
+		s.apiAbortErr(ctx, err)
+		return nil, false
+	}
+	return job, true
+}
+
+func apiClaimJobsHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiClaimRequest
+		owner, ok := bindQueueRequest(ctx, &req, func() string { return req.Worker })
+		if !ok {
+			return
+		}
+		lease, ok := s.leaseDuration(ctx, req.LeaseSeconds)
+		if !ok {
+			return
+		}
+		if req.Max == 0 {
+			req.Max = 1
+		}
+		if req.Max < 0 || req.Max > maxClaimJobs {
+			apiAbort(ctx, http.StatusBadRequest, apiCodeInvalidRequest, fmt.Sprintf("max must be between 1 and %d.", maxClaimJobs))
+			return
+		}
+
+		now := time.Now()
+		jobs, err := s.claimBounceJobs(ctx.Request.Context(), owner, req.Max, lease, now)
+		if err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		res := apiQueueJobList{Jobs: []apiQueueJob{}}
+		for _, job := range jobs {
+			res.Jobs = append(res.Jobs, newAPIQueueJob(job, now))
+		}
+		ctx.JSON(http.StatusOK, res)
+	}
+}
+
+func apiHeartbeatJobHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiLeaseRequest
+		owner, ok := bindQueueRequest(ctx, &req, func() string { return req.Worker })
+		if !ok {
+			return
+		}
+		lease, ok := s.leaseDuration(ctx, req.LeaseSeconds)
+		if !ok {
+			return
+		}
+		job, ok := s.queuedJobParam(ctx)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		if err := s.extendBounceJobLease(ctx.Request.Context(), job, owner, lease, now); err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, newAPIQueueJob(job, now))
+	}
+}
+
+func apiAckJobHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiLeaseRequest
+		owner, ok := bindQueueRequest(ctx, &req, func() string { return req.Worker })
+		if !ok {
+			return
+		}
+		job, ok := s.queuedJobParam(ctx)
+		if !ok {
+			return
+		}
+		if err := s.ackBounceJob(ctx.Request.Context(), job, owner); err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		res := newAPIQueueJob(job, time.Now())
+		res.State, res.LeaseUntil = jobDone, nil
+		ctx.JSON(http.StatusOK, res)
+	}
+}
+
+func apiFailJobHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiFailRequest
+		owner, ok := bindQueueRequest(ctx, &req, func() string { return req.Worker })
+		if !ok {
+			return
+		}
+		if req.Reason == "" {
+			apiAbort(ctx, http.StatusUnprocessableEntity, apiCodeUnprocessable, "A reason is required.")
+			return
+		}
+		job, ok := s.queuedJobParam(ctx)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		if err := s.releaseBounceJob(ctx.Request.Context(), job, owner, job.Retries+1, req.Reason, now); err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, newAPIQueueJob(job, now))
+	}
+}
+
+func apiRequeueJobHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req apiRequeueRequest
+		if _, ok := bindQueueRequest(ctx, &req, nil); !ok {
+			return
+		}
+		if req.Reason == "" {
+			apiAbort(ctx, http.StatusUnprocessableEntity, apiCodeUnprocessable, "A reason is required.")
+			return
+		}
+		job, ok := s.queuedJobParam(ctx)
+		if !ok {
+			return
+		}
+		if err := s.requeueBounceJob(ctx.Request.Context(), job); err != nil {
+			s.apiAbortErr(ctx, err)
+			return
+		}
+		err := s.createAuditEntry(ctx.Request.Context(), auditEntry{
+			Actor:  "api:" + apiClient(ctx),
+			Action: auditActionRequeueJob,
+			Target: job.MAC,
+			Detail: fmt.Sprintf("job %d to VLAN %d", job.ID, job.TargetVLAN),
+			Reason: req.Reason,
+		})
+		if err != nil {
+			withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to write audit log of requeue")
+		}
+		ctx.JSON(http.StatusOK, newAPIQueueJob(job, time.Now()))
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// otherMAC has a bounce job but is not connected.
+const otherMAC = "616263646567"
+
+// claim claims up to n jobs for worker.
+func (e *testEnv) claim(t *testing.T, worker string, n int) []apiQueueJob {
+	t.Helper()
+	var res apiQueueJobList
+	resp := e.api(t, http.MethodPost, "/jobs/claim", testAPIToken, apiClaimRequest{Worker: worker, Max: n}, &res)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /jobs/claim: %s", resp.Status)
+	}
+	return res.Jobs
+}
+
+func jobPath(id int64, op string) string {
+	return "/jobs/" + strconv.FormatInt(id, 10) + "/" + op
+}
+
+func TestBouncerQueue(t *testing.T) {
+	env := newTestEnv(t)
+	for _, mac := range []string{fixtureMAC, otherMAC} {
+		if err := env.S.createNewBounceJob(t.Context(), sql.NullInt64{}, mac, fixtureVLAN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Concurrent bouncers never get the same job.
+	a := env.claim(t, "a", 1)
+	if len(a) != 1 || a[0].MAC != fixtureMAC || a[0].State != jobLeased || a[0].LeaseUntil == nil {
+		t.Fatalf("claim of a = %+v, want the leased job of %s", a, fixtureMAC)
+	}
+	b := env.claim(t, "b", 10)
+	if len(b) != 1 || b[0].MAC != otherMAC {
+		t.Fatalf("claim of b = %+v, want the job of %s", b, otherMAC)
+	}
+	if jobs := env.claim(t, "c", 10); len(jobs) != 0 {
+		t.Errorf("claim of c = %+v, want none", jobs)
+	}
+
+	var conflict apiError
+	resp := env.api(t, http.MethodPost, jobPath(a[0].ID, "heartbeat"), testAPIToken, apiLeaseRequest{Worker: "b"}, &conflict)
+	if resp.StatusCode != http.StatusConflict || conflict.Error.Code != apiCodeConflict {
+		t.Errorf("heartbeat by b: %s %+v, want %d", resp.Status, conflict, http.StatusConflict)
+	}
+	var job apiQueueJob
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "heartbeat"), testAPIToken, apiLeaseRequest{Worker: "a", LeaseSeconds: 600}, &job)
+	if resp.StatusCode != http.StatusOK || job.State != jobLeased || !job.LeaseUntil.After(*a[0].LeaseUntil) {
+		t.Errorf("heartbeat by a: %s %+v, want the lease extended", resp.Status, job)
+	}
+
+	// A failed attempt is retried, the reason is kept.
+	job = apiQueueJob{}
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "fail"), testAPIToken, apiFailRequest{Worker: "a", Reason: "switch timeout"}, &job)
+	if resp.StatusCode != http.StatusOK || job.State != jobQueued || job.Retries != 1 || job.LastError != "switch timeout" {
+		t.Errorf("fail by a: %s %+v, want queued with 1 retry", resp.Status, job)
+	}
+	var progress apiJob
+	env.api(t, http.MethodGet, "/devices/"+fixtureMAC+"/job", testAPIToken, nil, &progress)
+	if progress.State != bounceBouncing {
+		t.Errorf("device job state = %q after a failed attempt, want %q", progress.State, bounceBouncing)
+	}
+
+	job = apiQueueJob{}
+	resp = env.api(t, http.MethodPost, jobPath(b[0].ID, "ack"), testAPIToken, apiLeaseRequest{Worker: "b"}, &job)
+	if resp.StatusCode != http.StatusOK || job.State != jobDone {
+		t.Errorf("ack by b: %s %+v, want done", resp.Status, job)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 || got[0].mac != fixtureMAC {
+		t.Errorf("bounce jobs = %v, want only the job of %s", got, fixtureMAC)
+	}
+	var notFound apiError
+	resp = env.api(t, http.MethodPost, jobPath(b[0].ID, "ack"), testAPIToken, apiLeaseRequest{Worker: "b"}, &notFound)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second ack by b: %s, want %d", resp.Status, http.StatusNotFound)
+	}
+
+	// The bouncer holding the retried job dies, its lease expires.
+	c := env.claim(t, "c", 1)
+	if len(c) != 1 || c[0].ID != a[0].ID || c[0].Retries != 1 {
+		t.Fatalf("claim of c = %+v, want the retried job", c)
+	}
+	if jobs := env.claim(t, "a", 1); len(jobs) != 0 {
+		t.Errorf("claim of a = %+v while c holds the lease, want none", jobs)
+	}
+	if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE bouncer_jobs SET lease_until = ?;`, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// The expired lease is the last attempt, the job is given up.
+	if jobs := env.claim(t, "a", 1); len(jobs) != 0 {
+		t.Errorf("claim of a = %+v, want the job given up after %d retries", jobs, testMaxRetries)
+	}
+	progress = apiJob{}
+	env.api(t, http.MethodGet, "/devices/"+fixtureMAC+"/job", testAPIToken, nil, &progress)
+	if progress.State != bounceFailed || progress.Retries != testMaxRetries {
+		t.Errorf("device job = %+v, want failed", progress)
+	}
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "ack"), testAPIToken, apiLeaseRequest{Worker: "c"}, &conflict)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("ack by c after its lease expired: %s, want %d", resp.Status, http.StatusConflict)
+	}
+
+	var invalid apiError
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "requeue"), testAPIToken, apiRequeueRequest{}, &invalid)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("requeue without reason: %s, want %d", resp.Status, http.StatusUnprocessableEntity)
+	}
+	job = apiQueueJob{}
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "requeue"), testAPIToken, apiRequeueRequest{Reason: "switch rebooted"}, &job)
+	if resp.StatusCode != http.StatusOK || job.State != jobQueued || job.Retries != 0 {
+		t.Errorf("requeue: %s %+v, want queued without retries", resp.Status, job)
+	}
+	resp = env.api(t, http.MethodPost, jobPath(a[0].ID, "requeue"), testAPIToken, apiRequeueRequest{Reason: "again"}, &conflict)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("requeue of a queued job: %s, want %d", resp.Status, http.StatusConflict)
+	}
+	entries, err := env.S.listAuditEntries(t.Context(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != auditActionRequeueJob || entries[0].Target != fixtureMAC {
+		t.Errorf("audit log = %+v, want the requeue", entries)
+	}
+	if jobs := env.claim(t, "a", 1); len(jobs) != 1 || jobs[0].ID != a[0].ID {
+		t.Errorf("claim of a = %+v, want the requeued job", jobs)
+	}
+}
+
+func TestBouncerQueueInvalidRequest(t *testing.T) {
+	env := newTestEnv(t)
+	tests := []struct {
+		name   string
+		path   string
+		body   any
+		status int
+	}{
+		{name: "no worker", path: "/jobs/claim", body: apiClaimRequest{}, status: http.StatusBadRequest},
+		{name: "too many jobs", path: "/jobs/claim", body: apiClaimRequest{Worker: "a", Max: maxClaimJobs + 1}, status: http.StatusBadRequest},
+		{name: "lease too long", path: "/jobs/claim", body: apiClaimRequest{Worker: "a", LeaseSeconds: 7200}, status: http.StatusBadRequest},
+		{name: "unknown job", path: jobPath(42, "heartbeat"), body: apiLeaseRequest{Worker: "a"}, status: http.StatusNotFound},
+		{name: "invalid job", path: "/jobs/x/ack", body: apiLeaseRequest{Worker: "a"}, status: http.StatusNotFound},
+		{name: "fail without reason", path: jobPath(42, "fail"), body: apiFailRequest{Worker: "a"}, status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res apiError
+			resp := env.api(t, http.MethodPost, tt.path, testAPIToken, tt.body, &res)
+			if resp.StatusCode != tt.status || res.Error.Message == "" {
+				t.Errorf("POST %s: %s %+v, want %d", tt.path, resp.Status, res, tt.status)
+			}
+		})
+	}
+}
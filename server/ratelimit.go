@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitConfig holds the token bucket budgets of the rate limited routes.
+type RateLimitConfig struct {
+	PerIP      RateBudget
+	PerSession RateBudget
+	// Shared keeps the buckets in the database, so all replicas enforce the
+	// same limits. Otherwise every replica keeps its own buckets in memory.
+	Shared bool
+}
+
+// RateBudget allows Tokens requests per Per. Tokens are refilled
+// continuously, so a client which used up its budget may retry after
+// Per/Tokens. A zero budget disables the limit.
+type RateBudget struct {
+	Tokens int
+	Per    time.Duration
+}
+
+func (b RateBudget) enabled() bool {
+	return b.Tokens > 0 && b.Per > 0
+}
+
+// take refills a bucket holding tokens at last and tries to remove one token
+// at now. It returns the new token count and how long the caller has to wait
+// if no token was available.
+func (b RateBudget) take(tokens float64, last, now time.Time) (float64, time.Duration) {
+	perSecond := float64(b.Tokens) / b.Per.Seconds()
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(b.Tokens), tokens+elapsed*perSecond)
+	}
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) / perSecond * float64(time.Second))
+}
+
+// rateLimitStore keeps the token buckets.
+type rateLimitStore interface {
+	// take removes a token from the bucket key and returns how long to wait
+	// if the bucket was empty.
+	take(ctx context.Context, key string, b RateBudget, now time.Time) (time.Duration, error)
+}
+
+// sessionRateLimitID is the session key of the ID which keys the
+// per-session buckets. It is created by the first rate limited request, so
+// the budget applies before the login too.
+const sessionRateLimitID = "rate_limit_id"
+
+// rateLimitSessionID returns the ID of the session, creating and saving one
+// if needed.
+func rateLimitSessionID(ctx *gin.Context) (string, error) {
+	session := sessions.Default(ctx)
+	if id, ok := session.Get(sessionRateLimitID).(string); ok {
+		return id, nil
+	}
+
+	id, err := randString(16)
+	if err != nil {
+		return "", err
+	}
+	session.Set(sessionRateLimitID, id)
+	if err := session.Save(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// bucketSweepInterval is how often idle buckets are removed from the stores.
+const bucketSweepInterval = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	per    time.Duration
+}
+
+// memoryRateLimitStore keeps the buckets of a single replica.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (m *memoryRateLimitStore) take(_ context.Context, key string, b RateBudget, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > bucketSweepInterval {
+		// A bucket idle for longer than its period is full again.
+		for k, bk := range m.buckets {
+			if now.Sub(bk.last) > bk.per {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	bk, ok := m.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: float64(b.Tokens), last: now, per: b.Per}
+		m.buckets[key] = bk
+	}
+	var wait time.Duration
+	bk.tokens, wait = b.take(bk.tokens, bk.last, now)
+	bk.last = now
+	return wait, nil
+}
+
+// dbRateLimitStore keeps the buckets in the database shared by all replicas.
+type dbRateLimitStore struct {
+	db db
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func (d *dbRateLimitStore) take(ctx context.Context, key string, b RateBudget, now time.Time) (wait time.Duration, err error) {
+	q := d.db.dialect.q
+	ctx, span := d.db.startSpan(ctx, "db.takeRateLimitToken", q.lockRateLimitBucket)
+	defer func() { endSpan(span, err) }()
+
+	d.sweep(ctx, now)
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, q.ensureRateLimitBucket, key, b.Tokens, now.UnixMicro()); err != nil {
+		return 0, fmt.Errorf("failed to create bucket: %w", err)
+	}
+	var tokens float64
+	var updatedAt int64
+	if err := tx.QueryRowContext(ctx, q.lockRateLimitBucket, key).Scan(&tokens, &updatedAt); err != nil {
+		return 0, fmt.Errorf("failed to lock bucket: %w", err)
+	}
+	tokens, wait = b.take(tokens, time.UnixMicro(updatedAt), now)
+	if _, err := tx.ExecContext(ctx, q.updateRateLimitBucket, tokens, now.UnixMicro(), key); err != nil {
+		return 0, fmt.Errorf("failed to update bucket: %w", err)
+	}
+	return wait, tx.Commit()
+}
+
+// sweep removes buckets which have been idle for an hour. Errors are ignored,
+// the next sweep will catch up.
+func (d *dbRateLimitStore) sweep(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	if now.Sub(d.lastSweep) < bucketSweepInterval {
+		d.mu.Unlock()
+		return
+	}
+	d.lastSweep = now
+	d.mu.Unlock()
+
+	d.db.ExecContext(ctx, d.db.dialect.q.sweepRateLimitBuckets, now.Add(-time.Hour).UnixMicro())
+}
+
+func (s *Server) newRateLimitStore() rateLimitStore {
+	if s.RateLimitConfig.Shared {
+		return &dbRateLimitStore{db: s.DB}
+	}
+	return newMemoryRateLimitStore()
+}
+
+// rateLimitMiddleware limits the requests to the route named scope per client
+// IP and per session. Clients over budget get a page asking them to wait. If
+// the store fails, requests are let through.
+func (s *Server) rateLimitMiddleware(store rateLimitStore, scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		log := withTrace(ctx.Request.Context(), s.Log)
+		now := time.Now()
+
+		var wait time.Duration
+		check := func(kind, key string, b RateBudget) {
+			if !b.enabled() || wait > 0 {
+				return
+			}
+			w, err := store.take(ctx.Request.Context(), kind+":"+scope+":"+key, b, now)
+			if err != nil {
+				log.Error().Err(err).Str("scope", scope).Str("kind", kind).Msg("failed to check rate limit")
+				return
+			}
+			if w > 0 {
+				metricRateLimitRejected.WithLabelValues(scope, kind).Inc()
+				log.Warn().Str("scope", scope).Str("kind", kind).Str("key", key).Dur("wait", w).Msg("rate limit exceeded")
+				wait = w
+			}
+		}
+
+		check("ip", clientIP(ctx), s.RateLimitConfig.PerIP)
+		if s.RateLimitConfig.PerSession.enabled() && wait == 0 {
+			if id, err := rateLimitSessionID(ctx); err != nil {
+				log.Error().Err(err).Str("scope", scope).Msg("failed to create session ID")
+			} else {
+				check("session", id, s.RateLimitConfig.PerSession)
+			}
+		}
+		if wait == 0 {
+			ctx.Next()
+			return
+		}
+
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		pageContent := gin.H{"wait": seconds}
+		if uname := sessions.Default(ctx).Get(sessionUserName); uname != nil {
+			pageContent["username"] = uname
+		}
+		renderHTML(ctx, http.StatusTooManyRequests, "ratelimit.gohtml", pageContent)
+		ctx.Abort()
+	}
+}
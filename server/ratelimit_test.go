@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateBudgetTake(t *testing.T) {
+	b := RateBudget{Tokens: 2, Per: 2 * time.Second}
+	start := time.Now()
+	tests := []struct {
+		name       string
+		tokens     float64
+		at         time.Time
+		wantTokens float64
+		wantWait   time.Duration
+	}{
+		{name: "full", tokens: 2, at: start, wantTokens: 1},
+		{name: "last token", tokens: 1, at: start, wantTokens: 0},
+		{name: "empty", tokens: 0, at: start, wantTokens: 0, wantWait: time.Second},
+		{name: "partly refilled", tokens: 0, at: start.Add(500 * time.Millisecond), wantTokens: 0.5, wantWait: 500 * time.Millisecond},
+		{name: "refilled", tokens: 0, at: start.Add(time.Second), wantTokens: 0},
+		{name: "capped", tokens: 1, at: start.Add(time.Hour), wantTokens: 1},
+		{name: "clock went back", tokens: 0, at: start.Add(-time.Second), wantTokens: 0, wantWait: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, wait := b.take(tt.tokens, start, tt.at)
+			if tokens != tt.wantTokens || wait != tt.wantWait {
+				t.Errorf("take() = %v, %v, want %v, %v", tokens, wait, tt.wantTokens, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestRateLimitStores(t *testing.T) {
+	for name, store := range map[string]rateLimitStore{
+		"memory": newMemoryRateLimitStore(),
+		"db":     &dbRateLimitStore{db: newTestDB(t)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := RateBudget{Tokens: 2, Per: time.Minute}
+			// The DB keeps microseconds.
+			now := time.Now().Truncate(time.Microsecond)
+			take := func(key string, at time.Time) time.Duration {
+				t.Helper()
+				wait, err := store.take(t.Context(), key, b, at)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return wait
+			}
+
+			for i := range b.Tokens {
+				if wait := take("a", now); wait != 0 {
+					t.Fatalf("take %d of a: wait %v, want none", i, wait)
+				}
+			}
+			if wait := take("a", now); wait != 30*time.Second {
+				t.Errorf("take of the empty a: wait %v, want %v", wait, 30*time.Second)
+			}
+			if wait := take("b", now); wait != 0 {
+				t.Errorf("take of b: wait %v, want none as it has its own bucket", wait)
+			}
+			// A token is refilled after Per/Tokens.
+			if wait := take("a", now.Add(30*time.Second)); wait != 0 {
+				t.Errorf("take of the refilled a: wait %v, want none", wait)
+			}
+			if wait := take("a", now.Add(30*time.Second)); wait == 0 {
+				t.Error("take of the empty a: no wait")
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{name: "direct", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "untrusted peer", remote: "10.0.0.1:1234", xff: "10.0.0.2", want: "10.0.0.1"},
+		{name: "trusted proxy", trusted: []string{"192.0.2.1"}, remote: "192.0.2.1:1234", xff: "10.0.0.2", want: "10.0.0.2"},
+		{name: "spoofed by the client", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.1:1234", xff: "10.0.0.3, 10.0.0.2", want: "10.0.0.2"},
+		{name: "chain of proxies", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.1:1234", xff: "10.0.0.2, 192.0.2.2", want: "10.0.0.2"},
+		{name: "IPv6", remote: "[2001:db8::1]:1234", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, r := gin.CreateTestContext(httptest.NewRecorder())
+			r.RemoteIPHeaders = []string{"X-Forwarded-For"}
+			if err := r.SetTrustedProxies(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			ctx.Request.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				ctx.Request.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(ctx); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitPerSession(t *testing.T) {
+	env := newTestEnv(t)
+	env.S.RateLimitConfig.PerSession = RateBudget{Tokens: 1, Per: time.Minute}
+
+	// The budget of the session applies before the login.
+	b := env.newBrowser(t)
+	if resp, page := b.get(t, "/login"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first login: %s:\n%s", resp.Status, page)
+	}
+	resp, page := b.get(t, "/login")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("second login: %s, Retry-After %q, want %d:\n%s", resp.Status, resp.Header.Get("Retry-After"), http.StatusTooManyRequests, page)
+	}
+
+	// Other sessions of the same IP have their own budget.
+	if resp, page := env.newBrowser(t).get(t, "/login"); resp.StatusCode != http.StatusOK {
+		t.Errorf("login of another session: %s:\n%s", resp.Status, page)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// dbPingTimeout bounds a single attempt to reach the DB.
+const dbPingTimeout = 5 * time.Second
+
+// Backoff configures how dependencies are retried at startup.
+type Backoff struct {
+	// Initial is the delay after the first failed attempt. It doubles with
+	// every further attempt up to Max.
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// permanentError stops the retries of Backoff.retry, see Permanent.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as one which retrying does not fix, e.g. a schema which
+// is behind while migrations are applied by hand.
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// retry calls fn until it succeeds or ctx is done, waiting with exponential
+// backoff and jitter in between. It returns an error if ctx is done or fn
+// failed with a Permanent one.
+func (b Backoff) retry(ctx context.Context, log zerolog.Logger, what string, fn func(ctx context.Context) error) error {
+	delay := b.Initial
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return fmt.Errorf("failed to %s: %w", what, permanent.err)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("gave up to %s: %w", what, ctx.Err())
+		}
+
+		// Up to 20% jitter, so replicas do not retry in lockstep.
+		wait := delay + rand.N(delay/5+1)
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", wait).Msgf("Failed to %s, retrying.", what)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up to %s: %w", what, ctx.Err())
+		}
+		delay = min(2*delay, b.Max)
+	}
+}
+
+// ConnectDB waits until the DB is reachable and prepare succeeded, retrying
+// both with backoff. prepare is meant to migrate and check the schema. It
+// returns an error if ctx is done or prepare failed with a Permanent one.
+func (s *Server) ConnectDB(ctx context.Context, backoff Backoff, prepare func(ctx context.Context) error) error {
+	err := backoff.retry(ctx, s.Log, "prepare the database", func(ctx context.Context) error {
+		pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+		defer cancel()
+		if err := s.DB.PingContext(pingCtx); err != nil {
+			return fmt.Errorf("failed to reach DB: %w", err)
+		}
+		return prepare(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	s.dbReady.Store(true)
+	s.Log.Info().Msg("Database is ready.")
+	return nil
+}
+
+// dependenciesReady reports whether the DB and the OIDC provider are usable.
+func (s *Server) dependenciesReady() bool {
+	return s.dbReady.Load() && s.OIDCProvider.Ready()
+}
+
+// maintenanceMiddleware shows a maintenance page instead of the portal until
+// the dependencies are ready.
+func (s *Server) maintenanceMiddleware(ctx *gin.Context) {
+	if s.dependenciesReady() {
+		ctx.Next()
+		return
+	}
+	ctx.Header("Retry-After", strconv.Itoa(int(s.StartupBackoff.Max.Seconds())))
+	renderHTML(ctx, http.StatusServiceUnavailable, "maintenance.gohtml", gin.H{})
+	ctx.Abort()
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestConnectDB(t *testing.T) {
+	errTransient := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "ready", wantCalls: 1},
+		{name: "transient errors are retried", errs: []error{errTransient, errTransient}, wantCalls: 3},
+		{name: "permanent errors are not", errs: []error{errTransient, Permanent(ErrSchemaBehind)}, wantErr: ErrSchemaBehind, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.S.dbReady.Store(false)
+
+			var calls int
+			err := env.S.ConnectDB(t.Context(), env.S.StartupBackoff, func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("ConnectDB() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("prepare called %d times, want %d", calls, tt.wantCalls)
+			}
+			if ready := env.S.dbReady.Load(); ready != (tt.wantErr == nil) {
+				t.Errorf("DB ready = %t, want %t", ready, tt.wantErr == nil)
+			}
+		})
+	}
+}
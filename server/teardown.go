@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// auditActorTeardown is the actor of the teardown in the audit log.
+const auditActorTeardown = "system:teardown"
+
+// RunEventTeardown tears down ended events every TeardownInterval until ctx
+// is done, see closeEvent. It does nothing if no captive VLAN is configured.
+func (s *Server) RunEventTeardown(ctx context.Context) {
+	if s.EventConfig.CaptiveVLAN == 0 {
+		s.Log.Info().Msg("No captive VLAN configured, ended events are not torn down.")
+		return
+	}
+
+	ticker := time.NewTicker(s.EventConfig.TeardownInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.dbReady.Load() {
+			continue
+		}
+		if err := s.teardownEvents(ctx, time.Now()); err != nil {
+			s.Log.Error().Err(err).Msg("Failed to tear down ended events.")
+		}
+	}
+}
+
+// teardownEvents closes all events which ended before now and are not closed
+// yet.
+func (s *Server) teardownEvents(ctx context.Context, now time.Time) error {
+	events, err := s.listEvents(ctx)
+	if err != nil {
+		return err
+	}
+	events = append(events, s.defaultEvent())
+
+	var errs []error
+	for _, ev := range events {
+		if !ev.EndsAt.Valid || now.Before(ev.EndsAt.Time) {
+			continue
+		}
+		if err := s.closeEvent(ctx, ev, now); err != nil {
+			errs = append(errs, fmt.Errorf("event %q: %w", ev.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeEvent bounces all devices patched during ev back into the captive
+// VLAN and marks the event closed. Every end of an event is closed once, even
+// with several replicas. The devices of an event without a start cannot be
+// told from those of earlier events, it is closed without bouncing any. The
+// sessions of the event are revoked by sessionExpiryMiddleware.
+func (s *Server) closeEvent(ctx context.Context, ev *event, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.closeEvent", s.DB.dialect.q.insertEventClosure)
+	defer func() { endSpan(span, err) }()
+	q := s.DB.dialect.q
+
+	var n int
+	if err = s.DB.QueryRowContext(ctx, q.hasEventClosure, ev.ID, ev.EndsAt.Time).Scan(&n); err != nil {
+		return fmt.Errorf("failed to get event closure: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Another replica closing the event at the same time fails here.
+	if _, err = tx.ExecContext(ctx, q.insertEventClosure, ev.ID, ev.EndsAt.Time, now); err != nil {
+		return fmt.Errorf("failed to close event: %w", err)
+	}
+
+	// The devices patched since the start of the event, or since its
+	// previous end if it was extended after a teardown, are bounced unless
+	// they were disconnected since.
+	var since sql.NullTime
+	if err = tx.QueryRowContext(ctx, q.lastEventClosure, ev.ID, ev.EndsAt.Time).Scan(&since); err != nil {
+		return fmt.Errorf("failed to get previous event closure: %w", err)
+	}
+	if ev.StartsAt.Valid && (!since.Valid || ev.StartsAt.Time.After(since.Time)) {
+		since = ev.StartsAt
+	}
+	log := withTrace(ctx, s.Log)
+	var macs []string
+	if since.Valid {
+		if macs, err = s.listPatchedMACs(ctx, tx, ev, since.Time); err != nil {
+			return err
+		}
+	} else {
+		log.Warn().Str("event", ev.Name).Msg("Event has no start, its devices are not bounced.")
+	}
+
+	events := make([]outboxEvent, len(macs))
+	for i, mac := range macs {
+		if _, err = tx.ExecContext(ctx, q.insertBounceJob, mac, s.EventConfig.CaptiveVLAN, ev.dbID()); err != nil {
+			return fmt.Errorf("failed to create bounce job: %w", err)
+		}
+		events[i] = outboxEvent{webhookBounceCreated, webhookBounce{MAC: mac, TargetVLAN: s.EventConfig.CaptiveVLAN}}
+	}
+	if err = s.queueEvents(ctx, tx, now, events...); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, q.updateEventClosure, len(macs), ev.ID, ev.EndsAt.Time); err != nil {
+		return fmt.Errorf("failed to update event closure: %w", err)
+	}
+	err = s.writeAuditEntry(ctx, tx, auditEntry{
+		Actor:  auditActorTeardown,
+		Action: auditActionCloseEvent,
+		Target: ev.Name,
+		Detail: fmt.Sprintf("event_id=%d ends_at=%s devices=%d captive_vlan=%d", ev.ID, ev.EndsAt.Time.Format(time.RFC3339), len(macs), s.EventConfig.CaptiveVLAN),
+		Reason: "event ended",
+	})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit event closure: %w", err)
+	}
+
+	log.Info().Str("event", ev.Name).Int("devices", len(macs)).Msg("Closed event, devices are bounced back to the captive VLAN.")
+	return nil
+}
+
+// listPatchedMACs returns the MACs of the devices patched for ev since since
+// which were not disconnected since.
+func (s *Server) listPatchedMACs(ctx context.Context, tx *sql.Tx, ev *event, since time.Time) ([]string, error) {
+	q := s.DB.dialect.q
+	query, args := q.listPatchedMACsOfEvent, []any{ev.ID, since}
+	if ev.ID == 0 {
+		query, args = q.listPatchedMACsOfDefaultEvent, []any{since}
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list patched devices: %w", err)
+	}
+	defer rows.Close()
+	var macs []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			return nil, fmt.Errorf("failed to read patched device: %w", err)
+		}
+		macs = append(macs, mac)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list patched devices: %w", err)
+	}
+	return macs, nil
+}
+
+// sessionExpiryMiddleware ends the sessions which started before the end of
+// the current event once it is over.
+func (s *Server) sessionExpiryMiddleware(ctx *gin.Context) {
+	session := sessions.Default(ctx)
+	ev := currentEvent(ctx)
+	if session.Get(sessionUserSub) == nil || !ev.EndsAt.Valid || time.Now().Before(ev.EndsAt.Time) {
+		ctx.Next()
+		return
+	}
+
+	loginAt, _ := session.Get(sessionLoginAt).(int64)
+	if loginAt < ev.EndsAt.Time.Unix() {
+		withTrace(ctx.Request.Context(), s.Log).Info().
+			Str("username", fmt.Sprint(session.Get(sessionUserName))).
+			Str("event", ev.Name).
+			Msg("Session revoked, the event is over.")
+		session.Clear()
+		if err := session.Save(); err != nil {
+			withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to revoke session")
+		}
+	}
+	ctx.Next()
+}
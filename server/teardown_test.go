@@ -0,0 +1,177 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPatchOutsideEventWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end time.Duration
+		msg        string
+	}{
+		{name: "not started", start: time.Hour, msg: "has not started yet"},
+		{name: "over", start: -2 * time.Hour, end: -time.Hour, msg: "is over"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			insertEvent(t, env.S.DB, "SideLAN", "", "127.0.0.0/8", tt.start, tt.end)
+			b := env.newBrowser(t)
+
+			page := b.login(t)
+			resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+			if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, tt.msg) {
+				t.Errorf("POST /patch: %s, want %d with %q:\n%s", resp.Status, http.StatusForbidden, tt.msg, page)
+			}
+			if env.Geco.Requests.Load() != 0 {
+				t.Errorf("GeCo got %d requests, want 0", env.Geco.Requests.Load())
+			}
+			if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+				t.Errorf("bounce jobs = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestEventTeardown(t *testing.T) {
+	env := newTestEnv(t)
+	id := insertEvent(t, env.S.DB, "SideLAN", "", "127.0.0.0/8", -time.Hour, time.Hour)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	// Nothing is torn down during the event.
+	if err := env.S.teardownEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 {
+		t.Fatalf("bounce jobs = %v, want the one of the patch", got)
+	}
+
+	// The login time is kept in seconds, the event ends in the next one.
+	end := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(end))
+	if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE events SET ends_at = ? WHERE id = ?;`, end, id); err != nil {
+		t.Fatal(err)
+	}
+	// Closing is idempotent.
+	for range 2 {
+		if err := env.S.teardownEvents(t.Context(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []bounceJob{{mac: fixtureMAC, vlan: fixtureVLAN}, {mac: fixtureMAC, vlan: testCaptiveVLAN}}
+	if got := bounceJobs(t, env.S.DB); len(got) != 2 || got[1] != want[1] {
+		t.Errorf("bounce jobs = %v, want %v", got, want)
+	}
+	var devices int
+	if err := env.S.DB.QueryRowContext(t.Context(), `SELECT devices FROM event_closures WHERE event_id = ?;`, id).Scan(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if devices != 1 {
+		t.Errorf("closure records %d devices, want 1", devices)
+	}
+
+	// The session of the event is revoked.
+	resp, _ := b.get(t, "/patch")
+	if resp.Request.URL.Path != "/" {
+		t.Errorf("GET /patch after the event ended on %s, want /", resp.Request.URL.Path)
+	}
+}
+
+func TestEventTeardownWithoutStart(t *testing.T) {
+	env := newTestEnv(t)
+	id := insertEvent(t, env.S.DB, "SideLAN", "", "127.0.0.0/8", 0, time.Hour)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+	end := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(end))
+	if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE events SET ends_at = ? WHERE id = ?;`, end, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a start, every device ever patched for the event would be
+	// bounced. The end is closed without bouncing any, once.
+	for range 2 {
+		if err := env.S.teardownEvents(t.Context(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 {
+		t.Fatalf("bounce jobs = %v, want the one of the patch", got)
+	}
+	var closures, devices int
+	if err := env.S.DB.QueryRowContext(t.Context(), `SELECT COUNT(*), SUM(devices) FROM event_closures WHERE event_id = ?;`, id).Scan(&closures, &devices); err != nil {
+		t.Fatal(err)
+	}
+	if closures != 1 || devices != 0 {
+		t.Errorf("closures = %d with %d devices, want one with 0", closures, devices)
+	}
+	entries, err := env.S.listAuditEntries(t.Context(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].Action != auditActionCloseEvent || !strings.Contains(entries[0].Detail, "devices=0") {
+		t.Errorf("audit entries = %+v, want the closure of the event", entries)
+	}
+
+	// The earlier end bounds the devices of the extended event.
+	end = time.Now().Truncate(time.Second).Add(2 * time.Second)
+	if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE events SET ends_at = ? WHERE id = ?;`, end, id); err != nil {
+		t.Fatal(err)
+	}
+	b = env.newBrowser(t)
+	page = b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+	time.Sleep(time.Until(end))
+	if err := env.S.teardownEvents(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 3 || got[2].vlan != testCaptiveVLAN {
+		t.Errorf("bounce jobs = %v, want the patched device bounced into the captive VLAN", got)
+	}
+}
+
+func TestEventTeardownSkipsDisconnected(t *testing.T) {
+	env := newTestEnv(t)
+	id := insertEvent(t, env.S.DB, "SideLAN", "", "127.0.0.0/8", -time.Hour, time.Hour)
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+	_, page = b.get(t, "/")
+	if resp, page := b.post(t, "/logout", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /logout: %s:\n%s", resp.Status, page)
+	}
+
+	// The DB may round the end up to the second.
+	if _, err := env.S.DB.ExecContext(t.Context(), `UPDATE events SET ends_at = ? WHERE id = ?;`, time.Now(), id); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.S.teardownEvents(t.Context(), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 2 {
+		t.Errorf("bounce jobs = %v, want those of the patch and the disconnect", got)
+	}
+	var devices int
+	if err := env.S.DB.QueryRowContext(t.Context(), `SELECT devices FROM event_closures WHERE event_id = ?;`, id).Scan(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if devices != 0 {
+		t.Errorf("closure records %d devices, want none", devices)
+	}
+}
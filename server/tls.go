@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// certReloader serves a certificate loaded from cert/key files and reloads
+// it when the files change on disk, e.g. when cert-manager renews a mounted
+// secret.
+type certReloader struct {
+	log      zerolog.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(log zerolog.Logger, certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair if either file changed since the last load and
+// reports whether it did.
+func (r *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat key: %w", err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	r.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the files every interval until ctx is cancelled. A failed
+// reload keeps serving the previous certificate.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			r.log.Error().Err(err).Str("cert", r.certFile).Str("key", r.keyFile).Msg("Failed to reload TLS certificate, keeping the current one.")
+			continue
+		}
+		if reloaded {
+			r.log.Info().Str("cert", r.certFile).Msg("Reloaded TLS certificate.")
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
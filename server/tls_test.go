@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestKeyPair returns the PEM encoded self-signed certificate and key of
+// the common name cn.
+func newTestKeyPair(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeKeyPair writes the key pair with the modification time mod, which must
+// change for the reloader to notice.
+func writeKeyPair(t *testing.T, certFile, keyFile string, certPEM, keyPEM []byte, mod time.Time) {
+	t.Helper()
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	env := newTestEnv(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	oldCert, oldKey := newTestKeyPair(t, "old.example")
+	newCert, newKey := newTestKeyPair(t, "new.example")
+	badCert, _ := newTestKeyPair(t, "bad.example")
+	mod := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, oldCert, oldKey, mod)
+	env.S.HTTPConfig.TLSCertFile, env.S.HTTPConfig.TLSKeyFile = certFile, keyFile
+	env.S.HTTPConfig.TLSReloadInterval = 20 * time.Millisecond
+	env.S.HTTPConfig.ShutdownTimeout = time.Second
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error, 1)
+	go func() { served <- env.S.ListenAndServe(ctx, addr) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("ListenAndServe() = %v", err)
+		}
+	}()
+
+	// servedName returns the common name of the certificate served.
+	servedName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	// waitFor waits up to a few reload intervals for the certificate of cn.
+	waitFor := func(cn string) string {
+		deadline := time.Now().Add(50 * env.S.HTTPConfig.TLSReloadInterval)
+		for {
+			got := servedName()
+			if got == cn || time.Now().After(deadline) {
+				return got
+			}
+			time.Sleep(env.S.HTTPConfig.TLSReloadInterval)
+		}
+	}
+	if got := waitFor("old.example"); got != "old.example" {
+		t.Fatalf("served %q, want old.example", got)
+	}
+
+	// A renewed key pair is picked up.
+	mod = mod.Add(time.Minute)
+	writeKeyPair(t, certFile, keyFile, newCert, newKey, mod)
+	if got := waitFor("new.example"); got != "new.example" {
+		t.Fatalf("served %q after the renewal, want new.example", got)
+	}
+
+	// A certificate not matching the key keeps the current one.
+	mod = mod.Add(time.Minute)
+	writeKeyPair(t, certFile, keyFile, badCert, newKey, mod)
+	time.Sleep(5 * env.S.HTTPConfig.TLSReloadInterval)
+	if got := servedName(); got != "new.example" {
+		t.Errorf("served %q after a bad key pair, want new.example", got)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/VSETH-GECO/login-ng/server"
+
+// ServiceName is the name the app reports to the tracing backend.
+const ServiceName = "login-ng"
+
+var tracer = otel.Tracer(tracerName)
+
+// SetupTracing installs a global tracer provider exporting spans via OTLP/HTTP
+// to the given collector URL, e.g. http://localhost:4318. The returned
+// function flushes and stops the exporter.
+func SetupTracing(ctx context.Context, endpointURL string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpointURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
+
+// TraceHook adds the trace and span ID of the event's context to log lines.
+// Loggers get a context with zerolog.Context.Ctx, see withTrace.
+type TraceHook struct{}
+
+func (TraceHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	sc := trace.SpanContextFromContext(e.GetCtx())
+	if !sc.IsValid() {
+		return
+	}
+	e.Str("trace_id", sc.TraceID().String()).Str("span_id", sc.SpanID().String())
+}
+
+// withTrace returns a logger whose lines are correlated with the span in ctx.
+func withTrace(ctx context.Context, log zerolog.Logger) *zerolog.Logger {
+	l := log.With().Ctx(ctx).Logger()
+	return &l
+}
+
+// startSpan starts a client span for a database statement.
+func (d db) startSpan(ctx context.Context, name, statement string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			d.dialect.system,
+			semconv.DBQueryText(statement),
+		),
+	)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
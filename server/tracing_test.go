@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver is an OTLP/HTTP collector recording the spans exported to it.
+type otlpReceiver struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func newOTLPReceiver(t *testing.T) *otlpReceiver {
+	t.Helper()
+	rcv := &otlpReceiver{}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rcv.mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				rcv.spans = append(rcv.spans, ss.Spans...)
+			}
+		}
+		rcv.mu.Unlock()
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(resp)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// traces returns the received spans by trace ID.
+func (rcv *otlpReceiver) traces() map[string][]*tracepb.Span {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	traces := make(map[string][]*tracepb.Span)
+	for _, s := range rcv.spans {
+		id := hex.EncodeToString(s.TraceId)
+		traces[id] = append(traces[id], s)
+	}
+	return traces
+}
+
+// syncBuffer is a log writer safe for concurrent requests.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// spanIn returns the first span of spans matching match.
+func spanIn(spans []*tracepb.Span, match func(*tracepb.Span) bool) *tracepb.Span {
+	for _, s := range spans {
+		if match(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// hasAttr reports whether span has the string attribute key containing value.
+func hasAttr(span *tracepb.Span, key, value string) bool {
+	for _, a := range span.Attributes {
+		if a.Key == key && strings.Contains(a.Value.GetStringValue(), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTracing(t *testing.T) {
+	rcv := newOTLPReceiver(t)
+	shutdown, err := SetupTracing(t.Context(), rcv.URL+"/v1/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The provider is global, later tests must not export to the closed
+	// receiver.
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	// The router is set up with the provider installed.
+	env := newTestEnv(t)
+	logs := &syncBuffer{}
+	env.S.Log = env.S.Log.Output(logs).Hook(TraceHook{})
+	env.S.OIDCProvider.log = env.S.OIDCProvider.log.Output(logs).Hook(TraceHook{})
+
+	b := env.newBrowser(t)
+	form := url.Values{csrfFormField: {csrfTokenFrom(t, b.login(t))}}
+	// The refusal is logged.
+	env.Geco.Status.Store(http.StatusUnprocessableEntity)
+	if resp, page := b.post(t, "/patch", form); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("POST /patch before the check-in: %s:\n%s", resp.Status, page)
+	}
+	env.Geco.Status.Store(http.StatusOK)
+	if resp, page := b.post(t, "/patch", form); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+
+	// Flushes the exporter.
+	if err := shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	traces := rcv.traces()
+
+	isRequest := func(method, route string) func(*tracepb.Span) bool {
+		return func(s *tracepb.Span) bool {
+			return s.Kind == tracepb.Span_SPAN_KIND_SERVER && hasAttr(s, "http.request.method", method) && hasAttr(s, "http.route", route)
+		}
+	}
+	var callback, patch []*tracepb.Span
+	for _, spans := range traces {
+		switch {
+		case spanIn(spans, isRequest(http.MethodGet, "/callback")) != nil:
+			callback = spans
+		case spanIn(spans, isRequest(http.MethodPost, "/patch")) != nil &&
+			spanIn(spans, func(s *tracepb.Span) bool { return s.Name == "db.createNewBounceJob" }) != nil:
+			patch = spans
+		}
+	}
+	if callback == nil || patch == nil {
+		t.Fatalf("received %d traces, want those of GET /callback and the successful POST /patch", len(traces))
+	}
+
+	if spanIn(callback, func(s *tracepb.Span) bool { return s.Name == "oidc.Exchange" }) == nil {
+		t.Error("no OIDC exchange span in the trace of /callback")
+	}
+	gecoHost := strings.TrimPrefix(env.Geco.URL, "http://")
+	if spanIn(patch, func(s *tracepb.Span) bool {
+		return s.Kind == tracepb.Span_SPAN_KIND_CLIENT && hasAttr(s, "url.full", gecoHost)
+	}) == nil {
+		t.Error("no GeCo request span in the trace of /patch")
+	}
+	for _, name := range []string{"db.locateUser", "db.createNewBounceJob"} {
+		if spanIn(patch, func(s *tracepb.Span) bool { return s.Name == name && hasAttr(s, "db.system", "mysql") }) == nil {
+			t.Errorf("no %s span in the trace of /patch", name)
+		}
+	}
+
+	// Every log line of a request carries its trace ID.
+	var traced int
+	lines := bufio.NewScanner(strings.NewReader(logs.String()))
+	for lines.Scan() {
+		var line struct {
+			TraceID string `json:"trace_id"`
+			SpanID  string `json:"span_id"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil || line.TraceID == "" {
+			continue
+		}
+		if _, ok := traces[line.TraceID]; !ok || line.SpanID == "" {
+			t.Errorf("log line %s is not correlated with a received trace", lines.Text())
+		}
+		traced++
+	}
+	if traced == 0 {
+		t.Errorf("no log line carries a trace ID:\n%s", logs)
+	}
+}
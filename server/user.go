@@ -1,20 +1,30 @@
 package server
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const (
 	sessionUserSub         = "sub"
 	sessionUserName        = "username"
 	sessionUserAccessToken = "access_token"
+	sessionLoginAt         = "login_at"
+	// The device located when the login started, see bindDeviceMiddleware.
+	sessionDeviceIP     = "device_ip"
+	sessionDeviceMAC    = "device_mac"
+	sessionDeviceSwitch = "device_switch"
+	// The device last patched and when, see progressHandler.
+	sessionBounceMAC = "bounce_mac"
+	sessionBounceAt  = "bounce_at"
 )
 
 type GecoAPIConfig struct {
@@ -22,18 +32,24 @@ type GecoAPIConfig struct {
 	UserstatusEndpointFmt string
 }
 
-// see https://geco.ethz.ch/api/v1#/paths/api-v1-lan_parties-id--me/get
-func (s *Server) userIsCheckedin(ctx *gin.Context) error {
+// gecoHTTPClient returns the client for the GeCo API, created once so its
+// connections are reused. The calls show up as child spans of the request.
+func (s *Server) gecoHTTPClient() *http.Client {
+	s.gecoClientOnce.Do(func() {
+		s.gecoClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	})
+	return s.gecoClient
+}
+
+// userIsCheckedin asks GeCo whether the user checked in at ev, see
+// https://geco.ethz.ch/api/v1#/paths/api-v1-lan_parties-id--me/get
+func (s *Server) userIsCheckedin(ctx *gin.Context, ev *event) error {
 	session := sessions.Default(ctx)
 	sub := session.Get(sessionUserSub).(string)
-	log := s.Log.With().Str("sub", sub).Logger()
-
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{},
-	}}
+	log := withTrace(ctx.Request.Context(), s.Log).With().Str("sub", sub).Logger()
 
 	accessToken := session.Get(sessionUserAccessToken).(string)
-	userstatusURL := fmt.Sprintf(s.GecoAPIConfig.UserstatusEndpointFmt, s.GecoAPIConfig.LanID)
+	userstatusURL := fmt.Sprintf(ev.UserstatusEndpointFmt, ev.LanID)
 	req, err := http.NewRequestWithContext(ctx.Request.Context(), http.MethodGet, userstatusURL, nil)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to create user status request")
@@ -42,11 +58,14 @@ func (s *Server) userIsCheckedin(ctx *gin.Context) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := s.gecoHTTPClient().Do(req)
 	if err != nil {
+		metricGecoStatusDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
 		log.Error().Err(err).Msg("Failed to send user status request.")
 		return err
 	}
+	metricGecoStatusDuration.WithLabelValues(strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// voucherAlphabet leaves out 0, O, 1 and I, which are easily confused
+	// on paper. Its 32 letters keep the codes uniformly distributed.
+	voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// voucherCodeLength gives 50 random bits per code.
+	voucherCodeLength = 10
+	// maxVoucherBatchSize limits the vouchers created at once.
+	maxVoucherBatchSize = 500
+	// voucherBatchPageSize is the number of batches listed on the admin page.
+	voucherBatchPageSize = 20
+
+	// voucherUsernamePrefix marks devices patched with a voucher in the
+	// login log, e.g. "voucher:ABCDEFGHJK".
+	voucherUsernamePrefix = "voucher:"
+)
+
+// errInvalidVoucher is returned for vouchers which do not exist, are expired
+// or used up.
+var errInvalidVoucher = errors.New("invalid voucher")
+
+// voucherBatch is a set of vouchers created at once for a group of guests,
+// e.g. the press or a caterer.
+type voucherBatch struct {
+	ID        string
+	CreatedAt time.Time
+	CreatedBy string
+	Label     string
+	// MaxUses is 1 for one-time vouchers and 0 for any number of uses.
+	MaxUses    int
+	ValidUntil sql.NullTime
+	// VLAN overrides the VLAN of the switch if valid.
+	VLAN sql.NullInt32
+
+	// Count and Used are the number of vouchers and how many were redeemed.
+	Count int
+	Used  int
+}
+
+// voucher is a single code of a batch.
+type voucher struct {
+	Code string
+	Uses int
+}
+
+// Formatted returns the code as printed, e.g. "ABCDE-FGHJK".
+func (v voucher) Formatted() string {
+	return formatVoucherCode(v.Code)
+}
+
+// VoucherBatchRequest asks for a batch of vouchers.
+type VoucherBatchRequest struct {
+	Label string
+	Count int
+	// OneTime vouchers can be redeemed for a single device only.
+	OneTime bool
+	// ValidFor limits how long the vouchers can be redeemed, 0 for no limit.
+	ValidFor time.Duration
+	// VLAN is the VLAN the devices are patched into, 0 for the switch's one.
+	VLAN int
+	// Actor is recorded in the audit log.
+	Actor string
+}
+
+// newVoucherCode returns a random code of voucherAlphabet.
+func newVoucherCode() (string, error) {
+	b := make([]byte, voucherCodeLength)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = voucherAlphabet[int(b[i])%len(voucherAlphabet)]
+	}
+	return string(b), nil
+}
+
+// normalizeVoucherCode accepts codes as typed by users, in any case and with
+// dashes or spaces.
+func normalizeVoucherCode(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(s)))
+}
+
+func formatVoucherCode(code string) string {
+	if len(code) != voucherCodeLength {
+		return code
+	}
+	return code[:voucherCodeLength/2] + "-" + code[voucherCodeLength/2:]
+}
+
+// createVoucherBatch creates the vouchers of req and records it in the audit
+// log.
+func (s *Server) createVoucherBatch(ctx context.Context, req VoucherBatchRequest) (batchID string, err error) {
+	label := strings.TrimSpace(req.Label)
+	switch {
+	case label == "":
+		return "", &userError{"A label is required.", errors.New("empty label")}
+	case req.Count < 1 || req.Count > maxVoucherBatchSize:
+		return "", &userError{fmt.Sprintf("Between 1 and %d vouchers can be created at once.", maxVoucherBatchSize), fmt.Errorf("invalid count %d", req.Count)}
+	case !req.OneTime && req.ValidFor <= 0:
+		return "", &userError{"Vouchers must be one-time or time-limited.", errors.New("unlimited vouchers")}
+	case req.VLAN < 0 || req.VLAN > 4094:
+		return "", &userError{"The VLAN must be between 1 and 4094.", fmt.Errorf("invalid VLAN %d", req.VLAN)}
+	case req.Actor == "":
+		return "", errors.New("actor is required")
+	}
+
+	batchID, err = randString(12)
+	if err != nil {
+		return "", err
+	}
+	maxUses := 0
+	if req.OneTime {
+		maxUses = 1
+	}
+	var validUntil sql.NullTime
+	if req.ValidFor > 0 {
+		validUntil = sql.NullTime{Time: time.Now().Add(req.ValidFor), Valid: true}
+	}
+	vlan := sql.NullInt32{Int32: int32(req.VLAN), Valid: req.VLAN != 0}
+
+	ctx, span := s.DB.startSpan(ctx, "db.createVoucherBatch", s.DB.dialect.q.insertVoucher)
+	defer func() { endSpan(span, err) }()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.DB.dialect.q.insertVoucherBatch, batchID, req.Actor, label, maxUses, validUntil, vlan)
+	if err != nil {
+		return "", fmt.Errorf("failed to create voucher batch: %w", err)
+	}
+	for range req.Count {
+		code, err := newVoucherCode()
+		if err != nil {
+			return "", err
+		}
+		if _, err := tx.ExecContext(ctx, s.DB.dialect.q.insertVoucher, code, batchID); err != nil {
+			return "", fmt.Errorf("failed to create voucher: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit voucher batch: %w", err)
+	}
+
+	err = s.createAuditEntry(ctx, auditEntry{
+		Actor:  req.Actor,
+		Action: auditActionCreateVouchers,
+		Target: batchID,
+		Detail: fmt.Sprintf("count=%d max_uses=%d valid_for=%s vlan=%d", req.Count, maxUses, req.ValidFor, req.VLAN),
+		Reason: label,
+	})
+	if err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Str("batch", batchID).Msg("failed to write audit log of voucher batch")
+	}
+	return batchID, nil
+}
+
+// redeemVoucher patches the located device with the voucher code and returns
+// the VLAN, reported as login.succeeded of the voucher user. One-time
+// vouchers are used up, unless patching fails.
+func (s *Server) redeemVoucher(ctx context.Context, ev *event, code string, up *userProperties) (_ int, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.redeemVoucher", s.DB.dialect.q.claimVoucher)
+	defer func() { endSpan(span, err) }()
+	log := withTrace(ctx, s.Log).With().Str("voucher", code).Str("user MAC", up.userMAC).Logger()
+	now := time.Now()
+
+	var (
+		maxUses, uses int
+		validUntil    sql.NullTime
+		vlan          sql.NullInt32
+	)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getVoucher, code).Scan(&maxUses, &validUntil, &vlan, &uses)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &userError{"This voucher code is not valid.", errInvalidVoucher}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get voucher: %w", err)
+	}
+	if validUntil.Valid && now.After(validUntil.Time) {
+		return 0, &userError{"This voucher has expired.", errInvalidVoucher}
+	}
+	if maxUses > 0 && uses >= maxUses {
+		return 0, &userError{"This voucher has already been used.", errInvalidVoucher}
+	}
+
+	// Claim the use seen above, so a one-time voucher is not redeemed twice
+	// concurrently.
+	res, err := s.DB.ExecContext(ctx, s.DB.dialect.q.claimVoucher, now, code, uses)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim voucher: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return 0, &userError{"This voucher is being used right now, please try again.", errInvalidVoucher}
+	}
+
+	username := voucherUsernamePrefix + code
+	login := &webhookLogin{Username: username, IP: up.userIP, Event: ev.Name}
+	targetVLAN, err := s.patchDevice(ctx, ev, up, "", username, int(vlan.Int32), login, nil)
+	if err != nil {
+		if _, rerr := s.DB.ExecContext(ctx, s.DB.dialect.q.releaseVoucher, code); rerr != nil {
+			log.Error().Err(rerr).Msg("failed to release voucher")
+		}
+		return 0, err
+	}
+	log.Info().Int("target VLAN", targetVLAN).Msg("Redeemed voucher.")
+	return targetVLAN, nil
+}
+
+// listVoucherBatches returns the latest limit batches, newest first.
+func (s *Server) listVoucherBatches(ctx context.Context, limit int) (batches []voucherBatch, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listVoucherBatches", s.DB.dialect.q.listVoucherBatches)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listVoucherBatches, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list voucher batches: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b voucherBatch
+		if err := rows.Scan(&b.ID, &b.CreatedAt, &b.CreatedBy, &b.Label, &b.MaxUses, &b.ValidUntil, &b.VLAN, &b.Count, &b.Used); err != nil {
+			return nil, fmt.Errorf("failed to read voucher batch: %w", err)
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// getVoucherBatch returns the batch id with its vouchers.
+func (s *Server) getVoucherBatch(ctx context.Context, id string) (b *voucherBatch, vouchers []voucher, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.getVoucherBatch", s.DB.dialect.q.listVouchers)
+	defer func() { endSpan(span, err) }()
+
+	b = new(voucherBatch)
+	err = s.DB.QueryRowContext(ctx, s.DB.dialect.q.getVoucherBatch, id).
+		Scan(&b.ID, &b.CreatedAt, &b.CreatedBy, &b.Label, &b.MaxUses, &b.ValidUntil, &b.VLAN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get voucher batch: %w", err)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listVouchers, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list vouchers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v voucher
+		if err := rows.Scan(&v.Code, &v.Uses); err != nil {
+			return nil, nil, fmt.Errorf("failed to read voucher: %w", err)
+		}
+		b.Count++
+		if v.Uses > 0 {
+			b.Used++
+		}
+		vouchers = append(vouchers, v)
+	}
+	return b, vouchers, rows.Err()
+}
+
+// voucherHandler redeems a voucher for the device of the client, like
+// patchHandler does for GeCo users.
+func voucherHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		log := withTrace(ctx.Request.Context(), s.Log)
+
+		code := normalizeVoucherCode(ctx.PostForm("code"))
+		if code == "" {
+			renderError(ctx, "index.gohtml", http.StatusUnprocessableEntity, "Please enter your voucher code.")
+			return
+		}
+
+		ev := currentEvent(ctx)
+		if msg := ev.closedMessage(time.Now()); msg != "" {
+			renderError(ctx, "index.gohtml", http.StatusForbidden, msg)
+			return
+		}
+
+		userIP := clientIP(ctx)
+		up, err := s.locateUser(ctx.Request.Context(), userIP)
+		if err != nil {
+			log.Warn().Err(err).Str("user IP", userIP).Msg("failed to find source switch")
+			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Unable to locate the switch the user is connected to.")
+			return
+		}
+
+		_, err = s.redeemVoucher(ctx.Request.Context(), ev, code, up)
+		if err != nil {
+			code, msg := http.StatusInternalServerError, "Failed to patch into the network."
+			if errors.Is(err, errInvalidVoucher) || errors.Is(err, errBlocked) {
+				code = http.StatusForbidden
+				log.Warn().Err(err).Str("user IP", userIP).Msg("voucher rejected")
+			}
+			var ue *userError
+			if errors.As(err, &ue) {
+				msg = ue.msg
+			}
+			renderError(ctx, "index.gohtml", code, msg)
+			return
+		}
+
+		if err := rememberBounce(ctx, up.userMAC); err != nil {
+			log.Warn().Err(err).Msg("failed to save session")
+		}
+		renderHTML(ctx, http.StatusOK, "success.gohtml", gin.H{})
+	}
+}
+
+func adminVouchersPageHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		renderAdminVouchers(ctx, s, http.StatusOK, gin.H{})
+	}
+}
+
+func adminVouchersHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req, err := voucherBatchRequestFromForm(ctx)
+		if err == nil {
+			var id string
+			id, err = s.createVoucherBatch(ctx.Request.Context(), req)
+			if err == nil {
+				ctx.Redirect(http.StatusSeeOther, "/admin/vouchers/"+id)
+				return
+			}
+		}
+
+		msg := "Failed to create the vouchers."
+		var ue *userError
+		if errors.As(err, &ue) {
+			msg = ue.msg
+		} else {
+			withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to create vouchers")
+		}
+		renderAdminVouchers(ctx, s, http.StatusUnprocessableEntity, gin.H{"error": msg})
+	}
+}
+
+func voucherBatchRequestFromForm(ctx *gin.Context) (VoucherBatchRequest, error) {
+	actor, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+	req := VoucherBatchRequest{
+		Label:   ctx.PostForm("label"),
+		OneTime: ctx.PostForm("one_time") != "",
+		Actor:   actor,
+	}
+	var err error
+	if req.Count, err = strconv.Atoi(ctx.PostForm("count")); err != nil {
+		return req, &userError{"The number of vouchers must be a number.", err}
+	}
+	if req.VLAN, err = atoiOrZero(ctx.PostForm("vlan")); err != nil {
+		return req, &userError{"The VLAN must be a number.", err}
+	}
+	hours, err := atoiOrZero(ctx.PostForm("valid_hours"))
+	if err != nil {
+		return req, &userError{"The validity must be a number of hours.", err}
+	}
+	req.ValidFor = time.Duration(hours) * time.Hour
+	return req, nil
+}
+
+// adminVoucherBatchHandler shows the vouchers of a batch for printing.
+func adminVoucherBatchHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		batch, vouchers, err := s.getVoucherBatch(ctx.Request.Context(), ctx.Param("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			renderError(ctx, "index.gohtml", http.StatusNotFound, "Voucher batch not found.")
+			return
+		}
+		if err != nil {
+			withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to get voucher batch")
+			renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+			return
+		}
+		renderHTML(ctx, http.StatusOK, "admin_vouchers_print.gohtml", gin.H{
+			"batch":    batch,
+			"vouchers": vouchers,
+		})
+	}
+}
+
+// renderAdminVouchers renders the voucher form with the latest batches.
+func renderAdminVouchers(ctx *gin.Context, s *Server, code int, pageContent gin.H) {
+	token, err := csrfToken(ctx)
+	if err != nil {
+		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+		return
+	}
+	batches, err := s.listVoucherBatches(ctx.Request.Context(), voucherBatchPageSize)
+	if err != nil {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to list voucher batches")
+	}
+
+	pageContent["username"] = sessions.Default(ctx).Get(sessionUserName)
+	pageContent["csrfToken"] = token
+	pageContent["batches"] = batches
+	renderHTML(ctx, code, "admin_vouchers.gohtml", pageContent)
+}
+
+// atoiOrZero parses an optional number of a form.
+func atoiOrZero(s string) (int, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var voucherCodePattern = regexp.MustCompile(`[A-Z2-9]{5}-[A-Z2-9]{5}`)
+
+// redeem submits code on the index page of a new anonymous browser.
+func (e *testEnv) redeem(t *testing.T, code string) (*http.Response, string) {
+	t.Helper()
+	b := e.newBrowser(t)
+	_, page := b.get(t, "/")
+	return b.post(t, "/voucher", url.Values{csrfFormField: {csrfTokenFrom(t, page)}, "code": {code}})
+}
+
+func TestVoucherFromAdminPage(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.newBrowser(t)
+	admin.login(t)
+
+	_, page := admin.get(t, "/admin/vouchers")
+	resp, page := admin.post(t, "/admin/vouchers", url.Values{
+		csrfFormField: {csrfTokenFrom(t, page)},
+		"label":       {"Press"},
+		"count":       {"3"},
+		"one_time":    {"on"},
+	})
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Request.URL.Path, "/admin/vouchers/") {
+		t.Fatalf("POST /admin/vouchers ended on %s with %s:\n%s", resp.Request.URL, resp.Status, page)
+	}
+	codes := voucherCodePattern.FindAllString(page, -1)
+	if len(codes) != 3 {
+		t.Fatalf("print page shows %d codes, want 3:\n%s", len(codes), page)
+	}
+
+	// Users may type the code in lower case and without the dash.
+	code := codes[0]
+	resp, page = env.redeem(t, strings.ToLower(strings.ReplaceAll(code, "-", "")))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /voucher: %s:\n%s", resp.Status, page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 1 || got[0] != (bounceJob{mac: fixtureMAC, vlan: fixtureVLAN}) {
+		t.Errorf("bounce jobs = %v, want one to VLAN %d", got, fixtureVLAN)
+	}
+	username := voucherUsernamePrefix + normalizeVoucherCode(code)
+	if got := loginLogs(t, env.S.DB)[username]; got != fixtureMAC {
+		t.Errorf("login log of %q has MAC %q, want %q", username, got, fixtureMAC)
+	}
+
+	resp, page = env.redeem(t, code)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, "already been used") {
+		t.Errorf("second POST /voucher: %s, want %d:\n%s", resp.Status, http.StatusForbidden, page)
+	}
+
+	_, page = admin.get(t, "/admin/vouchers")
+	if !strings.Contains(page, "1/3 one-time") {
+		t.Errorf("admin page does not list the used voucher:\n%s", page)
+	}
+}
+
+func TestVoucherRedeem(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      VoucherBatchRequest
+		expire   bool
+		redeems  int
+		wantVLAN int
+		wantErr  string
+	}{
+		{name: "time-limited", req: VoucherBatchRequest{ValidFor: time.Hour}, redeems: 3, wantVLAN: fixtureVLAN},
+		{name: "VLAN", req: VoucherBatchRequest{OneTime: true, VLAN: 42}, redeems: 1, wantVLAN: 42},
+		{name: "expired", req: VoucherBatchRequest{ValidFor: time.Hour}, expire: true, wantErr: "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			tt.req.Label, tt.req.Count, tt.req.Actor = "Catering", 1, "carol"
+			id, err := env.S.createVoucherBatch(t.Context(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expire {
+				_, err := env.S.DB.ExecContext(t.Context(), `UPDATE voucher_batches SET valid_until = ? WHERE id = ?;`, time.Now().Add(-time.Minute), id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, vouchers, err := env.S.getVoucherBatch(t.Context(), id)
+			if err != nil || len(vouchers) != 1 {
+				t.Fatalf("getVoucherBatch() = %v, %v", vouchers, err)
+			}
+			code := vouchers[0].Formatted()
+
+			if tt.wantErr != "" {
+				resp, page := env.redeem(t, code)
+				if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, tt.wantErr) {
+					t.Errorf("POST /voucher: %s, want %d with %q:\n%s", resp.Status, http.StatusForbidden, tt.wantErr, page)
+				}
+				return
+			}
+			for range tt.redeems {
+				if resp, page := env.redeem(t, code); resp.StatusCode != http.StatusOK {
+					t.Fatalf("POST /voucher: %s:\n%s", resp.Status, page)
+				}
+			}
+			jobs := bounceJobs(t, env.S.DB)
+			if len(jobs) != tt.redeems {
+				t.Fatalf("got %d bounce jobs, want %d", len(jobs), tt.redeems)
+			}
+			if jobs[0].vlan != tt.wantVLAN {
+				t.Errorf("bounce job to VLAN %d, want %d", jobs[0].vlan, tt.wantVLAN)
+			}
+			var logins int
+			events := pendingEvents(t, env.S.DB)
+			for _, typ := range events {
+				if typ == webhookLoginSucceeded {
+					logins++
+				}
+			}
+			if logins != tt.redeems {
+				t.Errorf("queued events = %v, want %d %s", events, tt.redeems, webhookLoginSucceeded)
+			}
+		})
+	}
+}
+
+func TestVoucherInvalid(t *testing.T) {
+	env := newTestEnv(t)
+	resp, page := env.redeem(t, "AAAAA-AAAAA")
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(page, "not valid") {
+		t.Errorf("POST /voucher: %s, want %d:\n%s", resp.Status, http.StatusForbidden, page)
+	}
+	if got := bounceJobs(t, env.S.DB); len(got) != 0 {
+		t.Errorf("bounce jobs = %v, want none", got)
+	}
+}
+
+func TestCreateVoucherBatchValidation(t *testing.T) {
+	env := newTestEnv(t)
+	for _, req := range []VoucherBatchRequest{
+		{Count: 1, OneTime: true, Actor: "carol"},
+		{Label: "Press", Count: 0, OneTime: true, Actor: "carol"},
+		{Label: "Press", Count: 1, Actor: "carol"},
+		{Label: "Press", Count: 1, OneTime: true, VLAN: 5000, Actor: "carol"},
+	} {
+		if _, err := env.S.createVoucherBatch(t.Context(), req); err == nil {
+			t.Errorf("createVoucherBatch(%+v) succeeded", req)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// WebhookConfig configures the delivery of webhooks.
+type WebhookConfig struct {
+	// Interval is how often pending deliveries are sent.
+	Interval time.Duration
+	// Timeout bounds every delivery attempt.
+	Timeout time.Duration
+	// MaxAttempts is the number of attempts after which a delivery fails.
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubled on every
+	// further attempt. It must be longer than Timeout, so deliveries in
+	// flight are not sent twice.
+	RetryBackoff time.Duration
+}
+
+// Event types of webhooks.
+const (
+	webhookLoginAuthenticated = "login.authenticated"
+	webhookLoginSucceeded     = "login.succeeded"
+	webhookLoginFailed        = "login.failed"
+	webhookBounceCreated      = "bounce.created"
+	webhookBounceCompleted    = "bounce.completed"
+	webhookBounceFailed       = "bounce.failed"
+	webhookBlocklistHit       = "blocklist.hit"
+)
+
+// webhookEventTypes are the event types webhooks can subscribe to.
+var webhookEventTypes = []string{
+	webhookLoginAuthenticated,
+	webhookLoginSucceeded,
+	webhookLoginFailed,
+	webhookBounceCreated,
+	webhookBounceCompleted,
+	webhookBounceFailed,
+	webhookBlocklistHit,
+}
+
+// Statuses of webhook deliveries.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	// minWebhookSecretLength is the minimum length of the HMAC secrets.
+	minWebhookSecretLength = 16
+	// webhookBatchSize is the most deliveries sent per interval.
+	webhookBatchSize = 50
+	// maxWebhookBackoff caps the delay between attempts.
+	maxWebhookBackoff = time.Hour
+	// webhookLogRetention is how long finished deliveries are kept in the
+	// log.
+	webhookLogRetention = 7 * 24 * time.Hour
+	// webhookPageSize is the number of deliveries listed on the admin page.
+	webhookPageSize = 50
+)
+
+// Headers of webhook requests.
+const (
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookDelivery  = "X-Webhook-Delivery"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+// webhookHTTPClient does not follow redirects, so subscriptions cannot be
+// bounced to internal services.
+var webhookHTTPClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookPayload is the JSON body of every webhook request.
+type webhookPayload struct {
+	// ID is the same for the deliveries of the event to all webhooks.
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// webhookLogin is the data of the login.* events. login.authenticated is sent
+// once the user signed in at the IdP, with the device the login started from
+// if it was located.
+type webhookLogin struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	MAC      string `json:"mac,omitempty"`
+	SwitchIP string `json:"switch_ip,omitempty"`
+	VLAN     int    `json:"vlan,omitempty"`
+	Event    string `json:"event"`
+	// Error is the message shown to the user if the login failed.
+	Error string `json:"error,omitempty"`
+}
+
+// webhookBounce is the data of the bounce.* events. The job ID is only known
+// for jobs of the bouncer queue.
+type webhookBounce struct {
+	JobID      int64  `json:"job_id,omitempty"`
+	MAC        string `json:"mac"`
+	TargetVLAN int    `json:"target_vlan"`
+	Retries    int    `json:"retries,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// webhookBlock is the data of blocklist.hit.
+type webhookBlock struct {
+	BlockID  int64  `json:"block_id"`
+	Action   string `json:"action"`
+	Kind     string `json:"kind"`
+	Value    string `json:"value"`
+	Username string `json:"username"`
+	MAC      string `json:"mac"`
+}
+
+// webhook is a subscription of a URL to event types.
+type webhook struct {
+	ID        int64
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// WebhookRequest asks to subscribe a URL to webhooks.
+type WebhookRequest struct {
+	URL    string
+	Secret string
+	Events []string
+	// Author is recorded with the webhook and in the audit log.
+	Author string
+}
+
+// webhookDelivery is an entry of the delivery log.
+type webhookDelivery struct {
+	ID          int64
+	URL         string
+	EventType   string
+	Status      string
+	Attempts    int
+	LastStatus  sql.NullInt64
+	LastError   sql.NullString
+	CreatedAt   time.Time
+	DeliveredAt sql.NullTime
+}
+
+// dueDelivery is a pending delivery with its webhook.
+type dueDelivery struct {
+	id        int64
+	eventType string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+func scanWebhook(row blockRow) (w webhook, err error) {
+	var events string
+	err = row.Scan(&w.ID, &w.URL, &w.Secret, &events, &w.CreatedBy, &w.CreatedAt)
+	w.Events = strings.Split(events, ",")
+	return w, err
+}
+
+// listWebhooks returns all webhooks, oldest first.
+func (s *Server) listWebhooks(ctx context.Context) (hooks []webhook, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listWebhooks", s.DB.dialect.q.listWebhooks)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listWebhooks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhooks: %w", err)
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// newWebhookPayload encodes an event with a new ID, the body of its webhook
+// deliveries and bus messages.
+func newWebhookPayload(eventType string, data any, now time.Time) (string, error) {
+	id, err := randString(16)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate event ID: %w", err)
+	}
+	payload, err := json.Marshal(webhookPayload{ID: id, Type: eventType, CreatedAt: now, Data: data})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode event: %w", err)
+	}
+	return string(payload), nil
+}
+
+// queueWebhookDeliveries queues payload for every webhook subscribed to
+// eventType with ex, in one statement which selects the webhooks.
+func (s *Server) queueWebhookDeliveries(ctx context.Context, ex execer, eventType, payload string, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.queueWebhookDeliveries", s.DB.dialect.q.insertWebhookDeliveries)
+	defer func() { endSpan(span, err) }()
+	if _, err = ex.ExecContext(ctx, s.DB.dialect.q.insertWebhookDeliveries, eventType, payload, now, eventType); err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// RunWebhooks sends the pending webhook deliveries every Interval until ctx
+// is done.
+func (s *Server) RunWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(s.WebhookConfig.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.dbReady.Load() {
+			continue
+		}
+		if err := s.deliverWebhooks(ctx, time.Now()); err != nil {
+			s.Log.Error().Err(err).Msg("Failed to deliver webhooks.")
+		}
+	}
+}
+
+// deliverWebhooks sends the deliveries due at now concurrently. Every attempt
+// is claimed first, so each is sent by one replica only. The claim schedules
+// the next attempt, which is taken if the delivery fails or this replica dies
+// while sending it.
+func (s *Server) deliverWebhooks(ctx context.Context, now time.Time) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.deliverWebhooks", s.DB.dialect.q.claimWebhookDelivery)
+	defer func() { endSpan(span, err) }()
+	q := s.DB.dialect.q
+
+	if _, err = s.DB.ExecContext(ctx, q.sweepWebhookDeliveries, now.Add(-webhookLogRetention)); err != nil {
+		return fmt.Errorf("failed to sweep webhook deliveries: %w", err)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, q.listDueWebhookDeliveries, now, webhookBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err = rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read webhook deliveries: %w", err)
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+
+	var claimed []dueDelivery
+	for _, d := range due {
+		res, err := s.DB.ExecContext(ctx, q.claimWebhookDelivery, now.Add(s.webhookBackoff(d.attempts+1)), d.id, d.attempts)
+		if err != nil {
+			return fmt.Errorf("failed to claim webhook delivery: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to claim webhook delivery: %w", err)
+		} else if n == 1 {
+			d.attempts++
+			claimed = append(claimed, d)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(claimed))
+	for i, d := range claimed {
+		wg.Go(func() {
+			errs[i] = s.deliverWebhook(ctx, d, now)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// webhookBackoff returns the delay before the attempt after the given one.
+func (s *Server) webhookBackoff(attempt int) time.Duration {
+	d := s.WebhookConfig.RetryBackoff
+	for i := 1; i < attempt && d < maxWebhookBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxWebhookBackoff)
+}
+
+// deliverWebhook sends a claimed delivery and records the outcome.
+func (s *Server) deliverWebhook(ctx context.Context, d dueDelivery, now time.Time) error {
+	status, sendErr := sendWebhook(ctx, d, now, s.WebhookConfig.Timeout)
+
+	outcome, lastError, deliveredAt := deliveryDelivered, sql.NullString{}, sql.NullTime{}
+	switch {
+	case sendErr == nil:
+		deliveredAt = sql.NullTime{Time: time.Now(), Valid: true}
+	case d.attempts >= s.WebhookConfig.MaxAttempts:
+		outcome, lastError = deliveryFailed, sql.NullString{String: sendErr.Error(), Valid: true}
+	default:
+		outcome, lastError = deliveryPending, sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	var lastStatus sql.NullInt64
+	if status != 0 {
+		lastStatus = sql.NullInt64{Int64: int64(status), Valid: true}
+	}
+
+	log := withTrace(ctx, s.Log).With().Int64("delivery", d.id).Str("event type", d.eventType).Int("attempt", d.attempts).Logger()
+	switch outcome {
+	case deliveryDelivered:
+		metricWebhookDeliveries.WithLabelValues(webhookOutcomeDelivered).Inc()
+	case deliveryPending:
+		metricWebhookDeliveries.WithLabelValues(webhookOutcomeRetry).Inc()
+		log.Warn().Err(sendErr).Msg("webhook delivery failed, retrying")
+	case deliveryFailed:
+		metricWebhookDeliveries.WithLabelValues(webhookOutcomeFailed).Inc()
+		log.Error().Err(sendErr).Msg("webhook delivery failed")
+	}
+
+	if _, err := s.DB.ExecContext(ctx, s.DB.dialect.q.finishWebhookDelivery, outcome, lastStatus, lastError, deliveredAt, d.id); err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// sendWebhook posts the payload of d, signed with its secret, and returns the
+// HTTP status. Only 2xx statuses are successful.
+func sendWebhook(ctx context.Context, d dueDelivery, now time.Time, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body := []byte(d.payload)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", ServiceName+"-webhook")
+	req.Header.Set(headerWebhookEvent, d.eventType)
+	req.Header.Set(headerWebhookDelivery, strconv.FormatInt(d.id, 10))
+	req.Header.Set(headerWebhookTimestamp, timestamp)
+	req.Header.Set(headerWebhookSignature, webhookSignature(d.secret, timestamp, body))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookSignature signs the timestamp and body of a request with the secret
+// of the webhook: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body)).
+// Receivers should reject old timestamps to prevent replays.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// addWebhook subscribes a URL to webhooks and records it in the audit log.
+func (s *Server) addWebhook(ctx context.Context, req WebhookRequest) (err error) {
+	rawURL := strings.TrimSpace(req.URL)
+	u, urlErr := url.Parse(rawURL)
+	switch {
+	case urlErr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return &userError{"The URL must be an absolute http or https URL.", fmt.Errorf("invalid URL %q", rawURL)}
+	case len(req.Secret) < minWebhookSecretLength:
+		return &userError{fmt.Sprintf("The secret must be at least %d characters.", minWebhookSecretLength), errors.New("short secret")}
+	case len(req.Events) == 0:
+		return &userError{"Select at least one event.", errors.New("no events")}
+	case req.Author == "":
+		return errors.New("author is required")
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(webhookEventTypes, e) {
+			return &userError{"Unknown event type.", fmt.Errorf("invalid event type %q", e)}
+		}
+	}
+	events := strings.Join(req.Events, ",")
+
+	ctx, span := s.DB.startSpan(ctx, "db.addWebhook", s.DB.dialect.q.insertWebhook)
+	defer func() { endSpan(span, err) }()
+	if _, err = s.DB.ExecContext(ctx, s.DB.dialect.q.insertWebhook, rawURL, req.Secret, events, req.Author); err != nil {
+		return fmt.Errorf("failed to add webhook: %w", err)
+	}
+
+	err = s.createAuditEntry(ctx, auditEntry{
+		Actor:  req.Author,
+		Action: auditActionAddWebhook,
+		Target: rawURL,
+		Detail: "events=" + events,
+	})
+	if err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Msg("failed to write audit log of webhook")
+	}
+	return nil
+}
+
+// removeWebhook deletes a webhook with its deliveries and records it in the
+// audit log.
+func (s *Server) removeWebhook(ctx context.Context, id int64, actor string) (err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.removeWebhook", s.DB.dialect.q.deleteWebhook)
+	defer func() { endSpan(span, err) }()
+
+	w, err := scanWebhook(s.DB.QueryRowContext(ctx, s.DB.dialect.q.getWebhook, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &userError{"The webhook does not exist anymore.", err}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get webhook: %w", err)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, s.DB.dialect.q.deleteWebhookDeliveries, id); err != nil {
+		return fmt.Errorf("failed to remove webhook deliveries: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, s.DB.dialect.q.deleteWebhook, id); err != nil {
+		return fmt.Errorf("failed to remove webhook: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to remove webhook: %w", err)
+	}
+
+	err = s.createAuditEntry(ctx, auditEntry{
+		Actor:  actor,
+		Action: auditActionRemoveWebhook,
+		Target: w.URL,
+		Detail: fmt.Sprintf("events=%s author=%s", strings.Join(w.Events, ","), w.CreatedBy),
+	})
+	if err != nil {
+		withTrace(ctx, s.Log).Error().Err(err).Msg("failed to write audit log of webhook removal")
+	}
+	return nil
+}
+
+// listWebhookDeliveries returns the latest limit deliveries, newest first.
+func (s *Server) listWebhookDeliveries(ctx context.Context, limit int) (deliveries []webhookDelivery, err error) {
+	ctx, span := s.DB.startSpan(ctx, "db.listWebhookDeliveries", s.DB.dialect.q.listWebhookDeliveries)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, s.DB.dialect.q.listWebhookDeliveries, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.ID, &d.URL, &d.EventType, &d.Status, &d.Attempts, &d.LastStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func adminWebhooksPageHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		renderAdminWebhooks(ctx, s, http.StatusOK, gin.H{})
+	}
+}
+
+func adminAddWebhookHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		author, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+		err := s.addWebhook(ctx.Request.Context(), WebhookRequest{
+			URL:    ctx.PostForm("url"),
+			Secret: ctx.PostForm("secret"),
+			Events: ctx.PostFormArray("events"),
+			Author: author,
+		})
+		if err != nil {
+			renderAdminWebhooksError(ctx, s, err)
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/admin/webhooks")
+	}
+}
+
+func adminRemoveWebhookHandler(s *Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		actor, _ := sessions.Default(ctx).Get(sessionUserName).(string)
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			err = &userError{"The webhook does not exist.", err}
+		} else {
+			err = s.removeWebhook(ctx.Request.Context(), id, actor)
+		}
+		if err != nil {
+			renderAdminWebhooksError(ctx, s, err)
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/admin/webhooks")
+	}
+}
+
+func renderAdminWebhooksError(ctx *gin.Context, s *Server, err error) {
+	msg := "Failed to update the webhooks."
+	var ue *userError
+	if errors.As(err, &ue) {
+		msg = ue.msg
+	} else {
+		withTrace(ctx.Request.Context(), s.Log).Error().Err(err).Msg("failed to update webhooks")
+	}
+	renderAdminWebhooks(ctx, s, http.StatusUnprocessableEntity, gin.H{"error": msg})
+}
+
+// renderAdminWebhooks renders the webhooks, the form to add them and the
+// delivery log.
+func renderAdminWebhooks(ctx *gin.Context, s *Server, code int, pageContent gin.H) {
+	token, err := csrfToken(ctx)
+	if err != nil {
+		renderError(ctx, "index.gohtml", http.StatusInternalServerError, "Internal error")
+		return
+	}
+	log := withTrace(ctx.Request.Context(), s.Log)
+	hooks, err := s.listWebhooks(ctx.Request.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list webhooks")
+	}
+	deliveries, err := s.listWebhookDeliveries(ctx.Request.Context(), webhookPageSize)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list webhook deliveries")
+	}
+
+	pageContent["username"] = sessions.Default(ctx).Get(sessionUserName)
+	pageContent["csrfToken"] = token
+	pageContent["webhooks"] = hooks
+	pageContent["deliveries"] = deliveries
+	pageContent["eventTypes"] = webhookEventTypes
+	renderHTML(ctx, code, "admin_webhooks.gohtml", pageContent)
+}
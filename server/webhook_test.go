@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "fedcba9876543210"
+
+// webhookReceiver records the webhook requests whose signature is valid and
+// answers them with status.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	payloads []webhookPayload
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := req.Header.Get(headerWebhookSignature), webhookSignature(testWebhookSecret, req.Header.Get(headerWebhookTimestamp), body); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		if req.Header.Get(headerWebhookEvent) != p.Type {
+			t.Errorf("%s = %q, want %q", headerWebhookEvent, req.Header.Get(headerWebhookEvent), p.Type)
+		}
+		r.mu.Lock()
+		r.payloads = append(r.payloads, p)
+		r.mu.Unlock()
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) received() []webhookPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookPayload(nil), r.payloads...)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	err := env.S.addWebhook(t.Context(), WebhookRequest{
+		URL:    receiver.URL,
+		Secret: testWebhookSecret,
+		Events: []string{webhookLoginSucceeded, webhookBounceCreated},
+		Author: "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := env.newBrowser(t)
+	page := b.login(t)
+	if resp, page := b.post(t, "/patch", url.Values{csrfFormField: {csrfTokenFrom(t, page)}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /patch: %s:\n%s", resp.Status, page)
+	}
+	if err := env.S.deliverWebhooks(t.Context(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receiver.received()
+	if len(got) != 2 {
+		t.Fatalf("received %+v, want bounce.created and login.succeeded", got)
+	}
+	types := map[string]map[string]any{}
+	for _, p := range got {
+		types[p.Type], _ = p.Data.(map[string]any)
+	}
+	if bounce := types[webhookBounceCreated]; bounce["mac"] != fixtureMAC || bounce["target_vlan"] != float64(fixtureVLAN) {
+		t.Errorf("bounce.created data = %v, want the job of %s", bounce, fixtureMAC)
+	}
+	if login := types[webhookLoginSucceeded]; login["username"] != env.IdP.User.Username || login["mac"] != fixtureMAC {
+		t.Errorf("login.succeeded data = %v, want the patch of %s", login, env.IdP.User.Username)
+	}
+
+	deliveries, err := env.S.listWebhookDeliveries(t.Context(), webhookPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		if d.Status != deliveryDelivered || d.Attempts != 1 || d.LastStatus.Int64 != http.StatusNoContent || !d.DeliveredAt.Valid {
+			t.Errorf("delivery %+v, want delivered at the first attempt", d)
+		}
+	}
+	// Delivered once only.
+	if err := env.S.deliverWebhooks(t.Context(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(receiver.received()); n != 2 {
+		t.Errorf("received %d requests after the second run, want 2", n)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	env := newTestEnv(t)
+	receiver := newWebhookReceiver(t, http.StatusBadGateway)
+	err := env.S.addWebhook(t.Context(), WebhookRequest{URL: receiver.URL, Secret: testWebhookSecret, Events: []string{webhookBounceFailed}, Author: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.S.emitEvent(t.Context(), outboxEvent{webhookBounceFailed, webhookBounce{JobID: 1, MAC: fixtureMAC, TargetVLAN: fixtureVLAN, Error: "switch timeout"}})
+	// Not subscribed.
+	env.S.emitEvent(t.Context(), outboxEvent{webhookBounceCreated, webhookBounce{MAC: fixtureMAC, TargetVLAN: fixtureVLAN}})
+
+	delivery := func() webhookDelivery {
+		t.Helper()
+		deliveries, err := env.S.listWebhookDeliveries(t.Context(), webhookPageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 {
+			t.Fatalf("deliveries = %+v, want one", deliveries)
+		}
+		return deliveries[0]
+	}
+
+	now := time.Now()
+	if err := env.S.deliverWebhooks(t.Context(), now); err != nil {
+		t.Fatal(err)
+	}
+	if d := delivery(); d.Status != deliveryPending || d.Attempts != 1 || d.LastStatus.Int64 != http.StatusBadGateway || d.LastError.String == "" {
+		t.Errorf("delivery after the first attempt = %+v, want pending", d)
+	}
+	// The retry waits for the backoff.
+	if err := env.S.deliverWebhooks(t.Context(), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(receiver.received()); n != 1 {
+		t.Errorf("received %d requests before the backoff, want 1", n)
+	}
+	if err := env.S.deliverWebhooks(t.Context(), now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if d := delivery(); d.Status != deliveryFailed || d.Attempts != testMaxRetries {
+		t.Errorf("delivery after the last attempt = %+v, want failed", d)
+	}
+	if got := receiver.received(); len(got) != 2 || got[1].ID != got[0].ID {
+		t.Errorf("received %+v, want the same event twice", got)
+	}
+}
+
+func TestWebhookAdminPage(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.newBrowser(t)
+	admin.login(t)
+
+	_, page := admin.get(t, "/admin/webhooks")
+	resp, page := admin.post(t, "/admin/webhooks", url.Values{
+		csrfFormField: {csrfTokenFrom(t, page)},
+		"url":         {"https://chat.example.org/hooks/orga"},
+		"secret":      {testWebhookSecret},
+		"events":      {webhookLoginFailed, webhookBounceFailed},
+	})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/admin/webhooks" {
+		t.Fatalf("POST /admin/webhooks ended on %s with %s:\n%s", resp.Request.URL, resp.Status, page)
+	}
+	if !strings.Contains(page, "https://chat.example.org/hooks/orga") || !strings.Contains(page, webhookLoginFailed+", "+webhookBounceFailed) {
+		t.Errorf("admin page does not list the webhook:\n%s", page)
+	}
+	if strings.Contains(page, testWebhookSecret) {
+		t.Error("admin page shows the secret")
+	}
+
+	for name, form := range map[string]url.Values{
+		"relative URL":  {"url": {"/hooks"}, "secret": {testWebhookSecret}, "events": {webhookLoginFailed}},
+		"short secret":  {"url": {"https://example.org"}, "secret": {"secret"}, "events": {webhookLoginFailed}},
+		"no events":     {"url": {"https://example.org"}, "secret": {testWebhookSecret}},
+		"unknown event": {"url": {"https://example.org"}, "secret": {testWebhookSecret}, "events": {"device.stolen"}},
+	} {
+		form.Set(csrfFormField, csrfTokenFrom(t, page))
+		if resp, page := admin.post(t, "/admin/webhooks", form); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("POST /admin/webhooks with %s: %s, want %d:\n%s", name, resp.Status, http.StatusUnprocessableEntity, page)
+		}
+	}
+
+	hooks, err := env.S.listWebhooks(t.Context())
+	if err != nil || len(hooks) != 1 {
+		t.Fatalf("listWebhooks() = %v, %v, want one webhook", hooks, err)
+	}
+	env.S.emitEvent(t.Context(), outboxEvent{webhookLoginFailed, webhookLogin{Username: "bob", Error: "not checked in"}})
+	_, page = admin.get(t, "/admin/webhooks")
+	if !strings.Contains(page, "Deliveries") || !strings.Contains(page, deliveryPending) {
+		t.Errorf("admin page does not show the pending delivery:\n%s", page)
+	}
+
+	resp, page = admin.post(t, "/admin/webhooks/"+strconv.FormatInt(hooks[0].ID, 10)+"/delete", url.Values{csrfFormField: {csrfTokenFrom(t, page)}})
+	if resp.StatusCode != http.StatusOK || strings.Contains(page, "chat.example.org") {
+		t.Errorf("POST delete: %s, want the webhook and its deliveries removed:\n%s", resp.Status, page)
+	}
+	audit, err := env.S.listAuditEntries(t.Context(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 2 || audit[0].Action != auditActionRemoveWebhook || audit[1].Action != auditActionAddWebhook {
+		t.Errorf("audit log = %+v, want add and remove", audit)
+	}
+}
@@ -0,0 +1,5 @@
+// Submits forms marked with data-autosubmit right away, so users do not have
+// to click again after returning from the login.
+document.querySelectorAll("form[data-autosubmit]").forEach(function (form) {
+  form.submit();
+});
@@ -0,0 +1,25 @@
+// Shows the progress of the bounce job on the success page, streamed from
+// /progress, so users know when to re-plug.
+(function () {
+  var status = document.getElementById("progress");
+  if (!status || !window.EventSource) {
+    return;
+  }
+  var alerts = {
+    queued: "alert-info",
+    bouncing: "alert-info",
+    reconnecting: "alert-info",
+    connected: "alert-success",
+    timeout: "alert-warning",
+    failed: "alert-danger",
+  };
+  var source = new EventSource("/progress");
+  source.addEventListener("progress", function (event) {
+    var progress = JSON.parse(event.data);
+    status.textContent = progress.message;
+    status.className = "alert " + (alerts[progress.state] || "alert-info");
+    if (progress.final) {
+      source.close();
+    }
+  });
+})();
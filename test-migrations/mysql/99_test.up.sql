@@ -17,6 +17,7 @@ CREATE TABLE users (
 CREATE TABLE radacct (
     username VARCHAR(32) NOT NULL,
     nasipaddress VARCHAR(32) NOT NULL,
+    acctstarttime DATETIME NULL DEFAULT NULL,
     acctstoptime VARCHAR(32) DEFAULT NULL
 );
 
@@ -0,0 +1,92 @@
+-- Create initial version of the database (see: https://github.com/rubenv/sql-migrate#writing-migrations)
+-- +migrate Up
+CREATE TABLE bouncer_jobs (
+    id SERIAL PRIMARY KEY,
+    clientMAC VARCHAR(32) NOT NULL,
+    targetVLAN SMALLINT NOT NULL,
+    last_update TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    retires INT DEFAULT 0 NOT NULL
+);
+
+CREATE TABLE users (
+    mac VARCHAR(255) NOT NULL,
+    switch VARCHAR(255) NOT NULL,
+    ip VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE radacct (
+    username TEXT NOT NULL,
+    nasipaddress INET NOT NULL,
+    acctstarttime TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+    acctstoptime TIMESTAMP WITH TIME ZONE DEFAULT NULL
+);
+
+CREATE TABLE lease4 (
+    address BIGINT NOT NULL,
+    hwaddr BYTEA NOT NULL
+);
+
+CREATE TABLE login_logs (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    username VARCHAR(255) NULL,
+    mac VARCHAR(255) NULL
+);
+
+CREATE INDEX idx_date ON login_logs (created_at);
+CREATE INDEX idx_name ON login_logs (username);
+CREATE INDEX idx_mac ON login_logs (mac);
+
+CREATE TABLE bouncer_switch_map (
+    id SERIAL PRIMARY KEY,
+    primary_vlan INTEGER NOT NULL UNIQUE,
+    hostname VARCHAR(255) NOT NULL,
+    location VARCHAR(255) NULL
+);
+
+CREATE TABLE bouncer_switch_ip (
+    id SERIAL PRIMARY KEY,
+    switch_id INTEGER NOT NULL REFERENCES bouncer_switch_map(id),
+    ip VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX idx_ip ON bouncer_switch_ip (ip);
+CREATE INDEX idx_switch_id ON bouncer_switch_ip (switch_id);
+
+-- 127.0.0.1 -> 127 * 2**24 + 0 * 2**16 + 0 * 2**8 + 1 * 2**0
+-- 61:62:63:64:65:66 -> abcdef
+INSERT INTO
+    lease4(address, hwaddr)
+VALUES
+    (2130706433, '\x616263646566');
+
+INSERT INTO
+    radacct(username, nasipaddress, acctstoptime)
+VALUES
+    ('616263646566', '10.233.254.27', NULL);
+
+INSERT INTO
+    bouncer_switch_map(id, primary_vlan, hostname, location)
+VALUES
+    (1, 527, 'user27.lan.geco.ethz.ch', 'test');
+
+INSERT INTO
+    bouncer_switch_ip(switch_id, ip)
+VALUES
+    (1, '10.233.254.27');
+
+-- +migrate Down
+DROP TABLE lease4;
+
+DROP TABLE radacct;
+
+DROP TABLE users;
+
+DROP TABLE bouncer_jobs;
+
+DROP TABLE login_logs;
+
+DROP TABLE bouncer_switch_ip;
+
+DROP TABLE bouncer_switch_map;